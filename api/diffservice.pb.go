@@ -20,9 +20,48 @@ var _ = math.Inf
 // proto package needs to be updated.
 const _ = proto.ProtoPackageIsVersion3 // please upgrade the proto package
 
+type DeltaPhase int32
+
+const (
+	DeltaPhase_DELTA_PHASE_UNSPECIFIED DeltaPhase = 0
+	DeltaPhase_DELTA_PHASE_PULLING     DeltaPhase = 1
+	DeltaPhase_DELTA_PHASE_GENERATING  DeltaPhase = 2
+	DeltaPhase_DELTA_PHASE_COMPRESSING DeltaPhase = 3
+	DeltaPhase_DELTA_PHASE_SENDING     DeltaPhase = 4
+)
+
+var DeltaPhase_name = map[int32]string{
+	0: "DELTA_PHASE_UNSPECIFIED",
+	1: "DELTA_PHASE_PULLING",
+	2: "DELTA_PHASE_GENERATING",
+	3: "DELTA_PHASE_COMPRESSING",
+	4: "DELTA_PHASE_SENDING",
+}
+
+var DeltaPhase_value = map[string]int32{
+	"DELTA_PHASE_UNSPECIFIED": 0,
+	"DELTA_PHASE_PULLING":     1,
+	"DELTA_PHASE_GENERATING":  2,
+	"DELTA_PHASE_COMPRESSING": 3,
+	"DELTA_PHASE_SENDING":     4,
+}
+
+func (x DeltaPhase) String() string {
+	return proto.EnumName(DeltaPhase_name, int32(x))
+}
+
+func (DeltaPhase) EnumDescriptor() ([]byte, []int) {
+	return fileDescriptor_9cc1287a3435a7b8, []int{0}
+}
+
 type CalcImageDiffsRequest struct {
 	Image1               *Image   `protobuf:"bytes,1,opt,name=image1,proto3" json:"image1,omitempty"`
 	Image2               *Image   `protobuf:"bytes,2,opt,name=image2,proto3" json:"image2,omitempty"`
+	Namespace            string   `protobuf:"bytes,3,opt,name=namespace,proto3" json:"namespace,omitempty"`
+	Os                   string   `protobuf:"bytes,4,opt,name=os,proto3" json:"os,omitempty"`
+	Arch                 string   `protobuf:"bytes,5,opt,name=arch,proto3" json:"arch,omitempty"`
+	Variant              string   `protobuf:"bytes,6,opt,name=variant,proto3" json:"variant,omitempty"`
+	OsVersion            string   `protobuf:"bytes,7,opt,name=os_version,json=osVersion,proto3" json:"os_version,omitempty"`
 	XXX_NoUnkeyedLiteral struct{} `json:"-"`
 	XXX_unrecognized     []byte   `json:"-"`
 	XXX_sizecache        int32    `json:"-"`
@@ -67,11 +106,48 @@ func (m *CalcImageDiffsRequest) GetImage2() *Image {
 	return nil
 }
 
+func (m *CalcImageDiffsRequest) GetNamespace() string {
+	if m != nil {
+		return m.Namespace
+	}
+	return ""
+}
+
+func (m *CalcImageDiffsRequest) GetOs() string {
+	if m != nil {
+		return m.Os
+	}
+	return ""
+}
+
+func (m *CalcImageDiffsRequest) GetArch() string {
+	if m != nil {
+		return m.Arch
+	}
+	return ""
+}
+
+func (m *CalcImageDiffsRequest) GetVariant() string {
+	if m != nil {
+		return m.Variant
+	}
+	return ""
+}
+
+func (m *CalcImageDiffsRequest) GetOsVersion() string {
+	if m != nil {
+		return m.OsVersion
+	}
+	return ""
+}
+
 type CalculateDeltaDiffsResponse struct {
-	DeltaDiff            []byte   `protobuf:"bytes,1,opt,name=delta_diff,json=deltaDiff,proto3" json:"delta_diff,omitempty"`
-	XXX_NoUnkeyedLiteral struct{} `json:"-"`
-	XXX_unrecognized     []byte   `json:"-"`
-	XXX_sizecache        int32    `json:"-"`
+	DeltaDiff            []byte     `protobuf:"bytes,1,opt,name=delta_diff,json=deltaDiff,proto3" json:"delta_diff,omitempty"`
+	Phase                DeltaPhase `protobuf:"varint,2,opt,name=phase,proto3,enum=deltadiff.DeltaPhase" json:"phase,omitempty"`
+	TotalSize            int64      `protobuf:"varint,3,opt,name=total_size,json=totalSize,proto3" json:"total_size,omitempty"`
+	XXX_NoUnkeyedLiteral struct{}   `json:"-"`
+	XXX_unrecognized     []byte     `json:"-"`
+	XXX_sizecache        int32      `json:"-"`
 }
 
 func (m *CalculateDeltaDiffsResponse) Reset()         { *m = CalculateDeltaDiffsResponse{} }
@@ -106,10 +182,27 @@ func (m *CalculateDeltaDiffsResponse) GetDeltaDiff() []byte {
 	return nil
 }
 
+func (m *CalculateDeltaDiffsResponse) GetPhase() DeltaPhase {
+	if m != nil {
+		return m.Phase
+	}
+	return DeltaPhase_DELTA_PHASE_UNSPECIFIED
+}
+
+func (m *CalculateDeltaDiffsResponse) GetTotalSize() int64 {
+	if m != nil {
+		return m.TotalSize
+	}
+	return 0
+}
+
 type ManifestRequest struct {
 	Image                *Image   `protobuf:"bytes,1,opt,name=image,proto3" json:"image,omitempty"`
 	Os                   string   `protobuf:"bytes,2,opt,name=os,proto3" json:"os,omitempty"`
 	Arch                 string   `protobuf:"bytes,3,opt,name=arch,proto3" json:"arch,omitempty"`
+	Namespace            string   `protobuf:"bytes,4,opt,name=namespace,proto3" json:"namespace,omitempty"`
+	Variant              string   `protobuf:"bytes,5,opt,name=variant,proto3" json:"variant,omitempty"`
+	OsVersion            string   `protobuf:"bytes,6,opt,name=os_version,json=osVersion,proto3" json:"os_version,omitempty"`
 	XXX_NoUnkeyedLiteral struct{} `json:"-"`
 	XXX_unrecognized     []byte   `json:"-"`
 	XXX_sizecache        int32    `json:"-"`
@@ -161,9 +254,34 @@ func (m *ManifestRequest) GetArch() string {
 	return ""
 }
 
+func (m *ManifestRequest) GetNamespace() string {
+	if m != nil {
+		return m.Namespace
+	}
+	return ""
+}
+
+func (m *ManifestRequest) GetVariant() string {
+	if m != nil {
+		return m.Variant
+	}
+	return ""
+}
+
+func (m *ManifestRequest) GetOsVersion() string {
+	if m != nil {
+		return m.OsVersion
+	}
+	return ""
+}
+
 type ManifestResponse struct {
 	Manifest             []byte   `protobuf:"bytes,1,opt,name=manifest,proto3" json:"manifest,omitempty"`
 	ImageConfig          []byte   `protobuf:"bytes,2,opt,name=imageConfig,proto3" json:"imageConfig,omitempty"`
+	MediaType            string   `protobuf:"bytes,3,opt,name=media_type,json=mediaType,proto3" json:"media_type,omitempty"`
+	Index                []byte   `protobuf:"bytes,4,opt,name=index,proto3" json:"index,omitempty"`
+	IndexMediaType       string   `protobuf:"bytes,5,opt,name=index_media_type,json=indexMediaType,proto3" json:"index_media_type,omitempty"`
+	ImageDigest          string   `protobuf:"bytes,6,opt,name=image_digest,json=imageDigest,proto3" json:"image_digest,omitempty"`
 	XXX_NoUnkeyedLiteral struct{} `json:"-"`
 	XXX_unrecognized     []byte   `json:"-"`
 	XXX_sizecache        int32    `json:"-"`
@@ -208,6 +326,420 @@ func (m *ManifestResponse) GetImageConfig() []byte {
 	return nil
 }
 
+func (m *ManifestResponse) GetMediaType() string {
+	if m != nil {
+		return m.MediaType
+	}
+	return ""
+}
+
+func (m *ManifestResponse) GetIndex() []byte {
+	if m != nil {
+		return m.Index
+	}
+	return nil
+}
+
+func (m *ManifestResponse) GetIndexMediaType() string {
+	if m != nil {
+		return m.IndexMediaType
+	}
+	return ""
+}
+
+func (m *ManifestResponse) GetImageDigest() string {
+	if m != nil {
+		return m.ImageDigest
+	}
+	return ""
+}
+
+type LayerMetadataRequest struct {
+	Image                *Image   `protobuf:"bytes,1,opt,name=image,proto3" json:"image,omitempty"`
+	Namespace            string   `protobuf:"bytes,2,opt,name=namespace,proto3" json:"namespace,omitempty"`
+	Os                   string   `protobuf:"bytes,3,opt,name=os,proto3" json:"os,omitempty"`
+	Arch                 string   `protobuf:"bytes,4,opt,name=arch,proto3" json:"arch,omitempty"`
+	Variant              string   `protobuf:"bytes,5,opt,name=variant,proto3" json:"variant,omitempty"`
+	OsVersion            string   `protobuf:"bytes,6,opt,name=os_version,json=osVersion,proto3" json:"os_version,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *LayerMetadataRequest) Reset()         { *m = LayerMetadataRequest{} }
+func (m *LayerMetadataRequest) String() string { return proto.CompactTextString(m) }
+func (*LayerMetadataRequest) ProtoMessage()    {}
+func (*LayerMetadataRequest) Descriptor() ([]byte, []int) {
+	return fileDescriptor_9cc1287a3435a7b8, []int{4}
+}
+
+func (m *LayerMetadataRequest) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_LayerMetadataRequest.Unmarshal(m, b)
+}
+func (m *LayerMetadataRequest) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_LayerMetadataRequest.Marshal(b, m, deterministic)
+}
+func (m *LayerMetadataRequest) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_LayerMetadataRequest.Merge(m, src)
+}
+func (m *LayerMetadataRequest) XXX_Size() int {
+	return xxx_messageInfo_LayerMetadataRequest.Size(m)
+}
+func (m *LayerMetadataRequest) XXX_DiscardUnknown() {
+	xxx_messageInfo_LayerMetadataRequest.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_LayerMetadataRequest proto.InternalMessageInfo
+
+func (m *LayerMetadataRequest) GetImage() *Image {
+	if m != nil {
+		return m.Image
+	}
+	return nil
+}
+
+func (m *LayerMetadataRequest) GetNamespace() string {
+	if m != nil {
+		return m.Namespace
+	}
+	return ""
+}
+
+func (m *LayerMetadataRequest) GetOs() string {
+	if m != nil {
+		return m.Os
+	}
+	return ""
+}
+
+func (m *LayerMetadataRequest) GetArch() string {
+	if m != nil {
+		return m.Arch
+	}
+	return ""
+}
+
+func (m *LayerMetadataRequest) GetVariant() string {
+	if m != nil {
+		return m.Variant
+	}
+	return ""
+}
+
+func (m *LayerMetadataRequest) GetOsVersion() string {
+	if m != nil {
+		return m.OsVersion
+	}
+	return ""
+}
+
+type LayerMetadataResponse struct {
+	Chunk                []byte   `protobuf:"bytes,1,opt,name=chunk,proto3" json:"chunk,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *LayerMetadataResponse) Reset()         { *m = LayerMetadataResponse{} }
+func (m *LayerMetadataResponse) String() string { return proto.CompactTextString(m) }
+func (*LayerMetadataResponse) ProtoMessage()    {}
+func (*LayerMetadataResponse) Descriptor() ([]byte, []int) {
+	return fileDescriptor_9cc1287a3435a7b8, []int{5}
+}
+
+func (m *LayerMetadataResponse) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_LayerMetadataResponse.Unmarshal(m, b)
+}
+func (m *LayerMetadataResponse) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_LayerMetadataResponse.Marshal(b, m, deterministic)
+}
+func (m *LayerMetadataResponse) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_LayerMetadataResponse.Merge(m, src)
+}
+func (m *LayerMetadataResponse) XXX_Size() int {
+	return xxx_messageInfo_LayerMetadataResponse.Size(m)
+}
+func (m *LayerMetadataResponse) XXX_DiscardUnknown() {
+	xxx_messageInfo_LayerMetadataResponse.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_LayerMetadataResponse proto.InternalMessageInfo
+
+func (m *LayerMetadataResponse) GetChunk() []byte {
+	if m != nil {
+		return m.Chunk
+	}
+	return nil
+}
+
+type DiffImageConfigRequest struct {
+	Image1               *Image   `protobuf:"bytes,1,opt,name=image1,proto3" json:"image1,omitempty"`
+	Image2               *Image   `protobuf:"bytes,2,opt,name=image2,proto3" json:"image2,omitempty"`
+	Namespace            string   `protobuf:"bytes,3,opt,name=namespace,proto3" json:"namespace,omitempty"`
+	Os                   string   `protobuf:"bytes,4,opt,name=os,proto3" json:"os,omitempty"`
+	Arch                 string   `protobuf:"bytes,5,opt,name=arch,proto3" json:"arch,omitempty"`
+	Variant              string   `protobuf:"bytes,6,opt,name=variant,proto3" json:"variant,omitempty"`
+	OsVersion            string   `protobuf:"bytes,7,opt,name=os_version,json=osVersion,proto3" json:"os_version,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *DiffImageConfigRequest) Reset()         { *m = DiffImageConfigRequest{} }
+func (m *DiffImageConfigRequest) String() string { return proto.CompactTextString(m) }
+func (*DiffImageConfigRequest) ProtoMessage()    {}
+func (*DiffImageConfigRequest) Descriptor() ([]byte, []int) {
+	return fileDescriptor_9cc1287a3435a7b8, []int{6}
+}
+
+func (m *DiffImageConfigRequest) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_DiffImageConfigRequest.Unmarshal(m, b)
+}
+func (m *DiffImageConfigRequest) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_DiffImageConfigRequest.Marshal(b, m, deterministic)
+}
+func (m *DiffImageConfigRequest) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_DiffImageConfigRequest.Merge(m, src)
+}
+func (m *DiffImageConfigRequest) XXX_Size() int {
+	return xxx_messageInfo_DiffImageConfigRequest.Size(m)
+}
+func (m *DiffImageConfigRequest) XXX_DiscardUnknown() {
+	xxx_messageInfo_DiffImageConfigRequest.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_DiffImageConfigRequest proto.InternalMessageInfo
+
+func (m *DiffImageConfigRequest) GetImage1() *Image {
+	if m != nil {
+		return m.Image1
+	}
+	return nil
+}
+
+func (m *DiffImageConfigRequest) GetImage2() *Image {
+	if m != nil {
+		return m.Image2
+	}
+	return nil
+}
+
+func (m *DiffImageConfigRequest) GetNamespace() string {
+	if m != nil {
+		return m.Namespace
+	}
+	return ""
+}
+
+func (m *DiffImageConfigRequest) GetOs() string {
+	if m != nil {
+		return m.Os
+	}
+	return ""
+}
+
+func (m *DiffImageConfigRequest) GetArch() string {
+	if m != nil {
+		return m.Arch
+	}
+	return ""
+}
+
+func (m *DiffImageConfigRequest) GetVariant() string {
+	if m != nil {
+		return m.Variant
+	}
+	return ""
+}
+
+func (m *DiffImageConfigRequest) GetOsVersion() string {
+	if m != nil {
+		return m.OsVersion
+	}
+	return ""
+}
+
+type DiffImageConfigResponse struct {
+	Config               []*Change `protobuf:"bytes,1,rep,name=config,proto3" json:"config,omitempty"`
+	Annotations          []*Change `protobuf:"bytes,2,rep,name=annotations,proto3" json:"annotations,omitempty"`
+	LayersAdded          []*Layer  `protobuf:"bytes,3,rep,name=layers_added,json=layersAdded,proto3" json:"layers_added,omitempty"`
+	LayersRemoved        []*Layer  `protobuf:"bytes,4,rep,name=layers_removed,json=layersRemoved,proto3" json:"layers_removed,omitempty"`
+	XXX_NoUnkeyedLiteral struct{}  `json:"-"`
+	XXX_unrecognized     []byte    `json:"-"`
+	XXX_sizecache        int32     `json:"-"`
+}
+
+func (m *DiffImageConfigResponse) Reset()         { *m = DiffImageConfigResponse{} }
+func (m *DiffImageConfigResponse) String() string { return proto.CompactTextString(m) }
+func (*DiffImageConfigResponse) ProtoMessage()    {}
+func (*DiffImageConfigResponse) Descriptor() ([]byte, []int) {
+	return fileDescriptor_9cc1287a3435a7b8, []int{7}
+}
+
+func (m *DiffImageConfigResponse) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_DiffImageConfigResponse.Unmarshal(m, b)
+}
+func (m *DiffImageConfigResponse) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_DiffImageConfigResponse.Marshal(b, m, deterministic)
+}
+func (m *DiffImageConfigResponse) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_DiffImageConfigResponse.Merge(m, src)
+}
+func (m *DiffImageConfigResponse) XXX_Size() int {
+	return xxx_messageInfo_DiffImageConfigResponse.Size(m)
+}
+func (m *DiffImageConfigResponse) XXX_DiscardUnknown() {
+	xxx_messageInfo_DiffImageConfigResponse.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_DiffImageConfigResponse proto.InternalMessageInfo
+
+func (m *DiffImageConfigResponse) GetConfig() []*Change {
+	if m != nil {
+		return m.Config
+	}
+	return nil
+}
+
+func (m *DiffImageConfigResponse) GetAnnotations() []*Change {
+	if m != nil {
+		return m.Annotations
+	}
+	return nil
+}
+
+func (m *DiffImageConfigResponse) GetLayersAdded() []*Layer {
+	if m != nil {
+		return m.LayersAdded
+	}
+	return nil
+}
+
+func (m *DiffImageConfigResponse) GetLayersRemoved() []*Layer {
+	if m != nil {
+		return m.LayersRemoved
+	}
+	return nil
+}
+
+type Change struct {
+	Field                string   `protobuf:"bytes,1,opt,name=field,proto3" json:"field,omitempty"`
+	Key                  string   `protobuf:"bytes,2,opt,name=key,proto3" json:"key,omitempty"`
+	Old                  string   `protobuf:"bytes,3,opt,name=old,proto3" json:"old,omitempty"`
+	New                  string   `protobuf:"bytes,4,opt,name=new,proto3" json:"new,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *Change) Reset()         { *m = Change{} }
+func (m *Change) String() string { return proto.CompactTextString(m) }
+func (*Change) ProtoMessage()    {}
+func (*Change) Descriptor() ([]byte, []int) {
+	return fileDescriptor_9cc1287a3435a7b8, []int{8}
+}
+
+func (m *Change) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_Change.Unmarshal(m, b)
+}
+func (m *Change) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_Change.Marshal(b, m, deterministic)
+}
+func (m *Change) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_Change.Merge(m, src)
+}
+func (m *Change) XXX_Size() int {
+	return xxx_messageInfo_Change.Size(m)
+}
+func (m *Change) XXX_DiscardUnknown() {
+	xxx_messageInfo_Change.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_Change proto.InternalMessageInfo
+
+func (m *Change) GetField() string {
+	if m != nil {
+		return m.Field
+	}
+	return ""
+}
+
+func (m *Change) GetKey() string {
+	if m != nil {
+		return m.Key
+	}
+	return ""
+}
+
+func (m *Change) GetOld() string {
+	if m != nil {
+		return m.Old
+	}
+	return ""
+}
+
+func (m *Change) GetNew() string {
+	if m != nil {
+		return m.New
+	}
+	return ""
+}
+
+type Layer struct {
+	Digest               string   `protobuf:"bytes,1,opt,name=digest,proto3" json:"digest,omitempty"`
+	MediaType            string   `protobuf:"bytes,2,opt,name=media_type,json=mediaType,proto3" json:"media_type,omitempty"`
+	Size                 int64    `protobuf:"varint,3,opt,name=size,proto3" json:"size,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *Layer) Reset()         { *m = Layer{} }
+func (m *Layer) String() string { return proto.CompactTextString(m) }
+func (*Layer) ProtoMessage()    {}
+func (*Layer) Descriptor() ([]byte, []int) {
+	return fileDescriptor_9cc1287a3435a7b8, []int{9}
+}
+
+func (m *Layer) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_Layer.Unmarshal(m, b)
+}
+func (m *Layer) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_Layer.Marshal(b, m, deterministic)
+}
+func (m *Layer) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_Layer.Merge(m, src)
+}
+func (m *Layer) XXX_Size() int {
+	return xxx_messageInfo_Layer.Size(m)
+}
+func (m *Layer) XXX_DiscardUnknown() {
+	xxx_messageInfo_Layer.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_Layer proto.InternalMessageInfo
+
+func (m *Layer) GetDigest() string {
+	if m != nil {
+		return m.Digest
+	}
+	return ""
+}
+
+func (m *Layer) GetMediaType() string {
+	if m != nil {
+		return m.MediaType
+	}
+	return ""
+}
+
+func (m *Layer) GetSize() int64 {
+	if m != nil {
+		return m.Size
+	}
+	return 0
+}
+
 type Image struct {
 	Reference            string   `protobuf:"bytes,1,opt,name=reference,proto3" json:"reference,omitempty"`
 	XXX_NoUnkeyedLiteral struct{} `json:"-"`
@@ -219,7 +751,7 @@ func (m *Image) Reset()         { *m = Image{} }
 func (m *Image) String() string { return proto.CompactTextString(m) }
 func (*Image) ProtoMessage()    {}
 func (*Image) Descriptor() ([]byte, []int) {
-	return fileDescriptor_9cc1287a3435a7b8, []int{4}
+	return fileDescriptor_9cc1287a3435a7b8, []int{10}
 }
 
 func (m *Image) XXX_Unmarshal(b []byte) error {
@@ -248,10 +780,17 @@ func (m *Image) GetReference() string {
 }
 
 func init() {
+	proto.RegisterEnum("deltadiff.DeltaPhase", DeltaPhase_name, DeltaPhase_value)
 	proto.RegisterType((*CalcImageDiffsRequest)(nil), "deltadiff.CalcImageDiffsRequest")
 	proto.RegisterType((*CalculateDeltaDiffsResponse)(nil), "deltadiff.CalculateDeltaDiffsResponse")
 	proto.RegisterType((*ManifestRequest)(nil), "deltadiff.ManifestRequest")
 	proto.RegisterType((*ManifestResponse)(nil), "deltadiff.ManifestResponse")
+	proto.RegisterType((*LayerMetadataRequest)(nil), "deltadiff.LayerMetadataRequest")
+	proto.RegisterType((*LayerMetadataResponse)(nil), "deltadiff.LayerMetadataResponse")
+	proto.RegisterType((*DiffImageConfigRequest)(nil), "deltadiff.DiffImageConfigRequest")
+	proto.RegisterType((*DiffImageConfigResponse)(nil), "deltadiff.DiffImageConfigResponse")
+	proto.RegisterType((*Change)(nil), "deltadiff.Change")
+	proto.RegisterType((*Layer)(nil), "deltadiff.Layer")
 	proto.RegisterType((*Image)(nil), "deltadiff.Image")
 }
 
@@ -260,26 +799,58 @@ func init() {
 }
 
 var fileDescriptor_9cc1287a3435a7b8 = []byte{
-	// 321 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x7c, 0x92, 0x41, 0x4b, 0xc3, 0x40,
-	0x10, 0x85, 0x49, 0xb5, 0xd5, 0x4c, 0x8b, 0x96, 0x91, 0x42, 0x49, 0x15, 0x4a, 0xc0, 0xd2, 0x53,
-	0xaa, 0xf1, 0xea, 0xc9, 0x16, 0xc5, 0x83, 0x20, 0xeb, 0x4d, 0x10, 0x59, 0xd3, 0x49, 0x5d, 0x6c,
-	0xb3, 0x31, 0xbb, 0xf5, 0xdf, 0xf9, 0xdf, 0x64, 0x37, 0x69, 0x1a, 0x4a, 0xea, 0x2d, 0x79, 0xf3,
-	0xe6, 0xcd, 0xb7, 0xb3, 0x0b, 0x3d, 0x9e, 0x8a, 0xc9, 0x5c, 0xc4, 0xb1, 0xa2, 0xec, 0x47, 0x44,
-	0x14, 0xa4, 0x99, 0xd4, 0x12, 0xdd, 0x39, 0x2d, 0x35, 0x37, 0xba, 0xff, 0x05, 0xbd, 0x29, 0x5f,
-	0x46, 0x8f, 0x2b, 0xbe, 0xa0, 0x99, 0x31, 0x32, 0xfa, 0x5e, 0x93, 0xd2, 0x38, 0x86, 0x96, 0x30,
-	0xe2, 0x75, 0xdf, 0x19, 0x3a, 0xe3, 0x76, 0xd8, 0x0d, 0xca, 0xa6, 0xc0, 0xba, 0x59, 0x51, 0x2f,
-	0x9d, 0x61, 0xbf, 0xf1, 0xaf, 0x33, 0xf4, 0x6f, 0x61, 0x60, 0x86, 0xad, 0x97, 0x5c, 0xd3, 0xcc,
-	0x78, 0x8a, 0x89, 0x2a, 0x95, 0x89, 0x22, 0xbc, 0x00, 0xb0, 0x9d, 0xef, 0xa6, 0xd5, 0x8e, 0xed,
-	0xb0, 0x1c, 0xd5, 0xf8, 0xfc, 0x37, 0x38, 0x7d, 0xe2, 0x89, 0x88, 0x49, 0xe9, 0x0d, 0xe4, 0x08,
-	0x9a, 0x36, 0x7a, 0x2f, 0x63, 0x5e, 0xc6, 0x13, 0x68, 0x48, 0x65, 0xf1, 0x5c, 0xd6, 0x90, 0x0a,
-	0x11, 0x0e, 0x79, 0x16, 0x7d, 0xf6, 0x0f, 0xac, 0x62, 0xbf, 0xfd, 0x67, 0xe8, 0x6e, 0xe3, 0x0b,
-	0x22, 0x0f, 0x8e, 0x57, 0x85, 0x56, 0xf0, 0x94, 0xff, 0x38, 0x84, 0xb6, 0x0d, 0x9f, 0xca, 0x24,
-	0x16, 0x0b, 0x1b, 0xde, 0x61, 0x55, 0xc9, 0xbf, 0x84, 0xa6, 0xa5, 0xc0, 0x73, 0x70, 0x33, 0x8a,
-	0x29, 0xa3, 0x24, 0xca, 0x51, 0x5d, 0xb6, 0x15, 0xc2, 0x5f, 0x07, 0xba, 0xe5, 0x36, 0x5e, 0xf2,
-	0x8b, 0x42, 0x0e, 0x67, 0x35, 0xab, 0xc2, 0x61, 0xe5, 0x84, 0xb5, 0xf7, 0xe6, 0x8d, 0x76, 0x1c,
-	0x7b, 0x96, 0x7d, 0xe5, 0xe0, 0x3d, 0xb4, 0x1f, 0x48, 0x6f, 0xce, 0x8c, 0x5e, 0xa5, 0x71, 0x67,
-	0xcf, 0xde, 0xa0, 0xb6, 0x96, 0x27, 0xdd, 0x1d, 0xbd, 0x36, 0x83, 0x09, 0x4f, 0xc5, 0x47, 0xcb,
-	0xbe, 0xae, 0x9b, 0xbf, 0x00, 0x00, 0x00, 0xff, 0xff, 0xe1, 0x22, 0x72, 0xf8, 0x76, 0x02, 0x00,
-	0x00,
+	// 845 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0xdc, 0x56, 0xdf, 0x72, 0xf2, 0x44,
+	0x14, 0x37, 0x09, 0xa1, 0x72, 0x40, 0xbe, 0xb8, 0x5f, 0x69, 0x33, 0x54, 0x47, 0x9a, 0x19, 0x3b,
+	0xa8, 0x23, 0x55, 0x7a, 0xe1, 0x35, 0x42, 0x8a, 0xcc, 0x00, 0x32, 0x81, 0xaa, 0xe3, 0x4d, 0x66,
+	0x25, 0x4b, 0xd9, 0x29, 0x24, 0x31, 0x49, 0x51, 0xfa, 0x04, 0x3e, 0x80, 0x8f, 0xe2, 0x8d, 0xaf,
+	0xe1, 0x43, 0xd8, 0x5b, 0x1f, 0xc1, 0xd9, 0x3f, 0x40, 0x9a, 0x42, 0x67, 0x7a, 0xfb, 0xdd, 0xed,
+	0xfe, 0xce, 0x6f, 0x4f, 0xce, 0xf9, 0x9d, 0xb3, 0x7b, 0x02, 0x15, 0x1c, 0xd2, 0x4b, 0x8f, 0xce,
+	0x66, 0x31, 0x89, 0x56, 0x74, 0x4a, 0x1a, 0x61, 0x14, 0x24, 0x01, 0x2a, 0x78, 0x64, 0x91, 0x60,
+	0x86, 0x5b, 0xff, 0x2a, 0x50, 0x69, 0xe3, 0xc5, 0xb4, 0xb7, 0xc4, 0xb7, 0xa4, 0xc3, 0x98, 0x0e,
+	0xf9, 0xf5, 0x9e, 0xc4, 0x09, 0xaa, 0x43, 0x9e, 0x32, 0xf0, 0x6b, 0x53, 0xa9, 0x29, 0xf5, 0x62,
+	0xd3, 0x68, 0x6c, 0x4f, 0x35, 0x38, 0xdb, 0x91, 0xf6, 0x2d, 0xb3, 0x69, 0xaa, 0x2f, 0x32, 0x9b,
+	0xe8, 0x23, 0x28, 0xf8, 0x78, 0x49, 0xe2, 0x10, 0x4f, 0x89, 0xa9, 0xd5, 0x94, 0x7a, 0xc1, 0xd9,
+	0x01, 0xa8, 0x0c, 0x6a, 0x10, 0x9b, 0x39, 0x0e, 0xab, 0x41, 0x8c, 0x10, 0xe4, 0x70, 0x34, 0x9d,
+	0x9b, 0x3a, 0x47, 0xf8, 0x1a, 0x99, 0x70, 0xb4, 0xc2, 0x11, 0xc5, 0x7e, 0x62, 0xe6, 0x39, 0xbc,
+	0xd9, 0xa2, 0x8f, 0x01, 0x82, 0xd8, 0x5d, 0x91, 0x28, 0xa6, 0x81, 0x6f, 0x1e, 0x09, 0xe7, 0x41,
+	0xfc, 0x83, 0x00, 0xac, 0x3f, 0x14, 0x38, 0x63, 0x89, 0xde, 0x2f, 0x70, 0x42, 0x3a, 0x2c, 0x3e,
+	0x99, 0x6d, 0x1c, 0x06, 0x7e, 0x4c, 0xd8, 0x71, 0x1e, 0xb5, 0xcb, 0xc2, 0xe6, 0x29, 0x97, 0x9c,
+	0x82, 0xb7, 0xe1, 0xa1, 0x2f, 0x40, 0x0f, 0xe7, 0x38, 0x26, 0x3c, 0xc5, 0x72, 0xb3, 0x92, 0x4a,
+	0x91, 0x3b, 0x1b, 0x31, 0xa3, 0x23, 0x38, 0xcc, 0x57, 0x12, 0x24, 0x78, 0xe1, 0xc6, 0xf4, 0x41,
+	0xe4, 0xa9, 0x39, 0x05, 0x8e, 0x8c, 0xe9, 0x03, 0xb1, 0xfe, 0x52, 0xe0, 0xcd, 0x00, 0xfb, 0x74,
+	0x46, 0xe2, 0x64, 0xa3, 0xf6, 0x05, 0xe8, 0x5c, 0xa3, 0x83, 0x62, 0x0b, 0xb3, 0xd4, 0x48, 0x7d,
+	0xa6, 0x91, 0x96, 0xd2, 0xe8, 0x89, 0xca, 0xb9, 0xac, 0xca, 0x29, 0x05, 0xf5, 0x97, 0x14, 0xcc,
+	0x67, 0x15, 0xfc, 0x47, 0x01, 0x63, 0x17, 0xb6, 0x94, 0xad, 0x0a, 0xef, 0x2f, 0x25, 0x26, 0x45,
+	0xdb, 0xee, 0x51, 0x0d, 0x8a, 0x3c, 0xe8, 0x76, 0xe0, 0xcf, 0xe8, 0x2d, 0x0f, 0xba, 0xe4, 0xa4,
+	0x21, 0xf6, 0xc5, 0x25, 0xf1, 0x28, 0x76, 0x93, 0x75, 0xb8, 0x6d, 0x08, 0x8e, 0x4c, 0xd6, 0x21,
+	0x41, 0xc7, 0xa0, 0x53, 0xdf, 0x23, 0xbf, 0xf3, 0x24, 0x4a, 0x8e, 0xd8, 0xa0, 0x3a, 0x18, 0x7c,
+	0xe1, 0xa6, 0x8e, 0x8a, 0x4c, 0xca, 0x1c, 0x1f, 0x6c, 0xcf, 0x9f, 0x43, 0x89, 0x7f, 0xcd, 0xf5,
+	0xe8, 0x2d, 0x0b, 0x50, 0xa4, 0x24, 0x22, 0xe8, 0x70, 0xc8, 0xfa, 0x5b, 0x81, 0xe3, 0x3e, 0x5e,
+	0x93, 0x68, 0x40, 0x12, 0xec, 0xe1, 0x04, 0xbf, 0xb6, 0x20, 0x4f, 0xc4, 0x56, 0xf7, 0xb7, 0xb4,
+	0xf6, 0xac, 0x5c, 0xb9, 0xfd, 0x2d, 0xfd, 0xba, 0x82, 0x7c, 0x09, 0x95, 0x4c, 0xe8, 0xb2, 0x28,
+	0xc7, 0xa0, 0x4f, 0xe7, 0xf7, 0xfe, 0x9d, 0xac, 0x88, 0xd8, 0x58, 0x8f, 0x0a, 0x9c, 0xb0, 0x5e,
+	0xee, 0xed, 0x0a, 0xf0, 0x8e, 0xde, 0xf5, 0x47, 0x05, 0x4e, 0x9f, 0x65, 0x2a, 0xb5, 0xf9, 0x0c,
+	0xf2, 0x53, 0x8e, 0x98, 0x4a, 0x4d, 0xab, 0x17, 0x9b, 0x1f, 0xa6, 0x12, 0x68, 0xcf, 0xb1, 0xcf,
+	0x32, 0x10, 0x04, 0x74, 0x05, 0x45, 0xec, 0xfb, 0x41, 0x82, 0x13, 0x1a, 0xf8, 0xec, 0xd2, 0x1d,
+	0xe0, 0xa7, 0x59, 0xe8, 0x0a, 0x4a, 0x0b, 0x56, 0x94, 0xd8, 0xc5, 0x9e, 0x47, 0x3c, 0x53, 0xab,
+	0x69, 0x19, 0x99, 0x78, 0xcd, 0x9c, 0xa2, 0x60, 0xb5, 0x18, 0x09, 0x7d, 0x03, 0x65, 0x79, 0x28,
+	0x22, 0xcb, 0x60, 0x45, 0x3c, 0x33, 0x77, 0xe0, 0xd8, 0x07, 0x82, 0xe7, 0x08, 0x9a, 0x35, 0x81,
+	0xbc, 0x08, 0x82, 0xd5, 0x7c, 0x46, 0xc9, 0xc2, 0xe3, 0x15, 0x2c, 0x38, 0x62, 0x83, 0x0c, 0xd0,
+	0xee, 0xc8, 0x5a, 0xf6, 0x25, 0x5b, 0x32, 0x24, 0x58, 0x78, 0xb2, 0x20, 0x6c, 0xc9, 0x10, 0x9f,
+	0xfc, 0x26, 0x6b, 0xc1, 0x96, 0x96, 0x03, 0x3a, 0xff, 0x1a, 0x3a, 0x81, 0xbc, 0xbc, 0x3a, 0xc2,
+	0xab, 0xdc, 0x65, 0xee, 0xad, 0x9a, 0xbd, 0xb7, 0x08, 0x72, 0xa9, 0x97, 0x8f, 0xaf, 0xad, 0x4f,
+	0x41, 0xef, 0x6d, 0x2e, 0x4c, 0x44, 0x66, 0x24, 0x22, 0xfe, 0x94, 0x48, 0xb7, 0x3b, 0xe0, 0xf3,
+	0x3f, 0x15, 0x80, 0xdd, 0x83, 0x8a, 0xce, 0xe0, 0xb4, 0x63, 0xf7, 0x27, 0x2d, 0x77, 0xf4, 0x5d,
+	0x6b, 0x6c, 0xbb, 0x37, 0xc3, 0xf1, 0xc8, 0x6e, 0xf7, 0xae, 0x7b, 0x76, 0xc7, 0x78, 0x0f, 0x9d,
+	0xc2, 0xdb, 0xb4, 0x71, 0x74, 0xd3, 0xef, 0xf7, 0x86, 0x5d, 0x43, 0x41, 0x55, 0x38, 0x49, 0x1b,
+	0xba, 0xf6, 0xd0, 0x76, 0x5a, 0x13, 0x66, 0x53, 0xb3, 0x1e, 0xdb, 0xdf, 0x0f, 0x46, 0x8e, 0x3d,
+	0x1e, 0x33, 0xa3, 0x96, 0xf5, 0x38, 0xb6, 0x87, 0x1d, 0x66, 0xc8, 0x35, 0xff, 0x53, 0xc1, 0xd8,
+	0x0e, 0x8d, 0xb1, 0x18, 0xa6, 0x08, 0xc3, 0xdb, 0x3d, 0x13, 0x05, 0xd5, 0xd2, 0x1d, 0xb2, 0x6f,
+	0xb4, 0x56, 0x2f, 0x32, 0x8c, 0x03, 0x33, 0xe9, 0x2b, 0x05, 0x5d, 0x43, 0xb1, 0x4b, 0x92, 0xcd,
+	0xab, 0x8b, 0xaa, 0xa9, 0x83, 0x99, 0x09, 0x52, 0x3d, 0xdb, 0x6b, 0x93, 0x5d, 0xff, 0x23, 0x18,
+	0x5d, 0x92, 0x3c, 0x79, 0x2d, 0xd0, 0x27, 0xd9, 0xe6, 0xca, 0x3c, 0x81, 0xd5, 0xda, 0x61, 0xc2,
+	0x36, 0xc0, 0x9f, 0xe0, 0x4d, 0xe6, 0xa6, 0xa1, 0xf3, 0xf4, 0x6c, 0xdc, 0xfb, 0xde, 0x54, 0xad,
+	0x97, 0x28, 0xc2, 0xf7, 0xb7, 0x47, 0x3f, 0xeb, 0x8d, 0x4b, 0x1c, 0xd2, 0x5f, 0xf2, 0xfc, 0xa7,
+	0xe5, 0xea, 0xff, 0x01, 0x00, 0xd7, 0x08, 0x44, 0x39, 0xcd, 0x08, 0x00, 0x00,
 }
@@ -21,6 +21,8 @@ const _ = grpc.SupportPackageIsVersion7
 const (
 	DeltaDiffService_CalculateDeltaDiffs_FullMethodName = "/deltadiff.DeltaDiffService/CalculateDeltaDiffs"
 	DeltaDiffService_GetManifest_FullMethodName         = "/deltadiff.DeltaDiffService/GetManifest"
+	DeltaDiffService_GetLayerMetadata_FullMethodName    = "/deltadiff.DeltaDiffService/GetLayerMetadata"
+	DeltaDiffService_DiffImageConfig_FullMethodName     = "/deltadiff.DeltaDiffService/DiffImageConfig"
 )
 
 // DeltaDiffServiceClient is the client API for DeltaDiffService service.
@@ -29,6 +31,8 @@ const (
 type DeltaDiffServiceClient interface {
 	CalculateDeltaDiffs(ctx context.Context, in *CalcImageDiffsRequest, opts ...grpc.CallOption) (DeltaDiffService_CalculateDeltaDiffsClient, error)
 	GetManifest(ctx context.Context, in *ManifestRequest, opts ...grpc.CallOption) (*ManifestResponse, error)
+	GetLayerMetadata(ctx context.Context, in *LayerMetadataRequest, opts ...grpc.CallOption) (DeltaDiffService_GetLayerMetadataClient, error)
+	DiffImageConfig(ctx context.Context, in *DiffImageConfigRequest, opts ...grpc.CallOption) (*DiffImageConfigResponse, error)
 }
 
 type deltaDiffServiceClient struct {
@@ -80,12 +84,55 @@ func (c *deltaDiffServiceClient) GetManifest(ctx context.Context, in *ManifestRe
 	return out, nil
 }
 
+func (c *deltaDiffServiceClient) GetLayerMetadata(ctx context.Context, in *LayerMetadataRequest, opts ...grpc.CallOption) (DeltaDiffService_GetLayerMetadataClient, error) {
+	stream, err := c.cc.NewStream(ctx, &DeltaDiffService_ServiceDesc.Streams[1], DeltaDiffService_GetLayerMetadata_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &deltaDiffServiceGetLayerMetadataClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type DeltaDiffService_GetLayerMetadataClient interface {
+	Recv() (*LayerMetadataResponse, error)
+	grpc.ClientStream
+}
+
+type deltaDiffServiceGetLayerMetadataClient struct {
+	grpc.ClientStream
+}
+
+func (x *deltaDiffServiceGetLayerMetadataClient) Recv() (*LayerMetadataResponse, error) {
+	m := new(LayerMetadataResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *deltaDiffServiceClient) DiffImageConfig(ctx context.Context, in *DiffImageConfigRequest, opts ...grpc.CallOption) (*DiffImageConfigResponse, error) {
+	out := new(DiffImageConfigResponse)
+	err := c.cc.Invoke(ctx, DeltaDiffService_DiffImageConfig_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // DeltaDiffServiceServer is the server API for DeltaDiffService service.
 // All implementations must embed UnimplementedDeltaDiffServiceServer
 // for forward compatibility
 type DeltaDiffServiceServer interface {
 	CalculateDeltaDiffs(*CalcImageDiffsRequest, DeltaDiffService_CalculateDeltaDiffsServer) error
 	GetManifest(context.Context, *ManifestRequest) (*ManifestResponse, error)
+	GetLayerMetadata(*LayerMetadataRequest, DeltaDiffService_GetLayerMetadataServer) error
+	DiffImageConfig(context.Context, *DiffImageConfigRequest) (*DiffImageConfigResponse, error)
 	mustEmbedUnimplementedDeltaDiffServiceServer()
 }
 
@@ -99,6 +146,12 @@ func (UnimplementedDeltaDiffServiceServer) CalculateDeltaDiffs(*CalcImageDiffsRe
 func (UnimplementedDeltaDiffServiceServer) GetManifest(context.Context, *ManifestRequest) (*ManifestResponse, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method GetManifest not implemented")
 }
+func (UnimplementedDeltaDiffServiceServer) GetLayerMetadata(*LayerMetadataRequest, DeltaDiffService_GetLayerMetadataServer) error {
+	return status.Errorf(codes.Unimplemented, "method GetLayerMetadata not implemented")
+}
+func (UnimplementedDeltaDiffServiceServer) DiffImageConfig(context.Context, *DiffImageConfigRequest) (*DiffImageConfigResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method DiffImageConfig not implemented")
+}
 func (UnimplementedDeltaDiffServiceServer) mustEmbedUnimplementedDeltaDiffServiceServer() {}
 
 // UnsafeDeltaDiffServiceServer may be embedded to opt out of forward compatibility for this service.
@@ -151,6 +204,45 @@ func _DeltaDiffService_GetManifest_Handler(srv interface{}, ctx context.Context,
 	return interceptor(ctx, in, info, handler)
 }
 
+func _DeltaDiffService_GetLayerMetadata_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(LayerMetadataRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(DeltaDiffServiceServer).GetLayerMetadata(m, &deltaDiffServiceGetLayerMetadataServer{stream})
+}
+
+type DeltaDiffService_GetLayerMetadataServer interface {
+	Send(*LayerMetadataResponse) error
+	grpc.ServerStream
+}
+
+type deltaDiffServiceGetLayerMetadataServer struct {
+	grpc.ServerStream
+}
+
+func (x *deltaDiffServiceGetLayerMetadataServer) Send(m *LayerMetadataResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _DeltaDiffService_DiffImageConfig_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DiffImageConfigRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(DeltaDiffServiceServer).DiffImageConfig(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: DeltaDiffService_DiffImageConfig_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(DeltaDiffServiceServer).DiffImageConfig(ctx, req.(*DiffImageConfigRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 // DeltaDiffService_ServiceDesc is the grpc.ServiceDesc for DeltaDiffService service.
 // It's only intended for direct use with grpc.RegisterService,
 // and not to be introspected or modified (even as a copy)
@@ -162,6 +254,10 @@ var DeltaDiffService_ServiceDesc = grpc.ServiceDesc{
 			MethodName: "GetManifest",
 			Handler:    _DeltaDiffService_GetManifest_Handler,
 		},
+		{
+			MethodName: "DiffImageConfig",
+			Handler:    _DeltaDiffService_DiffImageConfig_Handler,
+		},
 	},
 	Streams: []grpc.StreamDesc{
 		{
@@ -169,6 +265,11 @@ var DeltaDiffService_ServiceDesc = grpc.ServiceDesc{
 			Handler:       _DeltaDiffService_CalculateDeltaDiffs_Handler,
 			ServerStreams: true,
 		},
+		{
+			StreamName:    "GetLayerMetadata",
+			Handler:       _DeltaDiffService_GetLayerMetadata_Handler,
+			ServerStreams: true,
+		},
 	},
 	Metadata: "api/diffservice.proto",
 }
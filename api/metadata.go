@@ -0,0 +1,10 @@
+package api
+
+// RequestIDKey is the gRPC metadata key that carries the ID of a request.
+// Clients may send one so that their logs and the server's share it; the
+// server makes one up otherwise and returns it in the response header.
+const RequestIDKey = "x-request-id"
+
+// AuthorizationKey is the gRPC metadata key that carries a client's token,
+// as "Bearer <token>", for servers that authenticate clients.
+const AuthorizationKey = "authorization"
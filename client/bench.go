@@ -0,0 +1,593 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/mount"
+	"github.com/containerd/containerd/platforms"
+	"github.com/containerd/containerd/remotes"
+	"github.com/containerd/containerd/remotes/docker"
+	"github.com/mackerelio/go-osstat/cpu"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/urfave/cli"
+)
+
+// Ticks per second of the CPU times in /proc/stat (USER_HZ).
+const clockTicks = 100
+
+var benchCommand = cli.Command{
+	Name:      "bench",
+	Usage:     "compare delta updates with full pulls of the same images",
+	ArgsUsage: "[<base>=<target> ...]",
+	Description: `For every pair of images, the target is reconstructed from the base with
+   a delta from the server, then pulled in full from the registry, and the
+   filesystems of both are compared. The base is pulled first if it isn't
+   there; the target is removed before and after every run.
+
+   Use images in a local registry, so that registry and server see the same
+   network. CPU time and disk writes are those of the whole host, to include
+   containerd's work, so run nothing else meanwhile.`,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "pairs",
+			Usage: "file with a base and a target image per line, separated by whitespace",
+		},
+		cli.IntFlag{
+			Name:  "runs",
+			Usage: "number of times every pair is measured",
+			Value: 1,
+		},
+		cli.StringFlag{
+			Name:  "format",
+			Usage: "format of the results: csv or json",
+			Value: "csv",
+		},
+		cli.StringFlag{
+			Name:  "out",
+			Usage: "file to write the results to (default: stdout, with the summary on stderr)",
+		},
+		cli.BoolFlag{
+			Name:  "plain-http",
+			Usage: "pull from the registry over HTTP; localhost always is",
+		},
+		createdFlag,
+		compressionFlag,
+		outputFormatFlag,
+	},
+	Action: func(c *cli.Context) error {
+		pairs, err := benchPairs(c)
+		if err != nil {
+			return err
+		}
+		switch c.String("format") {
+		case "csv", "json":
+		default:
+			return fmt.Errorf("invalid --format %q: must be csv or json", c.String("format"))
+		}
+		if c.Int("runs") < 1 {
+			return errors.New("--runs must be at least 1")
+		}
+		opts, err := updateOpts(c)
+		if err != nil {
+			return err
+		}
+
+		diffClient, err := dialServer(c)
+		if err != nil {
+			return err
+		}
+		defer diffClient.Close()
+
+		client, err := newContainerdClient(c)
+		if err != nil {
+			return err
+		}
+		defer client.Close()
+
+		b := &bench{
+			c:          c,
+			diffClient: diffClient,
+			client:     client,
+			opts:       opts,
+			resolver:   benchResolver(c.Bool("plain-http")),
+		}
+		ctx := context.Background()
+		var results []benchResult
+		for _, pair := range pairs {
+			for i := 1; i <= c.Int("runs"); i++ {
+				ctx := withImages(ctx, pair.base, pair.target)
+				log.G(ctx).WithField("run", i).Info("benchmarking")
+				results = append(results, b.run(ctx, pair, i)...)
+			}
+		}
+
+		out, summary := io.Writer(os.Stdout), io.Writer(os.Stderr)
+		if path := c.String("out"); path != "" {
+			f, err := os.Create(path)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			out, summary = f, os.Stdout
+		}
+		if c.String("format") == "json" {
+			enc := json.NewEncoder(out)
+			enc.SetIndent("", "  ")
+			err = enc.Encode(results)
+		} else {
+			err = writeBenchCSV(out, results)
+		}
+		if err != nil {
+			return fmt.Errorf("error writing results: %w", err)
+		}
+		if err := printBenchSummary(summary, pairs, results); err != nil {
+			return err
+		}
+
+		var failed int
+		for _, r := range results {
+			if r.Error != "" || (r.Correct != nil && !*r.Correct) {
+				failed++
+			}
+		}
+		if failed > 0 {
+			return fmt.Errorf("%d of %d measurements failed", failed, len(results))
+		}
+		return nil
+	},
+}
+
+type benchPair struct {
+	base, target string
+}
+
+// benchPairs reads the image pairs from the arguments and --pairs.
+func benchPairs(c *cli.Context) ([]benchPair, error) {
+	var pairs []benchPair
+	for _, arg := range c.Args() {
+		base, target, ok := strings.Cut(arg, "=")
+		if !ok || base == "" || target == "" {
+			return nil, fmt.Errorf("invalid pair %q: expected <base>=<target>", arg)
+		}
+		pairs = append(pairs, benchPair{base, target})
+	}
+	if path := c.String("pairs"); path != "" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		scanner := bufio.NewScanner(f)
+		for n := 1; scanner.Scan(); n++ {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			fields := strings.Fields(line)
+			if len(fields) != 2 {
+				return nil, fmt.Errorf("%s:%d: expected a base and a target image", path, n)
+			}
+			pairs = append(pairs, benchPair{fields[0], fields[1]})
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+	if len(pairs) == 0 {
+		cli.ShowCommandHelp(c, c.Command.Name)
+		return nil, errors.New("no image pairs given")
+	}
+	return pairs, nil
+}
+
+func benchResolver(plainHTTP bool) remotes.Resolver {
+	match := docker.MatchLocalhost
+	if plainHTTP {
+		match = docker.MatchAllHosts
+	}
+	return docker.NewResolver(docker.ResolverOptions{
+		Hosts: docker.ConfigureDefaultRegistries(docker.WithPlainHTTP(match)),
+	})
+}
+
+// benchResult is one measurement of getting a target image.
+type benchResult struct {
+	Base   string `json:"base"`
+	Target string `json:"target"`
+	// delta or pull
+	Method string `json:"method"`
+	Run    int    `json:"run"`
+	// bytes received from the server or the registry
+	Bytes            int64   `json:"bytes"`
+	Seconds          float64 `json:"seconds"`
+	CPUSeconds       float64 `json:"cpuSeconds"`
+	DiskWrittenBytes uint64  `json:"diskWrittenBytes"`
+	// whether the reconstructed filesystem matches the pulled one; only
+	// set for deltas that could be compared
+	Correct *bool  `json:"correct,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+type bench struct {
+	c          *cli.Context
+	diffClient *serverClient
+	client     *containerd.Client
+	opts       updateOptions
+	resolver   remotes.Resolver
+}
+
+// run measures a delta update and a full pull of the target of pair.
+func (b *bench) run(ctx context.Context, pair benchPair, i int) []benchResult {
+	delta := benchResult{Base: pair.base, Target: pair.target, Method: "delta", Run: i}
+	pull := benchResult{Base: pair.base, Target: pair.target, Method: "pull", Run: i}
+	fail := func(err error) []benchResult {
+		log.G(ctx).WithError(err).Warn("benchmark run failed")
+		if delta.Error == "" {
+			delta.Error = err.Error()
+		}
+		if pull.Error == "" {
+			pull.Error = err.Error()
+		}
+		return []benchResult{delta, pull}
+	}
+
+	if _, err := b.client.GetImage(ctx, pair.base); err != nil {
+		log.G(ctx).WithField("image", pair.base).Info("image not found, pulling")
+		if _, err := b.pull(ctx, pair.base); err != nil {
+			return fail(fmt.Errorf("error pulling base %s: %w", pair.base, err))
+		}
+	}
+	// The reconstructed image is kept under another name while the
+	// target is pulled, to compare the two.
+	reconstructed := "cargosync-bench/" + pair.target
+	if err := b.removeImages(ctx, pair.target, reconstructed); err != nil {
+		return fail(err)
+	}
+	defer func() {
+		if err := b.removeImages(ctx, pair.target, reconstructed); err != nil {
+			log.G(ctx).WithError(err).Warn("cannot remove benchmark images")
+		}
+	}()
+
+	start := startMeasurement()
+	deltaBytes, err := b.delta(ctx, pair)
+	start.stop(&delta)
+	delta.Bytes = deltaBytes
+	if err != nil {
+		delta.Error = err.Error()
+		log.G(ctx).WithError(err).Warn("delta update failed")
+	} else if err := b.rename(ctx, pair.target, reconstructed); err != nil {
+		return fail(err)
+	}
+
+	start = startMeasurement()
+	pull.Bytes, err = b.pull(ctx, pair.target)
+	start.stop(&pull)
+	if err != nil {
+		pull.Error = err.Error()
+		log.G(ctx).WithError(err).Warn("full pull failed")
+	}
+
+	if delta.Error == "" && pull.Error == "" {
+		correct, err := b.compare(ctx, reconstructed, pair.target)
+		if err != nil {
+			delta.Error = fmt.Sprintf("error comparing with the pulled image: %v", err)
+		} else {
+			delta.Correct = &correct
+		}
+	}
+	return []benchResult{delta, pull}
+}
+
+// delta reconstructs the target from the base like sync does, and returns
+// the bytes received from the server.
+func (b *bench) delta(ctx context.Context, pair benchPair) (int64, error) {
+	ctx, done, err := b.client.WithLease(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("error getting lease: %w", err)
+	}
+	defer done(ctx)
+
+	r, err := startRun(ctx, b.c, b.client)
+	if err != nil {
+		return 0, err
+	}
+	defer r.close()
+
+	p := newProgress()
+	defer p.finish()
+
+	opts := b.opts
+	m, imageConfig, err := fetchManifest(ctx, b.diffClient, pair.target, &opts.provenance)
+	if err != nil {
+		return 0, err
+	}
+	received := m.Descriptor().Size + int64(len(imageConfig))
+	if err := checkCompatible(m, opts); err != nil {
+		return received, err
+	}
+
+	deltaPath := r.path("delta.zst")
+	if err := fetchDelta(ctx, b.diffClient, p, pair.base, pair.target, deltaPath); err != nil {
+		return received, err
+	}
+	info, err := os.Stat(deltaPath)
+	if err != nil {
+		return received, err
+	}
+	received += info.Size()
+
+	batchPath, err := decompressDelta(ctx, p, r, deltaPath)
+	if err != nil {
+		return received, err
+	}
+	if opts.provenance.Delta, err = digestFile(deltaPath); err != nil {
+		return received, err
+	}
+	_, _, err = applyDelta(ctx, b.client, b.c.GlobalString("snapshotter"), p, r, pair.base, pair.target, batchPath, m, imageConfig, opts)
+	return received, err
+}
+
+// pull pulls and unpacks ref from the registry, and returns the bytes of
+// the blobs that weren't in the content store yet.
+func (b *bench) pull(ctx context.Context, ref string) (int64, error) {
+	cs := b.client.ContentStore()
+	have := map[digest.Digest]bool{}
+	if err := cs.Walk(ctx, func(info content.Info) error {
+		have[info.Digest] = true
+		return nil
+	}); err != nil {
+		return 0, fmt.Errorf("error listing content: %w", err)
+	}
+
+	img, err := b.client.Pull(ctx, ref,
+		containerd.WithPullUnpack,
+		containerd.WithPullSnapshotter(b.c.GlobalString("snapshotter")),
+		containerd.WithResolver(b.resolver))
+	if err != nil {
+		return 0, err
+	}
+
+	var received int64
+	count := images.HandlerFunc(func(ctx context.Context, desc ocispec.Descriptor) ([]ocispec.Descriptor, error) {
+		if !have[desc.Digest] {
+			have[desc.Digest] = true
+			received += desc.Size
+		}
+		return nil, nil
+	})
+	children := images.FilterPlatforms(images.ChildrenHandler(cs), platforms.Default())
+	if err := images.Walk(ctx, images.Handlers(count, children), img.Target()); err != nil {
+		return received, fmt.Errorf("error walking %s: %w", ref, err)
+	}
+	return received, nil
+}
+
+// rename moves an image to another name, keeping its content.
+func (b *bench) rename(ctx context.Context, from, to string) error {
+	is := b.client.ImageService()
+	img, err := is.Get(ctx, from)
+	if err != nil {
+		return err
+	}
+	img.Name = to
+	if _, err := is.Create(ctx, img); err != nil {
+		return fmt.Errorf("error renaming %s: %w", from, err)
+	}
+	return is.Delete(ctx, from)
+}
+
+// removeImages deletes the images and, once the last is gone, the content
+// and snapshots only they used.
+func (b *bench) removeImages(ctx context.Context, names ...string) error {
+	for i, name := range names {
+		var opts []images.DeleteOpt
+		if i == len(names)-1 {
+			opts = append(opts, images.SynchronousDelete())
+		}
+		if err := b.client.ImageService().Delete(ctx, name, opts...); err != nil && !errdefs.IsNotFound(err) {
+			return fmt.Errorf("error removing image %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// compare reports whether the filesystems of two images are the same,
+// comparing the contents, metadata and hard links of every file.
+func (b *bench) compare(ctx context.Context, name1, name2 string) (bool, error) {
+	r, err := newRun(b.c.GlobalString("tmp-dir"))
+	if err != nil {
+		return false, err
+	}
+	defer r.close()
+
+	snapshotter := b.client.SnapshotService(b.c.GlobalString("snapshotter"))
+	var roots [2][]mount.Mount
+	for i, name := range []string{name1, name2} {
+		img, err := b.client.GetImage(ctx, name)
+		if err != nil {
+			return false, err
+		}
+		key := r.snapshotKey("bench" + strconv.Itoa(i))
+		if roots[i], err = PrepareSnapshot(ctx, snapshotter, img, key, r.snapshotOpts()); err != nil {
+			return false, err
+		}
+		defer snapshotter.Remove(ctx, key)
+	}
+
+	var differs bool
+	err = mount.WithTempMount(ctx, roots[0], func(root1 string) error {
+		return mount.WithTempMount(ctx, roots[1], func(root2 string) error {
+			// With --dry-run, rsync only itemizes what would change.
+			cmd := exec.Command("rsync", "-aHc", "--dry-run", "--delete", "--itemize-changes",
+				"--no-i-r", "--one-file-system", "--", root1+"/", root2+"/")
+			output, err := cmd.CombinedOutput()
+			if err != nil {
+				return fmt.Errorf("rsync: %w: %s", err, output)
+			}
+			if differs = len(strings.TrimSpace(string(output))) > 0; differs {
+				log.G(ctx).Warnf("reconstructed image differs from the pulled one:\n%s", output)
+			}
+			return nil
+		})
+	})
+	return err == nil && !differs, err
+}
+
+// measurement is the host's CPU time and disk writes since it started.
+type measurement struct {
+	start time.Time
+	cpu   *cpu.Stats
+	disk  uint64
+}
+
+func startMeasurement() measurement {
+	// Flush what earlier steps left in the page cache, so it isn't
+	// counted as written by this one.
+	syscall.Sync()
+	m := measurement{start: time.Now()}
+	m.cpu, _ = cpu.Get()
+	m.disk, _ = diskWritten()
+	return m
+}
+
+func (m measurement) stop(r *benchResult) {
+	syscall.Sync()
+	r.Seconds = time.Since(m.start).Seconds()
+	if after, err := cpu.Get(); err == nil && m.cpu != nil {
+		busy := func(s *cpu.Stats) uint64 { return s.Total - s.Idle - s.Iowait }
+		r.CPUSeconds = float64(busy(after)-busy(m.cpu)) / clockTicks
+	}
+	if after, err := diskWritten(); err == nil {
+		r.DiskWrittenBytes = after - m.disk
+	}
+}
+
+// diskWritten returns the bytes written to the host's disks so far.
+// Virtual devices are skipped, as their writes end up on a disk too.
+func diskWritten() (uint64, error) {
+	devices, err := os.ReadDir("/sys/block")
+	if err != nil {
+		return 0, err
+	}
+	var sectors uint64
+	for _, dev := range devices {
+		name := dev.Name()
+		if strings.HasPrefix(name, "loop") || strings.HasPrefix(name, "ram") || strings.HasPrefix(name, "zram") ||
+			strings.HasPrefix(name, "dm-") || strings.HasPrefix(name, "md") {
+			continue
+		}
+		stat, err := os.ReadFile(filepath.Join("/sys/block", name, "stat"))
+		if err != nil {
+			return 0, err
+		}
+		// See Documentation/block/stat.rst; sectors are always 512 bytes.
+		fields := strings.Fields(string(stat))
+		if len(fields) < 7 {
+			continue
+		}
+		n, err := strconv.ParseUint(fields[6], 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("error parsing %s stat: %w", name, err)
+		}
+		sectors += n
+	}
+	return sectors * 512, nil
+}
+
+func writeBenchCSV(w io.Writer, results []benchResult) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"base", "target", "method", "run", "bytes", "seconds", "cpu_seconds", "disk_written_bytes", "correct", "error"})
+	for _, r := range results {
+		correct := ""
+		if r.Correct != nil {
+			correct = strconv.FormatBool(*r.Correct)
+		}
+		cw.Write([]string{
+			r.Base, r.Target, r.Method, strconv.Itoa(r.Run),
+			strconv.FormatInt(r.Bytes, 10),
+			strconv.FormatFloat(r.Seconds, 'f', 3, 64),
+			strconv.FormatFloat(r.CPUSeconds, 'f', 2, 64),
+			strconv.FormatUint(r.DiskWrittenBytes, 10),
+			correct, r.Error,
+		})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// printBenchSummary prints the mean of the successful runs of every pair.
+func printBenchSummary(out io.Writer, pairs []benchPair, results []benchResult) error {
+	type mean struct {
+		n                            int
+		bytes, seconds, cpu, written float64
+	}
+	w := tabwriter.NewWriter(out, 1, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "BASE\tTARGET\tDELTA MB\tPULL MB\tSAVED\tDELTA TIME\tPULL TIME\tDELTA CPU\tPULL CPU\tDELTA WRITTEN MB\tPULL WRITTEN MB\tCORRECT")
+	for _, pair := range pairs {
+		var delta, pull mean
+		correct := "-"
+		for _, r := range results {
+			if r.Base != pair.base || r.Target != pair.target {
+				continue
+			}
+			if r.Correct != nil {
+				if !*r.Correct {
+					correct = "no"
+				} else if correct == "-" {
+					correct = "yes"
+				}
+			}
+			if r.Error != "" {
+				continue
+			}
+			m := &pull
+			if r.Method == "delta" {
+				m = &delta
+			}
+			m.n++
+			m.bytes += float64(r.Bytes)
+			m.seconds += r.Seconds
+			m.cpu += r.CPUSeconds
+			m.written += float64(r.DiskWrittenBytes)
+		}
+		for _, m := range []*mean{&delta, &pull} {
+			if m.n > 0 {
+				m.bytes /= float64(m.n)
+				m.seconds /= float64(m.n)
+				m.cpu /= float64(m.n)
+				m.written /= float64(m.n)
+			}
+		}
+		saved := "-"
+		if delta.n > 0 && pull.n > 0 && pull.bytes > 0 {
+			saved = fmt.Sprintf("%.1f%%", 100*(1-delta.bytes/pull.bytes))
+		}
+		fmt.Fprintf(w, "%s\t%s\t%.2f\t%.2f\t%s\t%.1fs\t%.1fs\t%.1fs\t%.1fs\t%.2f\t%.2f\t%s\n",
+			pair.base, pair.target,
+			delta.bytes/1048576.0, pull.bytes/1048576.0, saved,
+			delta.seconds, pull.seconds, delta.cpu, pull.cpu,
+			delta.written/1048576.0, pull.written/1048576.0, correct)
+	}
+	return w.Flush()
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/containerd/containerd/images"
+	refdocker "github.com/containerd/containerd/reference/docker"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/urfave/cli"
+)
+
+// An offline bundle is an uncompressed tar archive holding everything
+// needed to apply a delta without a connection to the server. The metadata
+// comes first and records the digests of the other files, so a bundle can be
+// verified before anything is applied.
+const (
+	bundleVersion = 2
+
+	bundleMetadataFile = "metadata.json"
+	bundleDeltaFile    = "delta.zst"
+	bundleManifestFile = "manifest.json"
+	bundleConfigFile   = "config.json"
+)
+
+// bundleFiles are the files a bundle must contain besides the metadata.
+var bundleFiles = []string{bundleDeltaFile, bundleManifestFile, bundleConfigFile}
+
+type bundleMetadata struct {
+	Version int       `json:"version"`
+	Created time.Time `json:"created"`
+
+	Base            string        `json:"base"`
+	BaseDigest      digest.Digest `json:"baseDigest"`
+	Target          string        `json:"target"`
+	TargetDigest    digest.Digest `json:"targetDigest"`
+	TargetMediaType string        `json:"targetMediaType"`
+	// What the target reference resolved to on the server, usually an
+	// index, and the server itself; recorded in the image provenance.
+	TargetImageDigest digest.Digest `json:"targetImageDigest,omitempty"`
+	Server            string        `json:"server,omitempty"`
+
+	// Digests of the other files in the bundle, by file name.
+	Files map[string]digest.Digest `json:"files"`
+}
+
+// writeBundle writes a bundle with the given metadata to path. files maps
+// each bundle file name to the local file holding its contents.
+func writeBundle(path string, meta bundleMetadata, files map[string]string) error {
+	meta.Version = bundleVersion
+	meta.Files = map[string]digest.Digest{}
+	for _, name := range bundleFiles {
+		dgst, err := digestFile(files[name])
+		if err != nil {
+			return err
+		}
+		meta.Files[name] = dgst
+	}
+	metaJSON, err := json.MarshalIndent(meta, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file first, so a failed or interrupted fetch
+	// never leaves something that looks like a bundle at path.
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".part-*")
+	if err != nil {
+		return fmt.Errorf("error creating bundle: %w", err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	tw := tar.NewWriter(f)
+	if err := tw.WriteHeader(&tar.Header{
+		Name:    bundleMetadataFile,
+		Mode:    0644,
+		Size:    int64(len(metaJSON)),
+		ModTime: meta.Created,
+	}); err != nil {
+		return err
+	}
+	if _, err := tw.Write(metaJSON); err != nil {
+		return err
+	}
+	for _, name := range bundleFiles {
+		if err := addBundleFile(tw, name, files[name], meta.Created); err != nil {
+			return fmt.Errorf("error adding %s to bundle: %w", name, err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(f.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+func addBundleFile(tw *tar.Writer, name, path string, modTime time.Time) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	fi, err := src.Stat()
+	if err != nil {
+		return err
+	}
+	if err := tw.WriteHeader(&tar.Header{
+		Name:    name,
+		Mode:    0644,
+		Size:    fi.Size(),
+		ModTime: modTime,
+	}); err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, src)
+	return err
+}
+
+// readBundle extracts the bundle at path into dir and verifies every file
+// against the digests in its metadata. Nothing is returned unless the whole
+// bundle checks out.
+func readBundle(path, dir string) (*bundleMetadata, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("error opening bundle: %w", err)
+	}
+	defer f.Close()
+
+	tr := tar.NewReader(f)
+	hdr, err := tr.Next()
+	if err != nil {
+		return nil, fmt.Errorf("error reading bundle %s: %w", path, err)
+	}
+	if hdr.Name != bundleMetadataFile {
+		return nil, fmt.Errorf("%s is not a delta bundle: first entry is %q, not %s", path, hdr.Name, bundleMetadataFile)
+	}
+	meta, err := decodeBundleMetadata(tr)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := map[string]bool{}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error reading bundle %s: %w", path, err)
+		}
+		// Only the known file names are extracted, so entries can never
+		// escape dir.
+		expected, ok := meta.Files[hdr.Name]
+		if !ok || !isBundleFile(hdr.Name) {
+			return nil, fmt.Errorf("unexpected file %q in bundle", hdr.Name)
+		}
+		if seen[hdr.Name] {
+			return nil, fmt.Errorf("duplicate file %q in bundle", hdr.Name)
+		}
+		seen[hdr.Name] = true
+
+		dst, err := os.OpenFile(filepath.Join(dir, hdr.Name), os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+		if err != nil {
+			return nil, err
+		}
+		verifier := expected.Verifier()
+		_, err = io.Copy(io.MultiWriter(dst, verifier), tr)
+		dst.Close()
+		if err != nil {
+			return nil, fmt.Errorf("error extracting %s: %w", hdr.Name, err)
+		}
+		if !verifier.Verified() {
+			return nil, fmt.Errorf("bundle is corrupt: %s does not match digest %s", hdr.Name, expected)
+		}
+	}
+	for _, name := range bundleFiles {
+		if !seen[name] {
+			return nil, fmt.Errorf("bundle is incomplete: %s is missing", name)
+		}
+	}
+	return meta, nil
+}
+
+// decodeBundleMetadata decodes and checks the metadata read from r. Unlike
+// the other files, nothing vouches for the metadata, so anything it doesn't
+// define is refused rather than ignored.
+func decodeBundleMetadata(r io.Reader) (*bundleMetadata, error) {
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	var meta bundleMetadata
+	if err := dec.Decode(&meta); err != nil {
+		return nil, fmt.Errorf("error decoding bundle metadata: %w", err)
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, errors.New("error decoding bundle metadata: unexpected data after the metadata")
+	}
+	if meta.Version != bundleVersion {
+		return nil, fmt.Errorf("unsupported bundle version %d (expected %d)", meta.Version, bundleVersion)
+	}
+	if err := meta.validate(); err != nil {
+		return nil, fmt.Errorf("invalid bundle metadata: %w", err)
+	}
+	return &meta, nil
+}
+
+func (m *bundleMetadata) validate() error {
+	if m.Created.IsZero() {
+		return errors.New("no creation time")
+	}
+	for _, ref := range []string{m.Base, m.Target} {
+		if _, err := refdocker.ParseNormalizedNamed(ref); err != nil {
+			return fmt.Errorf("invalid image reference %q: %w", ref, err)
+		}
+	}
+	digests := map[string]digest.Digest{"baseDigest": m.BaseDigest, "targetDigest": m.TargetDigest}
+	if m.TargetImageDigest != "" {
+		digests["targetImageDigest"] = m.TargetImageDigest
+	}
+	for name, file := range m.Files {
+		if !isBundleFile(name) {
+			return fmt.Errorf("unexpected file %q", name)
+		}
+		digests[name] = file
+	}
+	for name, dgst := range digests {
+		if err := dgst.Validate(); err != nil {
+			return fmt.Errorf("invalid digest for %s: %w", name, err)
+		}
+	}
+	for _, name := range bundleFiles {
+		if _, ok := m.Files[name]; !ok {
+			return fmt.Errorf("no digest for %s", name)
+		}
+	}
+	if !images.IsManifestType(m.TargetMediaType) {
+		return fmt.Errorf("target media type %q is not a manifest", m.TargetMediaType)
+	}
+	return nil
+}
+
+func isBundleFile(name string) bool {
+	for _, f := range bundleFiles {
+		if name == f {
+			return true
+		}
+	}
+	return false
+}
+
+func digestFile(path string) (digest.Digest, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	return digest.FromReader(f)
+}
+
+var verifyCommand = cli.Command{
+	Name:      "verify",
+	Usage:     "check the integrity of an offline delta bundle without applying it",
+	ArgsUsage: "<bundle>",
+	Action: func(c *cli.Context) error {
+		if c.NArg() != 1 {
+			cli.ShowCommandHelp(c, c.Command.Name)
+			return errors.New("verify expects exactly one bundle file")
+		}
+
+		r, err := newRun(c.GlobalString("tmp-dir"))
+		if err != nil {
+			return err
+		}
+		defer r.close()
+
+		meta, err := readBundle(c.Args().First(), r.dir)
+		if err != nil {
+			return err
+		}
+
+		if c.GlobalString("output") == "json" {
+			return printJSON(meta)
+		}
+		fmt.Printf("Bundle %s is intact\n", c.Args().First())
+		fmt.Printf("Base:    %s (%s)\n", meta.Base, meta.BaseDigest)
+		fmt.Printf("Target:  %s (%s)\n", meta.Target, meta.TargetDigest)
+		fmt.Printf("Created: %s\n", meta.Created.Format(time.RFC3339))
+		return nil
+	},
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+type bundleEntry struct {
+	name, content string
+}
+
+var testBundleFiles = []bundleEntry{
+	{bundleDeltaFile, "compressed delta"},
+	{bundleManifestFile, `{"schemaVersion":2}`},
+	{bundleConfigFile, `{"architecture":"amd64"}`},
+}
+
+func testBundleMetadata() bundleMetadata {
+	meta := bundleMetadata{
+		Version:      bundleVersion,
+		Created:      time.Date(2023, 9, 1, 0, 0, 0, 0, time.UTC),
+		Base:         "docker.io/library/alpine:3.17",
+		BaseDigest:   digest.FromString("base"),
+		Target:       "docker.io/library/alpine:3.18",
+		TargetDigest: digest.FromString("target"),
+		Files:        map[string]digest.Digest{},
+	}
+	meta.TargetMediaType = ocispec.MediaTypeImageManifest
+	for _, e := range testBundleFiles {
+		meta.Files[e.name] = digest.FromString(e.content)
+	}
+	return meta
+}
+
+// buildBundle writes a tar archive of entries, which may break the rules of
+// bundles, and returns its path.
+func buildBundle(t *testing.T, entries []bundleEntry) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "test.bundle")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	tw := tar.NewWriter(f)
+	for _, e := range entries {
+		if err := tw.WriteHeader(&tar.Header{Name: e.name, Mode: 0644, Size: int64(len(e.content))}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(e.content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func metadataEntry(t *testing.T, meta bundleMetadata) bundleEntry {
+	t.Helper()
+	p, err := json.Marshal(meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bundleEntry{bundleMetadataFile, string(p)}
+}
+
+func TestWriteAndReadBundle(t *testing.T) {
+	src := t.TempDir()
+	files := map[string]string{}
+	for _, e := range testBundleFiles {
+		files[e.name] = filepath.Join(src, e.name)
+		if err := os.WriteFile(files[e.name], []byte(e.content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	path := filepath.Join(t.TempDir(), "test.bundle")
+	meta := testBundleMetadata()
+	if err := writeBundle(path, meta, files); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	got, err := readBundle(path, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Target != meta.Target || got.BaseDigest != meta.BaseDigest || got.Version != bundleVersion {
+		t.Errorf("readBundle() = %+v, want %+v", got, meta)
+	}
+	for _, e := range testBundleFiles {
+		p, err := os.ReadFile(filepath.Join(dir, e.name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(p) != e.content {
+			t.Errorf("%s = %q, want %q", e.name, p, e.content)
+		}
+	}
+}
+
+func TestWriteBundleReplacesAtomically(t *testing.T) {
+	src := t.TempDir()
+	files := map[string]string{}
+	for _, e := range testBundleFiles {
+		files[e.name] = filepath.Join(src, e.name)
+		if err := os.WriteFile(files[e.name], []byte(e.content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	dir := t.TempDir()
+	path := filepath.Join(dir, "test.bundle")
+	if err := os.WriteFile(path, []byte("previous"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// A failed write leaves whatever was at path alone.
+	broken := map[string]string{bundleDeltaFile: files[bundleDeltaFile], bundleManifestFile: files[bundleManifestFile]}
+	if err := writeBundle(path, testBundleMetadata(), broken); err == nil {
+		t.Fatal("writeBundle() without a config succeeded")
+	}
+	if p, err := os.ReadFile(path); err != nil || string(p) != "previous" {
+		t.Fatalf("after a failed write, %s = %q, %v", path, p, err)
+	}
+
+	if err := writeBundle(path, testBundleMetadata(), files); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0644 {
+		t.Errorf("bundle mode = %v, want 0644", info.Mode().Perm())
+	}
+	if _, err := readBundle(path, t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("%s holds %d files, want only the bundle", dir, len(entries))
+	}
+}
+
+func TestReadBundleErrors(t *testing.T) {
+	withFiles := func(meta bundleMetadata, files ...bundleEntry) []bundleEntry {
+		return append([]bundleEntry{metadataEntry(t, meta)}, files...)
+	}
+	valid := testBundleMetadata()
+	tampered := append([]bundleEntry(nil), testBundleFiles...)
+	tampered[0] = bundleEntry{bundleDeltaFile, "compressed delta, changed"}
+	oldVersion := testBundleMetadata()
+	oldVersion.Version = 1
+	extraListed := testBundleMetadata()
+	extraListed.Files["extra.txt"] = digest.FromString("extra")
+	escaping := testBundleMetadata()
+	escaping.Files["../delta.zst"] = digest.FromString("escape")
+	withMeta := func(edit func(*bundleMetadata)) []bundleEntry {
+		meta := testBundleMetadata()
+		edit(&meta)
+		return withFiles(meta, testBundleFiles...)
+	}
+	withJSON := func(edit func(map[string]interface{})) []bundleEntry {
+		var m map[string]interface{}
+		if err := json.Unmarshal([]byte(metadataEntry(t, valid).content), &m); err != nil {
+			t.Fatal(err)
+		}
+		edit(m)
+		p, err := json.Marshal(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return append([]bundleEntry{{bundleMetadataFile, string(p)}}, testBundleFiles...)
+	}
+
+	tests := []struct {
+		name    string
+		entries []bundleEntry
+		want    string
+	}{
+		{"tampered file", withFiles(valid, tampered...), "does not match digest"},
+		{"missing file", withFiles(valid, testBundleFiles[:2]...), "config.json is missing"},
+		{"missing metadata entry", testBundleFiles, "first entry is \"delta.zst\""},
+		{"metadata not first", append(append([]bundleEntry(nil), testBundleFiles...), metadataEntry(t, valid)), "not a delta bundle"},
+		{"unexpected file", withFiles(valid, append(testBundleFiles, bundleEntry{"extra.txt", "extra"})...), "unexpected file \"extra.txt\""},
+		{"unexpected file listed in the metadata", withFiles(extraListed, append(testBundleFiles, bundleEntry{"extra.txt", "extra"})...), "invalid bundle metadata: unexpected file \"extra.txt\""},
+		{"path outside the directory", withFiles(escaping, append(testBundleFiles, bundleEntry{"../delta.zst", "escape"})...), "invalid bundle metadata: unexpected file"},
+		{"duplicate file", withFiles(valid, append(testBundleFiles, testBundleFiles[0])...), "duplicate file"},
+		{"version mismatch", withFiles(oldVersion, testBundleFiles...), "unsupported bundle version 1"},
+		{"invalid metadata", append([]bundleEntry{{bundleMetadataFile, "{"}}, testBundleFiles...), "error decoding bundle metadata"},
+		{"unknown metadata field", withJSON(func(m map[string]interface{}) { m["apply"] = "now" }), "unknown field \"apply\""},
+		{"data after the metadata", append([]bundleEntry{{bundleMetadataFile, metadataEntry(t, valid).content + "{}"}}, testBundleFiles...), "unexpected data after the metadata"},
+		{"no creation time", withMeta(func(m *bundleMetadata) { m.Created = time.Time{} }), "no creation time"},
+		{"invalid target", withMeta(func(m *bundleMetadata) { m.Target = "--rsh=evil" }), "invalid image reference"},
+		{"no base", withMeta(func(m *bundleMetadata) { m.Base = "" }), "invalid image reference"},
+		{"invalid base digest", withMeta(func(m *bundleMetadata) { m.BaseDigest = "sha256:abc" }), "invalid digest for baseDigest"},
+		{"no target digest", withMeta(func(m *bundleMetadata) { m.TargetDigest = "" }), "invalid digest for targetDigest"},
+		{"invalid image digest", withMeta(func(m *bundleMetadata) { m.TargetImageDigest = "index" }), "invalid digest for targetImageDigest"},
+		{"invalid file digest", withMeta(func(m *bundleMetadata) { m.Files[bundleDeltaFile] = "sha256:" }), "invalid digest for delta.zst"},
+		{"file without a digest", withMeta(func(m *bundleMetadata) { delete(m.Files, bundleConfigFile) }), "no digest for config.json"},
+		{"target not a manifest", withMeta(func(m *bundleMetadata) { m.TargetMediaType = ocispec.MediaTypeImageIndex }), "is not a manifest"},
+		{"empty archive", nil, "error reading bundle"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			meta, err := readBundle(buildBundle(t, tt.entries), dir)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("readBundle() = %v, %v, want an error containing %q", meta, err, tt.want)
+			}
+			if _, err := os.Stat(filepath.Join(filepath.Dir(dir), bundleDeltaFile)); err == nil {
+				t.Errorf("a file was extracted outside %s", dir)
+			}
+		})
+	}
+}
+
+func TestReadBundleNotATar(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "not.bundle")
+	if err := os.WriteFile(path, []byte("not a tar archive, just some text"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readBundle(path, t.TempDir()); err == nil {
+		t.Error("readBundle() of a text file succeeded")
+	}
+}
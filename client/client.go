@@ -2,368 +2,1292 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"deltadiff/api"
 	"deltadiff/manifest"
+	"deltadiff/telemetry"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
-	"runtime"
+	"path/filepath"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/containerd/containerd"
-	"github.com/containerd/containerd/diff"
 	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/log"
 	"github.com/containerd/containerd/mount"
+	"github.com/containerd/containerd/platforms"
+	refdocker "github.com/containerd/containerd/reference/docker"
 	"github.com/containerd/containerd/snapshots"
+	"github.com/golang/protobuf/proto"
+	"github.com/mackerelio/go-osstat/cpu"
+	digest "github.com/opencontainers/go-digest"
 	"github.com/opencontainers/image-spec/identity"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
-	"github.com/mackerelio/go-osstat/cpu"
-	"go.mongodb.org/mongo-driver/bson"
+	"github.com/urfave/cli"
+	"go.opentelemetry.io/otel/attribute"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/credentials/insecure"
 )
 
-var (
-	image1ref, image2ref string
-)
+// Image with an empty root filesystem that the reconstructed layer is diffed against.
+const blankImageRef = "docker.io/jprotogtwi/blank-canvas:latest"
+
+var baseFlag = cli.StringFlag{
+	Name:  "base",
+	Usage: "local image to use as the base (default: a local image of the same repository)",
+}
+
+var createdFlag = cli.StringFlag{
+	Name:  "created",
+	Usage: "created time of the reconstructed image: keep (the target's), now, or an RFC 3339 time",
+	Value: "keep",
+}
+
+var compressionFlag = cli.StringFlag{
+	Name:  "layer-compression",
+	Usage: "compression of the reconstructed layer: gzip, zstd (OCI images only) or none",
+	Value: string(manifest.CompressionGzip),
+}
+
+var exactFlag = cli.BoolFlag{
+	Name:  "exact",
+	Usage: "regenerate the original layers so the image keeps its upstream digest; falls back to a squashed layer if that fails",
+}
+
+var outputFormatFlag = cli.StringFlag{
+	Name:  "output-format",
+	Usage: "media types of the reconstructed image: oci, docker, or preserve (the target's)",
+	Value: string(manifest.FormatPreserve),
+}
+
+var syncCommand = cli.Command{
+	Name:      "sync",
+	Usage:     "update a local image to the target version using a delta from the server",
+	ArgsUsage: "<target-image>",
+	Flags:     []cli.Flag{baseFlag, createdFlag, compressionFlag, exactFlag, outputFormatFlag, reportFlag, reportFormatFlag},
+	Action: func(c *cli.Context) (err error) {
+		ctx, span := telemetry.StartSpan(context.Background(), "sync")
+		defer telemetry.End(span, &err)
+
+		rep, err := newReport(c)
+		if err != nil {
+			return err
+		}
+		defer func() { err = rep.finish(err) }()
+
+		target, err := targetArg(c)
+		if err != nil {
+			return err
+		}
+		rep.Target = target
+		opts, err := updateOpts(c)
+		if err != nil {
+			return err
+		}
+
+		before, _ := cpu.Get()
+		timeStart := time.Now()
+
+		diffClient, err := dialServer(c)
+		if err != nil {
+			return err
+		}
+		defer diffClient.Close()
+		defer func() { rep.ReceivedBytes = diffClient.receivedBytes() }()
+
+		client, err := newContainerdClient(c)
+		if err != nil {
+			return err
+		}
+		defer client.Close()
+
+		ctx, done, err := client.WithLease(ctx)
+		if err != nil {
+			return fmt.Errorf("error getting lease: %w", err)
+		}
+		defer done(ctx)
+
+		base, err := baseImage(ctx, c, client, target)
+		if err != nil {
+			return err
+		}
+		rep.Base = base
+		ctx = withImages(ctx, base, target)
+
+		r, err := startRun(ctx, c, client)
+		if err != nil {
+			return err
+		}
+		defer r.close()
+
+		timeRequestStart := time.Now()
+
+		p := newProgress()
+		defer p.finish()
+
+		// Check the manifest first, so nothing is downloaded for an image
+		// that can't be reconstructed.
+		m, imageConfig, err := fetchManifest(ctx, diffClient, target, &opts.provenance)
+		if err != nil {
+			return err
+		}
+		if err := checkCompatible(m, opts); err != nil {
+			return err
+		}
+
+		deltaPath := r.path("delta.zst")
+		timeFetchStart := time.Now()
+		if err := fetchDelta(ctx, diffClient, p, base, target, deltaPath); err != nil {
+			return err
+		}
+		rep.phase("fetch", time.Since(timeFetchStart))
+		rep.deltaFile(deltaPath)
+
+		timeDecompressStart := time.Now()
+		batchPath, err := decompressDelta(ctx, p, r, deltaPath)
+		if err != nil {
+			return err
+		}
+		rep.phase("decompress", time.Since(timeDecompressStart))
+
+		timeRequestEnd := time.Since(timeRequestStart)
+
+		p.printf("Successfully wrote delta diff file to %s\n", batchPath)
+
+		if opts.provenance.Delta, err = digestFile(deltaPath); err != nil {
+			return err
+		}
+		if c.Bool("exact") {
+			if opts.exact, err = fetchExact(ctx, diffClient, r, target); err != nil {
+				log.G(ctx).WithError(err).Warn("cannot get layer metadata, a squashed layer will be stored")
+				rep.Fallback = fmt.Sprintf("cannot get layer metadata: %v", err)
+			}
+		}
+
+		newImage, res, err := applyDelta(ctx, client, c.GlobalString("snapshotter"), p, r, base, target, batchPath, m, imageConfig, opts)
+		if err != nil {
+			return err
+		}
+		p.finish()
+		rep.applied(res)
+		rep.TargetDigest = newImage.Target().Digest
+
+		// Get the delta file size in bytes
+		fileInfo, err := os.Stat(deltaPath)
+		if err != nil {
+			return err
+		}
+
+		// Convert file size to megabytes
+		fileSizeMB := float64(fileInfo.Size()) / 1048576.0
+
+		// Get the image size
+		imageSizeBytes, err := newImage.Size(ctx)
+		if err != nil {
+			return fmt.Errorf("error getting image info: %w", err)
+		}
+
+		rep.ImageBytes = imageSizeBytes
+
+		// Convert image size to megabytes
+		imageSizeMB := float64(imageSizeBytes) / 1048576.0
+
+		fmt.Printf("Delta diff file size: %v MB\n", fileSizeMB)
+		fmt.Printf("Image size: %v MB\n", imageSizeMB)
+		fmt.Printf("Compression ratio (original:compressed): %v\n", imageSizeMB/fileSizeMB)
+
+		fmt.Printf("Time to receive delta diff file since request: %v\n", timeRequestEnd)
+		res.print()
+
+		after, _ := cpu.Get()
+		totalTime := time.Since(timeStart)
+
+		totalDiff := float64(after.Total - before.Total)
+		userDiff := float64(after.User - before.User)
+		usage := (userDiff / totalDiff) * 100
+
+		fmt.Printf("\nCPU Time: %v s\n", float64(totalTime)/10e+8*usage/100)
+		fmt.Printf("Total Time: %v\n", totalTime)
+		fmt.Printf("CPU Usage: %.2f%%\n", usage)
+
+		fmt.Printf("Successfully patched image %s\n", imageName(target))
+		return nil
+	},
+}
+
+var fetchCommand = cli.Command{
+	Name:      "fetch",
+	Usage:     "download the delta between a base and a target image without applying it",
+	ArgsUsage: "<target-image>",
+	Flags: []cli.Flag{
+		baseFlag,
+		cli.StringFlag{
+			Name:  "out",
+			Usage: "file to write the compressed delta to (default: a file in --tmp-dir)",
+		},
+		cli.StringFlag{
+			Name:  "bundle",
+			Usage: "write an offline bundle with the delta, manifest and config to this file instead",
+		},
+	},
+	Action: func(c *cli.Context) (err error) {
+		ctx, span := telemetry.StartSpan(context.Background(), "fetch")
+		defer telemetry.End(span, &err)
+
+		target, err := targetArg(c)
+		if err != nil {
+			return err
+		}
+		if c.String("out") != "" && c.String("bundle") != "" {
+			return errors.New("--out and --bundle cannot be used together")
+		}
+
+		diffClient, err := dialServer(c)
+		if err != nil {
+			return err
+		}
+		defer diffClient.Close()
+
+		base := c.String("base")
+		if base == "" {
+			client, err := newContainerdClient(c)
+			if err != nil {
+				return err
+			}
+			defer client.Close()
+
+			if base, err = baseImage(ctx, c, client, target); err != nil {
+				return err
+			}
+		}
+		ctx = withImages(ctx, base, target)
+
+		p := newProgress()
+		defer p.finish()
+
+		if bundlePath := c.String("bundle"); bundlePath != "" {
+			if err := fetchBundle(ctx, diffClient, p, c.GlobalString("tmp-dir"), base, target, bundlePath); err != nil {
+				return err
+			}
+			p.finish()
+			fmt.Printf("Successfully wrote delta bundle to %s\n", bundlePath)
+			return nil
+		}
+
+		// Only download the delta if the target can be reconstructed.
+		resp, err := requestManifest(ctx, diffClient, target)
+		if err != nil {
+			return err
+		}
+		if _, err := decodeManifest(resp); err != nil {
+			return err
+		}
+
+		deltaPath := c.String("out")
+		if deltaPath == "" {
+			deltaPath = filepath.Join(c.GlobalString("tmp-dir"),
+				fmt.Sprintf("delta-diff-patch-from-%s-to-%s.zst", imageName(base), imageName(target)))
+		}
+		if err := fetchDelta(ctx, diffClient, p, base, target, deltaPath); err != nil {
+			return err
+		}
+		p.finish()
+
+		fmt.Printf("Successfully wrote delta diff file to %s\n", deltaPath)
+		return nil
+	},
+}
+
+var applyCommand = cli.Command{
+	Name:      "apply",
+	Usage:     "apply a previously fetched delta or offline bundle to a base image",
+	ArgsUsage: "[target-image]",
+	Flags: []cli.Flag{
+		baseFlag,
+		createdFlag,
+		compressionFlag,
+		exactFlag,
+		outputFormatFlag,
+		cli.StringFlag{
+			Name:  "delta",
+			Usage: "compressed delta written by fetch; the manifest is requested from the server",
+		},
+		cli.StringFlag{
+			Name:  "bundle",
+			Usage: "offline bundle written by fetch --bundle; no server is contacted",
+		},
+		cli.BoolFlag{
+			Name:  "force",
+			Usage: "apply a bundle even if the local base image differs from the one it was made for",
+		},
+		reportFlag,
+		reportFormatFlag,
+	},
+	Action: func(c *cli.Context) (err error) {
+		ctx, span := telemetry.StartSpan(context.Background(), "apply")
+		defer telemetry.End(span, &err)
+
+		rep, err := newReport(c)
+		if err != nil {
+			return err
+		}
+		defer func() { err = rep.finish(err) }()
+
+		if c.String("bundle") != "" {
+			return applyBundle(ctx, c, rep)
+		}
+
+		target, err := targetArg(c)
+		if err != nil {
+			return err
+		}
+		rep.Target = target
+		opts, err := updateOpts(c)
+		if err != nil {
+			return err
+		}
+		deltaPath := c.String("delta")
+		if deltaPath == "" {
+			return errors.New("no delta given: use --delta <file> with a file written by fetch, or --bundle <file>")
+		}
+
+		diffClient, err := dialServer(c)
+		if err != nil {
+			return err
+		}
+		defer diffClient.Close()
+		defer func() { rep.ReceivedBytes = diffClient.receivedBytes() }()
+
+		client, err := newContainerdClient(c)
+		if err != nil {
+			return err
+		}
+		defer client.Close()
 
-func main() {
+		ctx, done, err := client.WithLease(ctx)
+		if err != nil {
+			return fmt.Errorf("error getting lease: %w", err)
+		}
+		defer done(ctx)
 
-	var SERVER_ADDRESS string
+		base, err := baseImage(ctx, c, client, target)
+		if err != nil {
+			return err
+		}
+		rep.Base = base
+		ctx = withImages(ctx, base, target)
 
-	if len(os.Args) != 3 {
-		fmt.Println("Usage: client <target-image>")
-		return
-	} else {
-		//image1ref = os.Args[1]
-		image2ref = os.Args[1]
-		SERVER_ADDRESS = os.Args[2]
+		r, err := startRun(ctx, c, client)
+		if err != nil {
+			return err
+		}
+		defer r.close()
+
+		m, imageConfig, err := fetchManifest(ctx, diffClient, target, &opts.provenance)
+		if err != nil {
+			return err
+		}
+		if err := checkCompatible(m, opts); err != nil {
+			return err
+		}
+
+		p := newProgress()
+		defer p.finish()
+
+		rep.deltaFile(deltaPath)
+		timeDecompressStart := time.Now()
+		batchPath, err := decompressDelta(ctx, p, r, deltaPath)
+		if err != nil {
+			return err
+		}
+		rep.phase("decompress", time.Since(timeDecompressStart))
+
+		if opts.provenance.Delta, err = digestFile(deltaPath); err != nil {
+			return err
+		}
+		if c.Bool("exact") {
+			if opts.exact, err = fetchExact(ctx, diffClient, r, target); err != nil {
+				log.G(ctx).WithError(err).Warn("cannot get layer metadata, a squashed layer will be stored")
+				rep.Fallback = fmt.Sprintf("cannot get layer metadata: %v", err)
+			}
+		}
+
+		newImage, res, err := applyDelta(ctx, client, c.GlobalString("snapshotter"), p, r, base, target, batchPath, m, imageConfig, opts)
+		if err != nil {
+			return err
+		}
+		p.finish()
+		rep.applied(res)
+		rep.TargetDigest = newImage.Target().Digest
+		if rep.ImageBytes, err = newImage.Size(ctx); err != nil {
+			return fmt.Errorf("error getting image info: %w", err)
+		}
+		res.print()
+
+		fmt.Printf("Successfully patched image %s with delta diff file %s\n", imageName(target), deltaPath)
+		return nil
+	},
+}
+
+// fetchBundle downloads the delta, manifest and config for an update and
+// writes them to an offline bundle at path.
+func fetchBundle(ctx context.Context, diffClient *serverClient, p *progress, tmpDir, base, target, path string) error {
+	r, err := newRun(tmpDir)
+	if err != nil {
+		return err
 	}
+	defer r.close()
 
-	before, _ := cpu.Get()
-	timeStart := time.Now()
+	files := map[string]string{
+		bundleDeltaFile:    r.path(bundleDeltaFile),
+		bundleManifestFile: r.path(bundleManifestFile),
+		bundleConfigFile:   r.path(bundleConfigFile),
+	}
+	// The manifest comes first, so nothing is downloaded for an image
+	// that can't be reconstructed.
+	targetResp, err := requestManifest(ctx, diffClient, target)
+	if err != nil {
+		return err
+	}
+	targetManifest, err := decodeManifest(targetResp)
+	if err != nil {
+		return err
+	}
+	if err := fetchDelta(ctx, diffClient, p, base, target, files[bundleDeltaFile]); err != nil {
+		return err
+	}
+	if err := os.WriteFile(files[bundleManifestFile], targetResp.Manifest, 0644); err != nil {
+		return err
+	}
+	if err := os.WriteFile(files[bundleConfigFile], targetResp.ImageConfig, 0644); err != nil {
+		return err
+	}
 
-	// Create a gRPC connection to the server.
-	conn, err := grpc.Dial(SERVER_ADDRESS, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	// The base digest lets the applying site check that it has the image
+	// the delta was computed against.
+	baseResp, err := requestManifest(ctx, diffClient, base)
+	if err != nil {
+		return err
+	}
+	baseManifest, err := decodeManifest(baseResp)
 	if err != nil {
-		fmt.Println(err)
-		return
+		return err
 	}
-	defer conn.Close()
 
-	// Create a gRPC client for the service.
-	diffClient := api.NewDeltaDiffServiceClient(conn)
+	return writeBundle(path, bundleMetadata{
+		Created:           time.Now().UTC(),
+		Base:              base,
+		BaseDigest:        baseManifest.Descriptor().Digest,
+		Target:            target,
+		TargetDigest:      targetManifest.Descriptor().Digest,
+		TargetMediaType:   targetManifest.Descriptor().MediaType,
+		TargetImageDigest: digest.Digest(targetResp.ImageDigest),
+		Server:            diffClient.address,
+	}, files)
+}
 
-	client, err := containerd.New("/run/containerd/containerd.sock", containerd.WithDefaultNamespace("default"))
+// applyBundle verifies an offline bundle and reconstructs the target image
+// from it without contacting the server, recording the outcome in rep.
+func applyBundle(ctx context.Context, c *cli.Context, rep *updateReport) error {
+	if c.String("delta") != "" {
+		return errors.New("--delta and --bundle cannot be used together")
+	}
+	if c.NArg() > 1 {
+		cli.ShowCommandHelp(c, c.Command.Name)
+		return fmt.Errorf("apply --bundle expects at most one target image reference, got %d arguments", c.NArg())
+	}
+	if c.Bool("exact") {
+		return errors.New("--exact needs the server; bundles don't carry the layer metadata")
+	}
+	opts, err := updateOpts(c)
+	if err != nil {
+		return err
+	}
+
+	client, err := newContainerdClient(c)
 	if err != nil {
-		fmt.Printf("error creating client: %v\n", err)
-		os.Exit(1)
+		return err
 	}
 	defer client.Close()
 
-	// Create a context for the request.
-	ctx := context.Background()
 	ctx, done, err := client.WithLease(ctx)
 	if err != nil {
-		fmt.Println("error getting lease")
-		fmt.Println(err)
+		return fmt.Errorf("error getting lease: %w", err)
 	}
 	defer done(ctx)
 
-	snapshotter := client.SnapshotService(containerd.DefaultSnapshotter)
+	r, err := startRun(ctx, c, client)
+	if err != nil {
+		return err
+	}
+	defer r.close()
+
+	meta, err := readBundle(c.String("bundle"), r.dir)
+	if err != nil {
+		return err
+	}
+	target := meta.Target
+	if c.NArg() == 1 && c.Args().First() != target {
+		return fmt.Errorf("bundle is for target %s, not %s", target, c.Args().First())
+	}
+	base := c.String("base")
+	if base == "" {
+		base = meta.Base
+	}
+	rep.Base, rep.Target = base, target
+	ctx = withImages(ctx, base, target)
+
+	baseImg, err := client.GetImage(ctx, base)
+	if err != nil {
+		return fmt.Errorf("error getting base image %s, it must be available locally: %w", base, err)
+	}
+	baseDesc, err := manifest.ResolvePlatform(ctx, client.ContentStore(), baseImg.Target(), platforms.DefaultSpec())
+	if err != nil {
+		return err
+	}
+	if baseDesc.Digest != meta.BaseDigest {
+		if !c.Bool("force") {
+			return fmt.Errorf("bundle was made for base %s (%s) but local %s is %s; use --force to apply anyway",
+				meta.Base, meta.BaseDigest, base, baseDesc.Digest)
+		}
+		log.G(ctx).WithFields(log.Fields{
+			"bundle_base": meta.BaseDigest,
+			"local_base":  baseDesc.Digest,
+		}).Warnf("bundle was made for a different version of %s", base)
+	}
+
+	manifestBytes, err := os.ReadFile(r.path(bundleManifestFile))
+	if err != nil {
+		return err
+	}
+	// The digest in the metadata was taken from this very file, so parsing
+	// against it also catches a mismatched metadata and manifest.
+	m, err := manifest.ParseManifest(ocispec.Descriptor{
+		MediaType: meta.TargetMediaType,
+		Digest:    meta.TargetDigest,
+	}, manifestBytes)
+	if err != nil {
+		return fmt.Errorf("error decoding bundle manifest: %w", err)
+	}
+	if err := checkCompatible(m, opts); err != nil {
+		return err
+	}
+	imageConfig, err := os.ReadFile(r.path(bundleConfigFile))
+	if err != nil {
+		return err
+	}
+
+	p := newProgress()
+	defer p.finish()
+
+	rep.deltaFile(r.path(bundleDeltaFile))
+	timeDecompressStart := time.Now()
+	batchPath, err := decompressDelta(ctx, p, r, r.path(bundleDeltaFile))
+	if err != nil {
+		return err
+	}
+	rep.phase("decompress", time.Since(timeDecompressStart))
+
+	opts.provenance = provenance{
+		Upstream:         meta.TargetImageDigest,
+		UpstreamManifest: meta.TargetDigest,
+		Delta:            meta.Files[bundleDeltaFile],
+		Server:           meta.Server,
+	}
+	if opts.provenance.Upstream == "" {
+		opts.provenance.Upstream = meta.TargetDigest
+	}
+
+	newImage, res, err := applyDelta(ctx, client, c.GlobalString("snapshotter"), p, r, base, target, batchPath, m, imageConfig, opts)
+	if err != nil {
+		return err
+	}
+	p.finish()
+	rep.applied(res)
+	rep.TargetDigest = newImage.Target().Digest
+	if rep.ImageBytes, err = newImage.Size(ctx); err != nil {
+		return fmt.Errorf("error getting image info: %w", err)
+	}
+	res.print()
+
+	fmt.Printf("Successfully patched image %s with bundle %s\n", imageName(target), c.String("bundle"))
+	return nil
+}
+
+// updateOptions are the settings of the update commands that control how
+// the target image is reconstructed.
+type updateOptions struct {
+	compression manifest.Compression
+	format      manifest.Format
+	replace     []manifest.ReplaceOpt
+	// set when the original layers are to be regenerated
+	exact *exactImage
+	// lineage recorded on the image; applyDelta fills in the base
+	provenance provenance
+}
 
-	// Locate if there are any existing older versions of image2
-	image_list, err := client.ListImages(context.Background())
+// updateOpts reads the updateOptions from the flags of the update commands.
+func updateOpts(c *cli.Context) (updateOptions, error) {
+	var opts updateOptions
+	created, err := manifest.ParseCreatedPolicy(c.String("created"))
 	if err != nil {
-		fmt.Printf("error listing images: %v\n", err)
-		return
+		return opts, fmt.Errorf("invalid --created: %w", err)
 	}
-	for _, image := range image_list {
-		if strings.Contains(image.Name(), strings.Split(image2ref, ":")[0]) && image.Name() != image2ref {
-			fmt.Printf("Found existing image %s, will fetch diffs between existing and target image...\n", image.Name())
-			image1ref = image.Name()
+	opts.replace = append(opts.replace, manifest.WithCreated(created))
+	if opts.compression, err = manifest.ParseCompression(c.String("layer-compression")); err != nil {
+		return opts, fmt.Errorf("invalid --layer-compression: %w", err)
+	}
+	if opts.format, err = manifest.ParseFormat(c.String("output-format")); err != nil {
+		return opts, fmt.Errorf("invalid --output-format: %w", err)
+	}
+	if opts.format != manifest.FormatPreserve {
+		if c.Bool("exact") {
+			return opts, errors.New("--exact keeps the upstream manifests, so it can't be used with --output-format")
 		}
+		opts.replace = append(opts.replace, manifest.WithFormat(opts.format))
+	}
+	return opts, nil
+}
+
+// targetArg returns the target image reference, the only positional argument
+// of the update commands.
+func targetArg(c *cli.Context) (string, error) {
+	if c.NArg() != 1 {
+		cli.ShowCommandHelp(c, c.Command.Name)
+		return "", fmt.Errorf("%s expects exactly one target image reference, got %d arguments", c.Command.Name, c.NArg())
+	}
+	return c.Args().First(), nil
+}
+
+// startRun removes what earlier runs left behind and starts a new run.
+func startRun(ctx context.Context, c *cli.Context, client *containerd.Client) (*run, error) {
+	if err := removeStale(ctx, client, c.GlobalString("snapshotter"), c.GlobalString("tmp-dir"), c.GlobalDuration("stale-after")); err != nil {
+		return nil, fmt.Errorf("error removing stale artifacts: %w", err)
+	}
+	return newRun(c.GlobalString("tmp-dir"))
+}
+
+// newContainerdClient connects to containerd using the global flags.
+func newContainerdClient(c *cli.Context) (*containerd.Client, error) {
+	client, err := containerd.New(c.GlobalString("address"),
+		containerd.WithDefaultNamespace(c.GlobalString("namespace")),
+		containerd.WithDialOpts(telemetry.ContainerdDialOptions()))
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to containerd at %s (set --address or CONTAINERD_ADDRESS): %w", c.GlobalString("address"), err)
+	}
+	return client, nil
+}
+
+// serverClient is a connection to the cargosync server.
+type serverClient struct {
+	api.DeltaDiffServiceClient
+	conn *grpc.ClientConn
+	// address the connection was made to
+	address string
+
+	// server-side containerd namespace the images are resolved in; empty
+	// for the server's default
+	namespace string
+
+	// size of the messages received from the server so far
+	received atomic.Int64
+}
+
+func (s *serverClient) Close() error {
+	return s.conn.Close()
+}
+
+// receivedBytes returns the size of the responses and stream messages
+// received from the server so far: deltas, manifests, configs, indexes and
+// layer metadata alike.
+func (s *serverClient) receivedBytes() int64 {
+	return s.received.Load()
+}
+
+func (s *serverClient) countUnary(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	err := invoker(ctx, method, req, reply, cc, opts...)
+	if err == nil {
+		s.count(reply)
 	}
+	return err
+}
+
+func (s *serverClient) countStream(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	stream, err := streamer(ctx, desc, cc, method, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &countingStream{ClientStream: stream, client: s}, nil
+}
 
-	image1name := strings.Split(image1ref, "/")[len(strings.Split(image1ref, "/"))-1]
-	image2name := strings.Split(image2ref, "/")[len(strings.Split(image2ref, "/"))-1]
+func (s *serverClient) count(m interface{}) {
+	if m, ok := m.(proto.Message); ok {
+		s.received.Add(int64(proto.Size(m)))
+	}
+}
+
+// countingStream counts the messages received on a stream.
+type countingStream struct {
+	grpc.ClientStream
+	client *serverClient
+}
+
+func (s *countingStream) RecvMsg(m interface{}) error {
+	err := s.ClientStream.RecvMsg(m)
+	if err == nil {
+		s.client.count(m)
+	}
+	return err
+}
+
+// dialServer opens the gRPC connection to the cargosync server.
+func dialServer(c *cli.Context) (*serverClient, error) {
+	address := c.GlobalString("server")
+	if address == "" {
+		return nil, errors.New("no server address given: use --server or set CARGOSYNC_SERVER")
+	}
+	// The server listens on a unix socket when given an absolute path.
+	if strings.HasPrefix(address, "/") {
+		address = "unix://" + address
+	}
+
+	creds, err := transportCredentials(c)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &serverClient{
+		address:   c.GlobalString("server"),
+		namespace: c.GlobalString("server-namespace"),
+	}
+	opts := append(telemetry.DialOptions(),
+		grpc.WithTransportCredentials(creds),
+		grpc.WithChainUnaryInterceptor(unaryRequestID, s.countUnary),
+		grpc.WithChainStreamInterceptor(streamRequestID, s.countStream))
+	if path := c.GlobalString("token-file"); path != "" {
+		if c.GlobalBool("insecure") {
+			return nil, errors.New("--token-file needs TLS, it can't be used with --insecure")
+		}
+		token, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("error reading --token-file: %w", err)
+		}
+		opts = append(opts, grpc.WithPerRPCCredentials(tokenCredentials(strings.TrimSpace(string(token)))))
+	}
+	conn, err := grpc.Dial(address, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to server %s: %w", address, err)
+	}
+	s.DeltaDiffServiceClient = api.NewDeltaDiffServiceClient(conn)
+	s.conn = conn
+	return s, nil
+}
+
+// transportCredentials returns TLS credentials built from the --tls-*
+// flags, or plaintext ones if --insecure is set.
+func transportCredentials(c *cli.Context) (credentials.TransportCredentials, error) {
+	if c.GlobalBool("insecure") {
+		for _, name := range []string{"tls-ca", "tls-cert", "tls-key", "tls-server-name"} {
+			if c.GlobalString(name) != "" {
+				return nil, fmt.Errorf("--insecure cannot be combined with --%s", name)
+			}
+		}
+		return insecure.NewCredentials(), nil
+	}
+
+	config := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: c.GlobalString("tls-server-name"),
+	}
+	if ca := c.GlobalString("tls-ca"); ca != "" {
+		pem, err := os.ReadFile(ca)
+		if err != nil {
+			return nil, fmt.Errorf("error loading --tls-ca: %w", err)
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in --tls-ca %s", ca)
+		}
+	}
+	if cert, key := c.GlobalString("tls-cert"), c.GlobalString("tls-key"); cert != "" || key != "" {
+		if cert == "" || key == "" {
+			return nil, errors.New("--tls-cert and --tls-key must be given together")
+		}
+		pair, err := tls.LoadX509KeyPair(cert, key)
+		if err != nil {
+			return nil, fmt.Errorf("error loading client certificate: %w", err)
+		}
+		config.Certificates = []tls.Certificate{pair}
+	}
+	return credentials.NewTLS(config), nil
+}
+
+// tokenCredentials sends a bearer token with every request.
+type tokenCredentials string
+
+func (t tokenCredentials) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	return map[string]string{api.AuthorizationKey: "Bearer " + string(t)}, nil
+}
+
+// RequireTransportSecurity keeps the token from being sent in cleartext.
+func (tokenCredentials) RequireTransportSecurity() bool {
+	return true
+}
+
+// baseImage returns the --base flag, or else an existing local version of
+// the target image that the delta can be computed from.
+func baseImage(ctx context.Context, c *cli.Context, client *containerd.Client, target string) (string, error) {
+	if base := c.String("base"); base != "" {
+		return base, nil
+	}
+
+	imageList, err := client.ImageService().List(ctx)
+	if err != nil {
+		return "", fmt.Errorf("error listing images: %w", err)
+	}
+	base, err := chooseBase(target, imageList)
+	if err != nil {
+		return "", err
+	}
+	log.G(ctx).WithField("base", base).Info("found existing image to use as the base")
+	return base, nil
+}
+
+// chooseBase returns the newest of imageList from the same repository as
+// target, other than target itself. Names are compared normalized, so
+// alpine:3.17 is a version of docker.io/library/alpine:3.18 but myalpine
+// and registry.local/alpine are not.
+func chooseBase(target string, imageList []images.Image) (string, error) {
+	targetRef, err := normalizeReference(target)
+	if err != nil {
+		return "", err
+	}
+	named, err := refdocker.ParseNormalizedNamed(targetRef)
+	if err != nil {
+		return "", err
+	}
 
-	// Make a request to the server.
-	req := api.CalcImageDiffsRequest{
-		Image1: &api.Image{Reference: image1ref}, // example: "docker.io/library/alpine:3.15.10"
-		Image2: &api.Image{Reference: image2ref}, // example: "docker.io/library/alpine:latest"
+	var base *images.Image
+	for i, image := range imageList {
+		ref, err := refdocker.ParseNormalizedNamed(image.Name)
+		if err != nil || ref.Name() != named.Name() || refdocker.TagNameOnly(ref).String() == targetRef {
+			continue
+		}
+		if base == nil || image.CreatedAt.After(base.CreatedAt) ||
+			image.CreatedAt.Equal(base.CreatedAt) && image.Name < base.Name {
+			base = &imageList[i]
+		}
 	}
+	if base == nil {
+		return "", fmt.Errorf("no local version of %s found to use as the base: pull one first or pass --base", target)
+	}
+	return base.Name, nil
+}
 
-	timeRequestStart := time.Now()
+// imageName returns the last path component of an image reference.
+func imageName(ref string) string {
+	return ref[strings.LastIndex(ref, "/")+1:]
+}
+
+// serverImage returns ref as sent to the server, normalized, which is how
+// the server pulls it and how policies name it.
+func serverImage(ref string) (*api.Image, error) {
+	ref, err := normalizeReference(ref)
+	if err != nil {
+		return nil, err
+	}
+	return &api.Image{Reference: ref}, nil
+}
 
-	resp, err := diffClient.CalculateDeltaDiffs(ctx, &req)
+// normalizeReference returns ref in its complete form, such as
+// docker.io/library/alpine:3.18 for alpine:3.18. Local images keep the
+// names they were given, so this is needed before a name is sent anywhere.
+func normalizeReference(ref string) (string, error) {
+	named, err := refdocker.ParseNormalizedNamed(ref)
 	if err != nil {
-		fmt.Printf("rpc request error: %v\n", err)
-		return
+		return "", fmt.Errorf("invalid image reference %q: %w", ref, err)
 	}
+	return refdocker.TagNameOnly(named).String(), nil
+}
+
+// fetchDelta streams the compressed delta between base and target from the
+// server into path, showing the server's progress on p.
+func fetchDelta(ctx context.Context, diffClient *serverClient, p *progress, base, target, path string) (err error) {
+	ctx, span := telemetry.StartSpan(ctx, "fetchDelta")
+	defer telemetry.End(span, &err)
 
-	filepath := fmt.Sprintf("/tmp/delta-diff-patch-from-%s-to-%s.zst", image1name, image2name)
-	// Delete file if it already exists
-	if _, err := os.Stat(filepath); err == nil {
-		os.Remove(filepath)
+	image1, err := serverImage(base)
+	if err != nil {
+		return err
+	}
+	image2, err := serverImage(target)
+	if err != nil {
+		return err
 	}
-	// Create file to write stream to
-	f, err := os.OpenFile(filepath, // example: "delta-diff-patch-from-alpine:3.15.10-to-alpine:latest
-		os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	p.setPhase(phaseWaiting)
+	platform := platforms.DefaultSpec()
+	resp, err := diffClient.CalculateDeltaDiffs(ctx, &api.CalcImageDiffsRequest{
+		Image1:    image1, // example: "docker.io/library/alpine:3.15.10"
+		Image2:    image2, // example: "docker.io/library/alpine:latest"
+		Namespace: diffClient.namespace,
+		Os:        platform.OS,
+		Arch:      platform.Architecture,
+		Variant:   platform.Variant,
+		OsVersion: platform.OSVersion,
+	})
 	if err != nil {
-		fmt.Printf("error creating delta file: %v\n", err)
-		return
+		return fmt.Errorf("rpc request error: %w", err)
 	}
+
+	// Write to a temporary file first so that a concurrent fetch of the
+	// same delta never sees, or leaves behind, a half-written file.
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".part-*")
+	if err != nil {
+		return fmt.Errorf("error creating delta file: %w", err)
+	}
+	defer os.Remove(f.Name())
 	defer f.Close()
 
 	// Receive stream (of delta diff file chunks) and write to file
 	for {
 		chunk, err := resp.Recv()
-		if err != nil {
+		if err == io.EOF {
 			break
 		}
+		if err != nil {
+			return fmt.Errorf("error receiving delta: %w", err)
+		}
+		if phase, ok := serverPhases[chunk.Phase]; ok {
+			p.setPhase(phase)
+		}
+		if chunk.Phase == api.DeltaPhase_DELTA_PHASE_SENDING {
+			p.setTotal(chunk.TotalSize)
+		}
+		// Older servers don't announce the transfer.
+		if chunk.Phase == api.DeltaPhase_DELTA_PHASE_SENDING || len(chunk.DeltaDiff) > 0 {
+			p.setPhase(phaseReceiving)
+		}
+		p.add(len(chunk.DeltaDiff))
 		if _, err := f.Write(chunk.DeltaDiff); err != nil {
-			fmt.Printf("error writing to file: %v\n", err)
-			return
+			return fmt.Errorf("error writing to file: %w", err)
 		}
 	}
-
-	// Decompress the delta diff file
-	cmd := exec.Command("zstd", "-fd", filepath)
-	output, err := cmd.CombinedOutput()
-	fmt.Println(string(output))
-	if err != nil {
-		fmt.Printf("WARNING (decompress command): %s", err)
-		//return err
+	if err := f.Close(); err != nil {
+		return err
 	}
+	return os.Rename(f.Name(), path)
+}
 
-	filepath = fmt.Sprintf("/tmp/delta-diff-patch-from-%s-to-%s", image1name, image2name)
-
-	timeRequestEnd := time.Since(timeRequestStart)
+// decompressDelta decompresses a zstd delta into the run's working
+// directory and returns the path of the rsync batch file.
+func decompressDelta(ctx context.Context, p *progress, r *run, path string) (_ string, err error) {
+	_, span := telemetry.StartSpan(ctx, "zstd")
+	defer telemetry.End(span, &err)
+	p.setPhase(phaseDecompressing)
+
+	batchPath := r.path("delta.batch")
+	cmd := exec.Command("zstd", "-fdq", "-o", batchPath, "--", path)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return "", fmt.Errorf("error decompressing delta: %w: %s", err, output)
+	}
+	return batchPath, nil
+}
 
-	fmt.Printf("Successfully wrote delta diff file to %s\n", filepath)
+// fetchManifest requests the manifest and image config of the target image
+// from the server, and records where they came from in prov.
+func fetchManifest(ctx context.Context, diffClient *serverClient, target string, prov *provenance) (manifest.Manifest, []byte, error) {
+	resp, err := requestManifest(ctx, diffClient, target)
+	if err != nil {
+		return nil, nil, err
+	}
 
-	// Request manifest of image 2 from server
-	// For multi-platform images, we pecify the OS and Arch
-	// as the one used by the client
-	req2 := api.ManifestRequest{
-		Image: &api.Image{Reference: image2ref},
-		Os:    runtime.GOOS,
-		Arch:  runtime.GOARCH,
+	m, err := decodeManifest(resp)
+	if err != nil {
+		return nil, nil, err
 	}
+	prov.UpstreamManifest = m.Descriptor().Digest
+	prov.Upstream = digest.Digest(resp.ImageDigest)
+	if prov.Upstream == "" {
+		prov.Upstream = prov.UpstreamManifest
+	}
+	prov.Server = diffClient.address
+	return m, resp.ImageConfig, nil
+}
 
-	manifest2_bytes, err := diffClient.GetManifest(ctx, &req2)
+// requestManifest calls GetManifest for ref. For multi-platform images, the
+// manifest matching the client's platform is returned.
+func requestManifest(ctx context.Context, diffClient *serverClient, ref string) (*api.ManifestResponse, error) {
+	image, err := serverImage(ref)
+	if err != nil {
+		return nil, err
+	}
+	platform := platforms.DefaultSpec()
+	resp, err := diffClient.GetManifest(ctx, &api.ManifestRequest{
+		Image:     image,
+		Os:        platform.OS,
+		Arch:      platform.Architecture,
+		Variant:   platform.Variant,
+		OsVersion: platform.OSVersion,
+		Namespace: diffClient.namespace,
+	})
 	if err != nil {
-		fmt.Printf("rpc request error: %v\n", err)
-		return
+		return nil, fmt.Errorf("rpc request error: %w", err)
 	}
+	return resp, nil
+}
 
-	var manifest2_impl manifest.ManifestImpl
-	if err := bson.Unmarshal(manifest2_bytes.Manifest, &manifest2_impl); err != nil {
-		fmt.Printf("error unmarshalling manifest: %v\n", err)
-		return
+// decodeManifest decodes the manifest returned by the server's GetManifest.
+func decodeManifest(resp *api.ManifestResponse) (*manifest.ImageManifest, error) {
+	m, err := manifest.ParseManifest(ocispec.Descriptor{MediaType: resp.MediaType}, resp.Manifest)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding manifest: %w", err)
 	}
+	return m, nil
+}
 
-	// Get the image config (in bytes) from the response
-	imageConfig := manifest2_bytes.ImageConfig
+// applyResult tells how applyDelta went.
+type applyResult struct {
+	applyDelta, createLayer, createImage, unpack time.Duration
+	// lineage recorded on the new image
+	prov provenance
+	// why the original layers couldn't be regenerated, if --exact was
+	// asked for but a squashed layer was stored instead
+	fallback string
+}
+
+func (t applyResult) print() {
+	fmt.Printf("Time to apply delta: %v\n", t.applyDelta)
+	fmt.Printf("Time to create layer: %v\n", t.createLayer)
+	fmt.Printf("Time to create image: %v\n", t.createImage)
+	fmt.Printf("Time to unpack image: %v\n", t.unpack)
+}
 
-	var manifest2 manifest.Manifest
-	manifest2 = &manifest.ManifestImpl{
-		D:    manifest2_impl.D,
-		Desc: manifest2_impl.Desc,
+// checkCompatible fails if the target manifest can't be reconstructed with
+// opts, so that the check can be done before anything is downloaded or
+// applied.
+func checkCompatible(m manifest.Manifest, opts updateOptions) error {
+	mediaType := opts.format.ManifestMediaType(m.Descriptor().MediaType)
+	if _, err := manifest.LayerMediaType(mediaType, opts.compression); err != nil {
+		return fmt.Errorf("target image can't be reconstructed: %w", err)
 	}
+	return nil
+}
+
+// applyDelta replays the rsync batch on a snapshot of the base image, turns
+// the patched filesystem into a single layer, and stores the target image
+// built from that layer and the target manifest.
+func applyDelta(ctx context.Context, client *containerd.Client, snapshotterName string, p *progress, r *run, baseRef, targetRef, batchPath string, m manifest.Manifest, imageConfig []byte, opts updateOptions) (containerd.Image, applyResult, error) {
+	var res applyResult
 
-	image1, err := client.GetImage(context.Background(), image1ref)
+	snapshotter := client.SnapshotService(snapshotterName)
+
+	base, err := client.GetImage(ctx, baseRef)
 	if err != nil {
-		fmt.Printf("error getting image %v. You should have the image pulled. errormsg: %v\n", image1ref, err)
-		os.Exit(1)
+		return nil, res, fmt.Errorf("error getting image %v, you should have the image pulled: %w", baseRef, err)
 	}
+	replaceOpts := append(opts.replace,
+		manifest.WithBase(baseRef, base.Target().Digest),
+		manifest.WithIngestRef("cargosync-"+r.id))
+
+	prov := opts.provenance
+	prov.Base = baseRef
+	prov.BaseDigest = base.Target().Digest
+	prov.Reconstructed = time.Now().UTC()
+
 	// unpack the image if not unpacked
-	isUnpacked, err := image1.IsUnpacked(context.Background(), "overlayfs")
+	isUnpacked, err := base.IsUnpacked(ctx, snapshotterName)
 	if err != nil {
-		fmt.Printf("error checking if image is unpacked: %v\n", err)
-		os.Exit(1)
+		return nil, res, fmt.Errorf("error checking if image is unpacked: %w", err)
 	}
 	if !isUnpacked {
-		err = image1.Unpack(context.Background(), "overlayfs")
-		if err != nil {
-			fmt.Printf("error unpacking image: %v\n", err)
-			return
+		if err := base.Unpack(ctx, snapshotterName); err != nil {
+			return nil, res, fmt.Errorf("error unpacking image: %w", err)
 		}
 	}
-	
-	if err := snapshotter.Remove(ctx, "from"); err == nil {
-		fmt.Println("cleaned up a snapshot from before:)")
+
+	fromKey := r.snapshotKey("from")
+	mountsFrom, err := PrepareSnapshot(ctx, snapshotter, base, fromKey, r.snapshotOpts())
+	if err != nil {
+		return nil, res, err
 	}
-	mounts_from := PrepareSnapshot(ctx, snapshotter, image1, "from")
-	defer snapshotter.Remove(ctx, "from")
+	defer snapshotter.Remove(ctx, fromKey)
 
-	if err := mount.WithTempMount(ctx, mounts_from, func(from_root string) error {
-		fmt.Println("from-dir: " + from_root)
+	var newImage containerd.Image
+	if err := mount.WithTempMount(ctx, mountsFrom, func(fromRoot string) error {
+		log.G(ctx).WithField("dir", fromRoot).Debug("base snapshot mounted")
 
 		timeApplyDeltaStart := time.Now()
+		p.setPhase(phaseApplying)
 
 		cmd := exec.Command("rsync",
 			"-avH",
 			"--partial",
 			"--delete",
-			"--read-batch="+filepath,
+			"--read-batch="+batchPath,
 			"--checksum",
 			"--no-i-r",
 			"--one-file-system",
-			from_root+"/")
+			"--", fromRoot+"/")
 
+		_, span := telemetry.StartSpan(ctx, "rsync")
 		output, err := cmd.CombinedOutput()
-		fmt.Println(string(output))
+		telemetry.End(span, &err)
+		log.G(ctx).WithField("phase", "apply").Debugf("rsync output:\n%s", output)
 		if err != nil {
-			fmt.Printf("WARNING (apply batch command): %s", err)
-			//return err
+			// The base snapshot is half patched; it is removed on the way
+			// out, and nothing is built from it.
+			return fmt.Errorf("error applying delta: %w: %s", err, output)
 		}
 
-		timeToApplyDelta := time.Since(timeApplyDeltaStart)
+		res.applyDelta = time.Since(timeApplyDeltaStart)
+		log.G(ctx).WithFields(log.Fields{"phase": "apply", "duration": res.applyDelta}).Debug("delta applied")
 
-		// Retrieve the empty image
-		image_empty, err := client.GetImage(ctx, "docker.io/jprotogtwi/blank-canvas:latest")
-		if err != nil {
-			fmt.Printf("Image %v not found, pulling...\n", "docker.io/jprotogtwi/blank-canvas:latest")
-			_, err = client.Pull(ctx, "docker.io/jprotogtwi/blank-canvas:latest", containerd.WithPullUnpack)
+		timeToCreateLayerStart := time.Now()
+		p.setPhase(phaseLayer)
+		layerCtx, span := telemetry.StartSpan(ctx, "createLayer")
+
+		var target ocispec.Descriptor
+		if opts.exact != nil {
+			// Regenerate the original layers from the patched filesystem,
+			// so the image keeps its upstream digest.
+			target, err = opts.exact.store(layerCtx, client.ContentStore(), fromRoot)
 			if err != nil {
-				fmt.Println(err)
-				return err
+				log.G(ctx).WithError(err).Warn("cannot reconstruct the original image, storing a squashed layer instead")
+				res.fallback = fmt.Sprintf("cannot reconstruct the original image: %v", err)
 			}
-			image_empty, err = client.GetImage(ctx, "docker.io/jprotogtwi/blank-canvas:latest")
-			if err != nil {
-				fmt.Println(err)
+			prov.Mode = modeExact
+		}
+		if target.Digest == "" {
+			// The squashed manifest is ours, so it can carry the lineage too.
+			prov.Mode = modeSquashed
+			replaceOpts = append(replaceOpts, manifest.WithAnnotations(prov.labels()))
+			if err := squashLayer(layerCtx, client, snapshotterName, r, mountsFrom, m, imageConfig, opts.compression, replaceOpts); err != nil {
+				telemetry.End(span, &err)
 				return err
 			}
+			target = m.Descriptor()
 		}
-		
-		if err := snapshotter.Remove(ctx, "empty"); err == nil {
-                fmt.Println("cleaned up a snapshot from before:)")
-        	}
-		mounts_empty := PrepareSnapshot(ctx, snapshotter, image_empty, "empty")
+		span.SetAttributes(attribute.String("mode", prov.Mode))
+		span.End()
 
-		// write diffs between patched filesystem and empty mount to content store
-		// this is basically a layer
-
-		timeToCreateLayerStart := time.Now()
-
-		diffs, err := client.DiffService().Compare(ctx, mounts_empty, mounts_from, diff.WithMediaType(ocispec.MediaTypeImageLayerGzip), diff.WithReference("custom-ref"))
-		if err != nil {
-			fmt.Printf("error creating diff: %v\n", err)
-			return err
-		}
-
-		if err := manifest2.ReplaceWithLayer(ctx, client.ContentStore(), diffs, imageConfig); err != nil {
-			fmt.Printf("error modifying target manifest: %v\n", err)
-			return err
-		}
-
-		timeToCreateLayer := time.Since(timeToCreateLayerStart)
+		res.createLayer = time.Since(timeToCreateLayerStart)
+		log.G(ctx).WithFields(log.Fields{"phase": "layer", "mode": prov.Mode, "duration": res.createLayer}).Debug("layer created")
 
 		timeCreateImageStart := time.Now()
-
-		// Create a new image from the modified manifest
-
-		_, err = client.ImageService().Create(ctx,
-			images.Image{
-				Name: image2ref,
-				Target: ocispec.Descriptor{
-					Digest:    manifest2.Descriptor().Digest,
-					Size:      manifest2.Descriptor().Size,
-					MediaType: manifest2.Descriptor().MediaType,
-				},
+		imageCtx, span := telemetry.StartSpan(ctx, "createImage")
+
+		// Create a new image from the modified manifest, replacing an older
+		// image of the same name if there is one.
+		img := images.Image{
+			Name:   targetRef,
+			Labels: prov.labels(),
+			Target: ocispec.Descriptor{
+				Digest:    target.Digest,
+				Size:      target.Size,
+				MediaType: target.MediaType,
 			},
-		)
-		if err != nil {
-			fmt.Println(err)
 		}
+		if _, err := client.ImageService().Create(imageCtx, img); err != nil {
+			// Only replace our labels, leaving any others on the image. An
+			// empty label is removed, so stale ones don't survive.
+			fieldpaths := []string{"target"}
+			for _, k := range provenanceLabels {
+				fieldpaths = append(fieldpaths, "labels."+k)
+			}
+			if _, err := client.ImageService().Update(imageCtx, img, fieldpaths...); err != nil {
+				telemetry.End(span, &err)
+				return fmt.Errorf("error creating image: %w", err)
+			}
+		}
+		span.End()
 
-		timeToCreateImage := time.Since(timeCreateImageStart)
+		res.createImage = time.Since(timeCreateImageStart)
+		log.G(ctx).WithFields(log.Fields{"phase": "image", "digest": target.Digest, "duration": res.createImage}).Debug("image created")
 
-		new_image, err := client.GetImage(ctx, image2ref)
+		newImage, err = client.GetImage(ctx, targetRef)
 		if err != nil {
-			fmt.Println("ERROR GETTING NEW IMAGE: ", err)
-			return err
+			return fmt.Errorf("error getting new image: %w", err)
 		}
 
 		timeToUnpackStart := time.Now()
+		p.setPhase(phaseUnpacking)
 
-		if err := new_image.Unpack(ctx, containerd.DefaultSnapshotter); err != nil {
-			fmt.Println("ERROR UNPACKING IMAGE: ", err)
-			return err
-		}
-
-		timeToUnpack := time.Since(timeToUnpackStart)
-
-		// Get the delta file size in bytes
-		fileInfo, err := os.Stat(filepath + ".zst")
+		unpackCtx, span := telemetry.StartSpan(ctx, "unpack")
+		err = newImage.Unpack(unpackCtx, snapshotterName)
+		telemetry.End(span, &err)
 		if err != nil {
-			fmt.Println("Error:", err)
-			return err
+			return fmt.Errorf("error unpacking image: %w", err)
 		}
 
-		// Get the file size in bytes from the file info
-		fileSizeBytes := fileInfo.Size()
+		res.unpack = time.Since(timeToUnpackStart)
+		log.G(ctx).WithFields(log.Fields{"phase": "unpack", "duration": res.unpack}).Debug("image unpacked")
+		return nil
+	}); err != nil {
+		return nil, res, fmt.Errorf("error mounting from-image: %w", err)
+	}
 
-		// Convert file size to megabytes
-		fileSizeMB := float64(fileSizeBytes) / 1048576.0
+	res.prov = prov
+	return newImage, res, nil
+}
 
-		// Get the image size
-		imageSizeBytes, err := new_image.Size(ctx)
+// squashLayer turns the patched filesystem mounted by mountsFrom into a
+// single layer and replaces the layers of m with it.
+func squashLayer(ctx context.Context, client *containerd.Client, snapshotterName string, r *run, mountsFrom []mount.Mount, m manifest.Manifest, imageConfig []byte, compression manifest.Compression, opts []manifest.ReplaceOpt) error {
+	snapshotter := client.SnapshotService(snapshotterName)
+
+	// Retrieve the empty image
+	imageEmpty, err := client.GetImage(ctx, blankImageRef)
+	if err != nil {
+		log.G(ctx).WithField("image", blankImageRef).Info("image not found, pulling")
+		imageEmpty, err = client.Pull(ctx, blankImageRef, containerd.WithPullUnpack, containerd.WithPullSnapshotter(snapshotterName))
 		if err != nil {
-			fmt.Println("Error getting image info:", err)
 			return err
 		}
+	}
 
-		// Convert image size to megabytes
-		imageSizeMB := float64(imageSizeBytes) / 1048576.0
-
-		fmt.Printf("Delta diff file size: %v MB\n", fileSizeMB)
-		fmt.Printf("Image size: %v MB\n", imageSizeMB)
-		fmt.Printf("Compression ratio (original:compressed): %v\n", imageSizeMB/fileSizeMB)
-
-		fmt.Printf("Time to receive delta diff file since request: %v\n", timeRequestEnd)
-		fmt.Printf("Time to apply delta: %v\n", timeToApplyDelta)
-		fmt.Printf("Time to create layer: %v\n", timeToCreateLayer)
-		fmt.Printf("Time to create image: %v\n", timeToCreateImage)
-		fmt.Printf("Time to unpack image: %v\n", timeToUnpack)
-
-		after, _ := cpu.Get()
-		totalTime := time.Since(timeStart)
-
-		totalDiff := float64(after.Total - before.Total)
-		userDiff := float64(after.User - before.User)
-		usage := (userDiff / totalDiff) * 100
+	emptyKey := r.snapshotKey("empty")
+	mountsEmpty, err := PrepareSnapshot(ctx, snapshotter, imageEmpty, emptyKey, r.snapshotOpts())
+	if err != nil {
+		return err
+	}
+	defer snapshotter.Remove(ctx, emptyKey)
 
-		fmt.Printf("\nCPU Time: %v s\n", float64(totalTime)/10e+8 * usage / 100)
-		fmt.Printf("Total Time: %v\n", totalTime)
-		fmt.Printf("CPU Usage: %.2f%%\n", usage)
-		return nil
+	// write diffs between patched filesystem and empty mount to content store
+	// this is basically a layer
 
-	}); err != nil {
-		fmt.Printf("error mounting from-image: %v\n", err)
-		return
+	layer, err := createLayer(ctx, client, mountsEmpty, mountsFrom, compression, "cargosync-layer-"+r.id)
+	if err != nil {
+		return err
 	}
 
-	fmt.Printf("Successfully patched image %s with delta diff file %s\n", image2name, filepath)
+	if err := m.ReplaceWithLayer(ctx, client.ContentStore(), layer, imageConfig, opts...); err != nil {
+		return fmt.Errorf("error modifying target manifest: %w", err)
+	}
 
+	return nil
 }
 
-func PrepareSnapshot(ctx context.Context, snapshotter snapshots.Snapshotter, image containerd.Image, key string) []mount.Mount {
-
+// PrepareSnapshot creates an active snapshot with the given key on top of
+// the image's root filesystem and returns its mounts.
+func PrepareSnapshot(ctx context.Context, snapshotter snapshots.Snapshotter, image containerd.Image, key string, opts ...snapshots.Opt) ([]mount.Mount, error) {
 	diffIDs, err := image.RootFS(ctx)
 	if err != nil {
-		panic(err)
+		return nil, fmt.Errorf("error getting rootfs of %s: %w", image.Name(), err)
 	}
 
 	parent := identity.ChainID(diffIDs).String()
 
-	mounts, err := snapshotter.Prepare(ctx, key, parent)
+	mounts, err := snapshotter.Prepare(ctx, key, parent, opts...)
 	if err != nil {
-		panic(err)
+		return nil, fmt.Errorf("error preparing snapshot %s: %w", key, err)
 	}
 
-	return mounts
+	return mounts, nil
 }
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"deltadiff/api"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd/images"
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/grpc"
+)
+
+// fakeStream delivers layer metadata chunks, then io.EOF.
+type fakeStream struct {
+	grpc.ClientStream
+	chunks [][]byte
+}
+
+func (s *fakeStream) RecvMsg(m interface{}) error {
+	if len(s.chunks) == 0 {
+		return io.EOF
+	}
+	m.(*api.LayerMetadataResponse).Chunk, s.chunks = s.chunks[0], s.chunks[1:]
+	return nil
+}
+
+func TestServerClientCountsReceivedBytes(t *testing.T) {
+	ctx := context.Background()
+	s := &serverClient{}
+
+	resp := &api.ManifestResponse{Manifest: []byte(`{"schemaVersion":2}`), ImageConfig: []byte(`{}`), MediaType: "application/vnd.oci.image.manifest.v1+json"}
+	reply := func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+		proto.Merge(reply.(*api.ManifestResponse), resp)
+		return nil
+	}
+	if err := s.countUnary(ctx, "GetManifest", &api.ManifestRequest{}, &api.ManifestResponse{}, nil, reply); err != nil {
+		t.Fatal(err)
+	}
+	want := int64(proto.Size(resp))
+
+	fail := func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+		return errors.New("unavailable")
+	}
+	if err := s.countUnary(ctx, "GetManifest", &api.ManifestRequest{}, &api.ManifestResponse{}, nil, fail); err == nil {
+		t.Fatal("countUnary() hid the error")
+	}
+
+	chunks := [][]byte{make([]byte, 1000), make([]byte, 10)}
+	stream, err := s.countStream(ctx, nil, nil, "GetLayerMetadata", func(context.Context, *grpc.StreamDesc, *grpc.ClientConn, string, ...grpc.CallOption) (grpc.ClientStream, error) {
+		return &fakeStream{chunks: chunks}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range chunks {
+		want += int64(proto.Size(&api.LayerMetadataResponse{Chunk: c}))
+	}
+	for {
+		if err := stream.RecvMsg(&api.LayerMetadataResponse{}); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if got := s.receivedBytes(); got != want {
+		t.Errorf("receivedBytes() = %d, want %d", got, want)
+	}
+}
+
+func TestChooseBase(t *testing.T) {
+	day := time.Date(2023, 9, 1, 0, 0, 0, 0, time.UTC)
+	local := func(name string, age int) images.Image {
+		return images.Image{Name: name, CreatedAt: day.AddDate(0, 0, -age)}
+	}
+	tests := []struct {
+		name   string
+		target string
+		local  []images.Image
+		want   string
+	}{
+		{
+			name:   "short names",
+			target: "alpine:3.18",
+			local:  []images.Image{local("alpine:3.17", 1)},
+			want:   "alpine:3.17",
+		},
+		{
+			name:   "short and full names",
+			target: "docker.io/library/alpine:3.18",
+			local:  []images.Image{local("alpine:3.17", 1)},
+			want:   "alpine:3.17",
+		},
+		{
+			name:   "newest",
+			target: "alpine:3.18",
+			local:  []images.Image{local("alpine:3.16", 2), local("alpine:3.17", 1), local("alpine:3.15", 3)},
+			want:   "alpine:3.17",
+		},
+		{
+			name:   "same age",
+			target: "alpine:3.18",
+			local:  []images.Image{local("alpine:3.17", 1), local("alpine:3.16", 1)},
+			want:   "alpine:3.16",
+		},
+		{
+			name:   "not the target itself",
+			target: "alpine",
+			local:  []images.Image{local("docker.io/library/alpine:latest", 0), local("alpine:3.17", 1)},
+			want:   "alpine:3.17",
+		},
+		{
+			name:   "registry with a port",
+			target: "registry.local:5000/app:2",
+			local:  []images.Image{local("registry.local:5000/app:1", 1), local("registry.local:5000/other:1", 0), local("registry.local:5000/team/app:1", 0)},
+			want:   "registry.local:5000/app:1",
+		},
+		{
+			name:   "other registry",
+			target: "registry.local:5000/app:2",
+			local:  []images.Image{local("docker.io/library/app:1", 0)},
+		},
+		{
+			name:   "names containing the target",
+			target: "app:2",
+			local:  []images.Image{local("myapp:1", 0), local("app-tools:1", 0), local("team/app:1", 0), local("registry.local/app:1", 0)},
+		},
+		{
+			name:   "digest",
+			target: "alpine:3.18",
+			local:  []images.Image{local("alpine@sha256:"+strings.Repeat("a", 64), 1), local("sha256:"+strings.Repeat("b", 64), 0)},
+			want:   "alpine@sha256:" + strings.Repeat("a", 64),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := chooseBase(tt.target, tt.local)
+			if tt.want == "" {
+				if err == nil {
+					t.Fatalf("chooseBase() = %s, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("chooseBase() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
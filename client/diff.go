@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"deltadiff/api"
+	"deltadiff/manifest"
+	"errors"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/containerd/containerd/platforms"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/urfave/cli"
+)
+
+var diffCommand = cli.Command{
+	Name:      "diff",
+	Usage:     "show what changed in the config and manifest between two images, as resolved by the server",
+	ArgsUsage: "<base-image> <target-image>",
+	Action: func(c *cli.Context) error {
+		if c.NArg() != 2 {
+			cli.ShowCommandHelp(c, c.Command.Name)
+			return errors.New("diff expects a base and a target image reference")
+		}
+
+		image1, err := serverImage(c.Args().Get(0))
+		if err != nil {
+			return err
+		}
+		image2, err := serverImage(c.Args().Get(1))
+		if err != nil {
+			return err
+		}
+
+		diffClient, err := dialServer(c)
+		if err != nil {
+			return err
+		}
+		defer diffClient.Close()
+
+		platform := platforms.DefaultSpec()
+		resp, err := diffClient.DiffImageConfig(context.Background(), &api.DiffImageConfigRequest{
+			Image1:    image1,
+			Image2:    image2,
+			Os:        platform.OS,
+			Arch:      platform.Architecture,
+			Variant:   platform.Variant,
+			OsVersion: platform.OSVersion,
+			Namespace: diffClient.namespace,
+		})
+		if err != nil {
+			return fmt.Errorf("rpc request error: %w", err)
+		}
+		d, err := decodeDiff(resp)
+		if err != nil {
+			return err
+		}
+
+		if c.GlobalString("output") == "json" {
+			return printJSON(d)
+		}
+		return printDiff(d)
+	},
+}
+
+// decodeDiff converts the server's DiffImageConfig response back to the
+// manifest package's diff.
+func decodeDiff(resp *api.DiffImageConfigResponse) (*manifest.ImageDiff, error) {
+	d := &manifest.ImageDiff{
+		Config:        decodeChanges(resp.Config),
+		Annotations:   decodeChanges(resp.Annotations),
+		LayersAdded:   []ocispec.Descriptor{},
+		LayersRemoved: []ocispec.Descriptor{},
+	}
+	for _, layers := range []struct {
+		from []*api.Layer
+		to   *[]ocispec.Descriptor
+	}{{resp.LayersAdded, &d.LayersAdded}, {resp.LayersRemoved, &d.LayersRemoved}} {
+		for _, layer := range layers.from {
+			dgst, err := digest.Parse(layer.Digest)
+			if err != nil {
+				return nil, fmt.Errorf("invalid layer digest from server: %w", err)
+			}
+			*layers.to = append(*layers.to, ocispec.Descriptor{MediaType: layer.MediaType, Digest: dgst, Size: layer.Size})
+		}
+	}
+	return d, nil
+}
+
+func decodeChanges(changes []*api.Change) []manifest.Change {
+	result := make([]manifest.Change, len(changes))
+	for i, ch := range changes {
+		result[i] = manifest.Change{Field: ch.Field, Key: ch.Key, Old: ch.Old, New: ch.New}
+	}
+	return result
+}
+
+func printDiff(d *manifest.ImageDiff) error {
+	if len(d.Config)+len(d.Annotations)+len(d.LayersAdded)+len(d.LayersRemoved) == 0 {
+		fmt.Println("No differences")
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 1, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "FIELD\tKEY\tOLD\tNEW")
+	for _, ch := range append(d.Config, d.Annotations...) {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", ch.Field, ch.Key, valueOrDash(ch.Old), valueOrDash(ch.New))
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	for _, layer := range d.LayersRemoved {
+		fmt.Printf("- layer %s (%.2f MB)\n", layer.Digest, float64(layer.Size)/1048576.0)
+	}
+	for _, layer := range d.LayersAdded {
+		fmt.Printf("+ layer %s (%.2f MB)\n", layer.Digest, float64(layer.Size)/1048576.0)
+	}
+	return nil
+}
+
+func valueOrDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
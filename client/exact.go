@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"deltadiff/api"
+	"deltadiff/layermeta"
+	"deltadiff/manifest"
+	"deltadiff/telemetry"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/platforms"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// exactImage holds what is needed to store the target image exactly as it
+// is upstream, with the same manifest, config and layer digests.
+type exactImage struct {
+	manifest *manifest.ImageManifest
+	config   []byte
+	// nil if the image points at the manifest directly
+	index *manifest.ImageIndex
+	// layer metadata, extracted to dir
+	layers *layermeta.Index
+	dir    string
+}
+
+// fetchExact downloads the untouched manifest, config and index of target,
+// and the metadata to regenerate its layers, into the run's directory.
+func fetchExact(ctx context.Context, diffClient *serverClient, r *run, target string) (_ *exactImage, err error) {
+	ctx, span := telemetry.StartSpan(ctx, "fetchExact")
+	defer telemetry.End(span, &err)
+
+	resp, err := requestManifest(ctx, diffClient, target)
+	if err != nil {
+		return nil, err
+	}
+	m, err := decodeManifest(resp)
+	if err != nil {
+		return nil, err
+	}
+	e := &exactImage{
+		manifest: m,
+		config:   resp.ImageConfig,
+		dir:      r.path("layers"),
+	}
+	if len(resp.Index) > 0 {
+		if e.index, err = manifest.ParseIndex(ocispec.Descriptor{MediaType: resp.IndexMediaType}, resp.Index); err != nil {
+			return nil, fmt.Errorf("error decoding index: %w", err)
+		}
+	}
+
+	image, err := serverImage(target)
+	if err != nil {
+		return nil, err
+	}
+	platform := platforms.DefaultSpec()
+	stream, err := diffClient.GetLayerMetadata(ctx, &api.LayerMetadataRequest{
+		Image:     image,
+		Namespace: diffClient.namespace,
+		Os:        platform.OS,
+		Arch:      platform.Architecture,
+		Variant:   platform.Variant,
+		OsVersion: platform.OSVersion,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("rpc request error: %w", err)
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		for {
+			chunk, err := stream.Recv()
+			if err == io.EOF {
+				pw.Close()
+				return
+			}
+			if err != nil {
+				pw.CloseWithError(fmt.Errorf("error receiving layer metadata: %w", err))
+				return
+			}
+			if _, err := pw.Write(chunk.Chunk); err != nil {
+				return
+			}
+		}
+	}()
+	defer pr.Close()
+
+	if e.layers, err = layermeta.Extract(pr, e.dir); err != nil {
+		return nil, err
+	}
+	if e.layers.Manifest != m.Descriptor().Digest {
+		return nil, fmt.Errorf("layer metadata is for manifest %s, not %s", e.layers.Manifest, m.Descriptor().Digest)
+	}
+	return e, nil
+}
+
+// store regenerates the layers from the patched filesystem at root and
+// stores them with the original config, manifest and index. It returns the
+// descriptor the image should point at.
+func (e *exactImage) store(ctx context.Context, cs content.Store, root string) (ocispec.Descriptor, error) {
+	if err := e.layers.Reproducible(); err != nil {
+		return ocispec.Descriptor{}, err
+	}
+
+	var config ocispec.Image
+	if err := json.Unmarshal(e.config, &config); err != nil {
+		return ocispec.Descriptor{}, fmt.Errorf("error decoding image config: %w", err)
+	}
+	layers := e.manifest.Layers()
+	if len(config.RootFS.DiffIDs) != len(layers) {
+		return ocispec.Descriptor{}, fmt.Errorf("image config has %d diff IDs for %d layers", len(config.RootFS.DiffIDs), len(layers))
+	}
+
+	for i, desc := range layers {
+		// Layers shared with the base are already here.
+		if _, err := cs.Info(ctx, desc.Digest); err == nil {
+			continue
+		}
+		if err := layermeta.Rebuild(ctx, cs, e.dir, e.layers, i, root, desc, config.RootFS.DiffIDs[i]); err != nil {
+			return ocispec.Descriptor{}, fmt.Errorf("error regenerating layer %s: %w", desc.Digest, err)
+		}
+	}
+
+	configDesc := e.manifest.Config()
+	if err := manifest.WriteBlob(ctx, cs, "cargosync-exact-"+configDesc.Digest.Encoded(), bytes.NewReader(e.config), configDesc, nil); err != nil {
+		return ocispec.Descriptor{}, fmt.Errorf("error storing image config: %w", err)
+	}
+	target := e.manifest.Descriptor()
+	if err := manifest.WriteBlob(ctx, cs, "cargosync-exact-"+target.Digest.Encoded(), bytes.NewReader(e.manifest.Bytes()), target,
+		e.manifest.GCLabels()); err != nil {
+		return ocispec.Descriptor{}, fmt.Errorf("error storing manifest: %w", err)
+	}
+	if e.index != nil {
+		target = e.index.Descriptor()
+		if err := manifest.WriteBlob(ctx, cs, "cargosync-exact-"+target.Digest.Encoded(), bytes.NewReader(e.index.Bytes()), target,
+			e.index.GCLabels()); err != nil {
+			return ocispec.Descriptor{}, fmt.Errorf("error storing index: %w", err)
+		}
+	}
+	return target, nil
+}
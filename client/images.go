@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"deltadiff/manifest"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/platforms"
+	"github.com/containerd/containerd/remotes"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/urfave/cli"
+)
+
+type imageSummary struct {
+	Name      string        `json:"name"`
+	Digest    digest.Digest `json:"digest"`
+	MediaType string        `json:"mediaType"`
+	Size      int64         `json:"size"`
+	Created   time.Time     `json:"created"`
+}
+
+var imagesCommand = cli.Command{
+	Name:      "images",
+	Usage:     "list local images, optionally only those whose name contains a filter",
+	ArgsUsage: "[filter]",
+	Action: func(c *cli.Context) error {
+		client, err := newContainerdClient(c)
+		if err != nil {
+			return err
+		}
+		defer client.Close()
+
+		ctx := context.Background()
+		imageList, err := client.ListImages(ctx)
+		if err != nil {
+			return fmt.Errorf("error listing images: %w", err)
+		}
+
+		summaries := []imageSummary{}
+		for _, image := range imageList {
+			if !strings.Contains(image.Name(), c.Args().First()) {
+				continue
+			}
+			size, err := image.Size(ctx)
+			if err != nil {
+				return fmt.Errorf("error getting size of %s: %w", image.Name(), err)
+			}
+			summaries = append(summaries, imageSummary{
+				Name:      image.Name(),
+				Digest:    image.Target().Digest,
+				MediaType: image.Target().MediaType,
+				Size:      size,
+				Created:   image.Metadata().CreatedAt,
+			})
+		}
+
+		if c.GlobalString("output") == "json" {
+			return printJSON(summaries)
+		}
+		w := tabwriter.NewWriter(os.Stdout, 1, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "NAME\tDIGEST\tSIZE\tCREATED")
+		for _, s := range summaries {
+			fmt.Fprintf(w, "%s\t%s\t%.2f MB\t%s\n", s.Name, s.Digest, float64(s.Size)/1048576.0, s.Created.Format(time.RFC3339))
+		}
+		return w.Flush()
+	},
+}
+
+type imageDetails struct {
+	imageSummary
+	Labels   map[string]string    `json:"labels,omitempty"`
+	Platform string               `json:"platform"`
+	Manifest ocispec.Descriptor   `json:"manifest"`
+	Config   ocispec.Descriptor   `json:"config"`
+	Layers   []ocispec.Descriptor `json:"layers"`
+	DiffIDs  []digest.Digest      `json:"diffIDs"`
+	// where a reconstructed image came from; nil for other images
+	Provenance *provenance `json:"provenance,omitempty"`
+	// what the image name resolves to in the registry now, with --check-upstream
+	RegistryDigest digest.Digest `json:"registryDigest,omitempty"`
+}
+
+var inspectCommand = cli.Command{
+	Name:      "inspect",
+	Usage:     "show the manifest, config and layers of a local image",
+	ArgsUsage: "<image>",
+	Flags: append([]cli.Flag{
+		cli.BoolFlag{
+			Name:  "check-upstream",
+			Usage: "check that the image the reconstructed image came from is still the one the registry serves",
+		},
+	}, registryFlags...),
+	Action: func(c *cli.Context) error {
+		ref, err := targetArg(c)
+		if err != nil {
+			return err
+		}
+
+		client, err := newContainerdClient(c)
+		if err != nil {
+			return err
+		}
+		defer client.Close()
+
+		ctx := context.Background()
+		image, err := client.GetImage(ctx, ref)
+		if err != nil {
+			if errdefs.IsNotFound(err) {
+				return fmt.Errorf("image %s not found in namespace %s", ref, c.GlobalString("namespace"))
+			}
+			return err
+		}
+
+		platform := platforms.DefaultSpec()
+		manifestDesc, err := manifest.ResolvePlatform(ctx, client.ContentStore(), image.Target(), platform)
+		if err != nil {
+			return err
+		}
+		m, err := images.Manifest(ctx, client.ContentStore(), manifestDesc, platforms.Only(platform))
+		if err != nil {
+			return fmt.Errorf("error reading manifest of %s: %w", ref, err)
+		}
+		diffIDs, err := image.RootFS(ctx)
+		if err != nil {
+			return fmt.Errorf("error reading rootfs of %s: %w", ref, err)
+		}
+		size, err := image.Size(ctx)
+		if err != nil {
+			return fmt.Errorf("error getting size of %s: %w", ref, err)
+		}
+
+		details := imageDetails{
+			imageSummary: imageSummary{
+				Name:      image.Name(),
+				Digest:    image.Target().Digest,
+				MediaType: image.Target().MediaType,
+				Size:      size,
+				Created:   image.Metadata().CreatedAt,
+			},
+			Labels:     image.Labels(),
+			Platform:   platforms.Format(platform),
+			Manifest:   manifestDesc,
+			Config:     m.Config,
+			Layers:     m.Layers,
+			DiffIDs:    diffIDs,
+			Provenance: provenanceFromLabels(image.Labels()),
+		}
+
+		var checkErr error
+		if c.Bool("check-upstream") {
+			if details.Provenance == nil {
+				return fmt.Errorf("image %s has no provenance to check", ref)
+			}
+			resolver, err := registryResolver(ctx, c)
+			if err != nil {
+				return err
+			}
+			if details.RegistryDigest, err = upstreamDigest(ctx, resolver, image.Name()); err != nil {
+				return err
+			}
+			if details.RegistryDigest != details.Provenance.Upstream {
+				checkErr = fmt.Errorf("%s was reconstructed from %s but the registry now serves %s", ref, details.Provenance.Upstream, details.RegistryDigest)
+			}
+		}
+
+		if c.GlobalString("output") == "json" {
+			if err := printJSON(details); err != nil {
+				return err
+			}
+			return checkErr
+		}
+		w := tabwriter.NewWriter(os.Stdout, 1, 8, 2, ' ', 0)
+		fmt.Fprintf(w, "Name:\t%s\n", details.Name)
+		fmt.Fprintf(w, "Digest:\t%s\n", details.Digest)
+		fmt.Fprintf(w, "Media type:\t%s\n", details.MediaType)
+		fmt.Fprintf(w, "Size:\t%.2f MB\n", float64(details.Size)/1048576.0)
+		fmt.Fprintf(w, "Platform:\t%s\n", details.Platform)
+		fmt.Fprintf(w, "Manifest:\t%s\n", details.Manifest.Digest)
+		fmt.Fprintf(w, "Config:\t%s\n", details.Config.Digest)
+		for k, v := range details.Labels {
+			if details.Provenance != nil && strings.HasPrefix(k, "cargosync.io/") {
+				continue
+			}
+			fmt.Fprintf(w, "Label:\t%s=%s\n", k, v)
+		}
+		for i, layer := range details.Layers {
+			fmt.Fprintf(w, "Layer %d:\t%s\t%s\t%.2f MB\n", i, layer.Digest, layer.MediaType, float64(layer.Size)/1048576.0)
+		}
+		if p := details.Provenance; p != nil {
+			fmt.Fprintf(w, "Reconstructed:\t%s (%s)\n", p.Reconstructed.Format(time.RFC3339), p.Mode)
+			fmt.Fprintf(w, "  Upstream:\t%s\n", p.Upstream)
+			fmt.Fprintf(w, "  Upstream manifest:\t%s\n", p.UpstreamManifest)
+			fmt.Fprintf(w, "  Base:\t%s@%s\n", p.Base, p.BaseDigest)
+			fmt.Fprintf(w, "  Delta:\t%s\n", p.Delta)
+			fmt.Fprintf(w, "  Server:\t%s\n", p.Server)
+			if details.RegistryDigest != "" {
+				fmt.Fprintf(w, "  Registry:\t%s\n", details.RegistryDigest)
+			}
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+		return checkErr
+	},
+}
+
+var gcCommand = cli.Command{
+	Name:  "gc",
+	Usage: "remove snapshots and working directories left behind by interrupted updates",
+	Description: `Only snapshots labelled by cargosync and working directories created by it
+   are removed, and only once they are older than --stale-after, so updates
+   still in progress are not disturbed.`,
+	Action: func(c *cli.Context) error {
+		client, err := newContainerdClient(c)
+		if err != nil {
+			return err
+		}
+		defer client.Close()
+
+		return removeStale(context.Background(), client, c.GlobalString("snapshotter"), c.GlobalString("tmp-dir"), c.GlobalDuration("stale-after"))
+	},
+}
+
+func printJSON(v interface{}) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// upstreamDigest returns the digest the registry serves for the local image
+// name, which may be a short name like alpine:3.18.
+func upstreamDigest(ctx context.Context, resolver remotes.Resolver, name string) (digest.Digest, error) {
+	ref, err := normalizeReference(name)
+	if err != nil {
+		return "", err
+	}
+	_, desc, err := resolver.Resolve(ctx, ref)
+	if err != nil {
+		return "", fmt.Errorf("error resolving %s in the registry: %w", ref, err)
+	}
+	return desc.Digest, nil
+}
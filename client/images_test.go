@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/containerd/containerd/reference"
+	"github.com/containerd/containerd/remotes"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// fakeResolver resolves every reference containerd's docker resolver
+// would accept to dgst, and records what it was asked for.
+type fakeResolver struct {
+	remotes.Resolver
+	dgst     digest.Digest
+	resolved []string
+}
+
+func (r *fakeResolver) Resolve(ctx context.Context, ref string) (string, ocispec.Descriptor, error) {
+	r.resolved = append(r.resolved, ref)
+	// The docker resolver parses references this way first, and knows
+	// nothing of Docker Hub's short names.
+	if _, err := reference.Parse(ref); err != nil {
+		return "", ocispec.Descriptor{}, err
+	}
+	return ref, ocispec.Descriptor{MediaType: ocispec.MediaTypeImageIndex, Digest: r.dgst}, nil
+}
+
+func TestUpstreamDigest(t *testing.T) {
+	dgst := digest.FromString("index")
+	tests := []struct {
+		name, want string
+	}{
+		{"alpine:3.18", "docker.io/library/alpine:3.18"},
+		{"alpine", "docker.io/library/alpine:latest"},
+		{"team/app:2", "docker.io/team/app:2"},
+		{"docker.io/library/alpine:3.18", "docker.io/library/alpine:3.18"},
+		{"registry.local:5000/app:2", "registry.local:5000/app:2"},
+		{"registry.local:5000/app@" + dgst.String(), "registry.local:5000/app@" + dgst.String()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &fakeResolver{dgst: dgst}
+			got, err := upstreamDigest(context.Background(), r, tt.name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != dgst {
+				t.Errorf("upstreamDigest() = %s, want %s", got, dgst)
+			}
+			if len(r.resolved) != 1 || r.resolved[0] != tt.want {
+				t.Errorf("resolved %v, want %s", r.resolved, tt.want)
+			}
+		})
+	}
+
+	if _, err := upstreamDigest(context.Background(), &fakeResolver{dgst: dgst}, "Alpine:3.18"); err == nil {
+		t.Error("upstreamDigest() of an invalid name succeeded")
+	}
+}
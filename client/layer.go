@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"deltadiff/manifest"
+	"fmt"
+	"io"
+
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/archive/compression"
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/diff"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/labels"
+	"github.com/containerd/containerd/mount"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// createLayer diffs upper against lower into a layer compressed with c.
+// containerd's differ only writes gzip or uncompressed layers, so zstd
+// layers are compressed here from an uncompressed diff.
+func createLayer(ctx context.Context, client *containerd.Client, lower, upper []mount.Mount, c manifest.Compression, ref string) (ocispec.Descriptor, error) {
+	mediaType := ocispec.MediaTypeImageLayerGzip
+	if c != manifest.CompressionGzip {
+		mediaType = ocispec.MediaTypeImageLayer
+	}
+	layer, err := client.DiffService().Compare(ctx, lower, upper, diff.WithMediaType(mediaType), diff.WithReference(ref))
+	if err != nil {
+		return ocispec.Descriptor{}, fmt.Errorf("error creating diff: %w", err)
+	}
+	if c != manifest.CompressionZstd {
+		return layer, nil
+	}
+	return compressLayer(ctx, client.ContentStore(), layer, ref+"-zstd")
+}
+
+// compressLayer stores a zstd-compressed copy of the uncompressed layer
+// desc, labelled with its diffID like the ones the differ writes.
+func compressLayer(ctx context.Context, cs content.Store, desc ocispec.Descriptor, ref string) (ocispec.Descriptor, error) {
+	ra, err := cs.ReaderAt(ctx, desc)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	defer ra.Close()
+
+	w, err := content.OpenWriter(ctx, cs, content.WithRef(ref))
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	defer w.Close()
+	if err := w.Truncate(0); err != nil {
+		return ocispec.Descriptor{}, err
+	}
+
+	zw, err := compression.CompressStream(w, compression.Zstd)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	if _, err := io.Copy(zw, content.NewReader(ra)); err != nil {
+		zw.Close()
+		return ocispec.Descriptor{}, fmt.Errorf("error compressing layer: %w", err)
+	}
+	if err := zw.Close(); err != nil {
+		return ocispec.Descriptor{}, fmt.Errorf("error compressing layer: %w", err)
+	}
+
+	info := content.Info{
+		Digest: w.Digest(),
+		Labels: map[string]string{labels.LabelUncompressed: desc.Digest.String()},
+	}
+	if err := w.Commit(ctx, 0, info.Digest, content.WithLabels(info.Labels)); err != nil {
+		if !errdefs.IsAlreadyExists(err) {
+			return ocispec.Descriptor{}, fmt.Errorf("error committing layer: %w", err)
+		}
+		if _, err := cs.Update(ctx, info, "labels."+labels.LabelUncompressed); err != nil {
+			return ocispec.Descriptor{}, err
+		}
+	}
+	info, err = cs.Info(ctx, info.Digest)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	return ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageLayerZstd,
+		Digest:    info.Digest,
+		Size:      info.Size,
+	}, nil
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"deltadiff/api"
+	"encoding/hex"
+	"time"
+
+	"github.com/containerd/containerd/log"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// withRequestID tags ctx and its logger with a new request ID, which the
+// server logs too, so both sides of a call can be matched up.
+func withRequestID(ctx context.Context, method string) context.Context {
+	b := make([]byte, 8)
+	rand.Read(b)
+	id := hex.EncodeToString(b)
+
+	ctx = metadata.AppendToOutgoingContext(ctx, api.RequestIDKey, id)
+	return log.WithLogger(ctx, log.G(ctx).WithFields(log.Fields{
+		"request_id": id,
+		"method":     method,
+	}))
+}
+
+func unaryRequestID(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	start := time.Now()
+	ctx = withRequestID(ctx, method)
+	err := invoker(ctx, method, req, reply, cc, opts...)
+	entry := log.G(ctx).WithField("duration", time.Since(start))
+	if err != nil {
+		entry = entry.WithError(err)
+	}
+	entry.Debug("request finished")
+	return err
+}
+
+func streamRequestID(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	ctx = withRequestID(ctx, method)
+	log.G(ctx).Debug("stream opened")
+	return streamer(ctx, desc, cc, method, opts...)
+}
+
+// withImages returns ctx with a logger that names the images of an update,
+// and names them on the update's span too.
+func withImages(ctx context.Context, base, target string) context.Context {
+	trace.SpanFromContext(ctx).SetAttributes(
+		attribute.String("base", base),
+		attribute.String("target", target))
+	return log.WithLogger(ctx, log.G(ctx).WithFields(log.Fields{
+		"base":   base,
+		"target": target,
+	}))
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"deltadiff/telemetry"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/defaults"
+	"github.com/containerd/containerd/log"
+	"github.com/urfave/cli"
+)
+
+// shutdownTracing flushes the spans of the command, once it has run.
+var shutdownTracing func(context.Context) error
+
+func main() {
+	app := cli.NewApp()
+	app.Name = "cargosync"
+	app.Usage = "update container images with rsync-based deltas"
+	app.Flags = []cli.Flag{
+		cli.StringFlag{
+			Name:   "address, a",
+			Usage:  "address of the containerd socket",
+			Value:  defaults.DefaultAddress,
+			EnvVar: "CONTAINERD_ADDRESS",
+		},
+		cli.StringFlag{
+			Name:   "namespace, n",
+			Usage:  "containerd namespace the local images live in (k8s.io for images used by the kubelet)",
+			Value:  "default",
+			EnvVar: "CONTAINERD_NAMESPACE",
+		},
+		cli.StringFlag{
+			Name:   "snapshotter",
+			Usage:  "containerd snapshotter used to unpack and mount images",
+			Value:  containerd.DefaultSnapshotter,
+			EnvVar: "CONTAINERD_SNAPSHOTTER",
+		},
+		cli.StringFlag{
+			Name:   "server, s",
+			Usage:  "address of the cargosync server (host:port or unix socket path)",
+			EnvVar: "CARGOSYNC_SERVER",
+		},
+		cli.StringFlag{
+			Name:   "server-namespace",
+			Usage:  "containerd namespace on the server to resolve images in (default: the server's)",
+			EnvVar: "CARGOSYNC_SERVER_NAMESPACE",
+		},
+		cli.StringFlag{
+			Name:   "tmp-dir",
+			Usage:  "directory the per-run working directories are created in",
+			Value:  os.TempDir(),
+			EnvVar: "CARGOSYNC_TMP_DIR",
+		},
+		cli.DurationFlag{
+			Name:   "stale-after",
+			Usage:  "age after which snapshots and working directories of interrupted runs are removed",
+			Value:  24 * time.Hour,
+			EnvVar: "CARGOSYNC_STALE_AFTER",
+		},
+		cli.StringFlag{
+			Name:   "tls-ca",
+			Usage:  "CA bundle used to verify the server (default: the system's CAs)",
+			EnvVar: "CARGOSYNC_TLS_CA",
+		},
+		cli.StringFlag{
+			Name:   "tls-cert",
+			Usage:  "client certificate, for servers that require one",
+			EnvVar: "CARGOSYNC_TLS_CERT",
+		},
+		cli.StringFlag{
+			Name:   "tls-key",
+			Usage:  "private key of the client certificate",
+			EnvVar: "CARGOSYNC_TLS_KEY",
+		},
+		cli.StringFlag{
+			Name:   "tls-server-name",
+			Usage:  "name to verify the server certificate against (default: the host of --server)",
+			EnvVar: "CARGOSYNC_TLS_SERVER_NAME",
+		},
+		cli.StringFlag{
+			Name:   "token-file",
+			Usage:  "file holding the token to authenticate to the server with",
+			EnvVar: "CARGOSYNC_TOKEN_FILE",
+		},
+		cli.BoolFlag{
+			Name:   "insecure",
+			Usage:  "connect without TLS: traffic is in cleartext and the server is not verified",
+			EnvVar: "CARGOSYNC_INSECURE",
+		},
+		cli.StringFlag{
+			Name:   "log-level",
+			Usage:  "log level (trace, debug, info, warn, error)",
+			Value:  "info",
+			EnvVar: "CARGOSYNC_LOG_LEVEL",
+		},
+		cli.StringFlag{
+			Name:   "log-format",
+			Usage:  "log output format (text, json)",
+			Value:  "text",
+			EnvVar: "CARGOSYNC_LOG_FORMAT",
+		},
+		cli.StringFlag{
+			Name:   "trace-otlp-endpoint",
+			Usage:  "OTLP gRPC collector to send traces to, host:port (default: tracing disabled)",
+			EnvVar: "CARGOSYNC_TRACE_OTLP_ENDPOINT",
+		},
+		cli.StringFlag{
+			Name:   "trace-file",
+			Usage:  "file to append traces to as JSON spans",
+			EnvVar: "CARGOSYNC_TRACE_FILE",
+		},
+		cli.StringFlag{
+			Name:   "output, o",
+			Usage:  "output format of listing commands (text, json)",
+			Value:  "text",
+			EnvVar: "CARGOSYNC_OUTPUT",
+		},
+	}
+	app.Before = func(c *cli.Context) error {
+		if err := log.SetLevel(c.GlobalString("log-level")); err != nil {
+			return fmt.Errorf("invalid --log-level %q: %w", c.GlobalString("log-level"), err)
+		}
+		switch c.GlobalString("log-format") {
+		case "text":
+			log.SetFormat(log.TextFormat)
+		case "json":
+			log.SetFormat(log.JSONFormat)
+		default:
+			return fmt.Errorf("invalid --log-format %q: must be text or json", c.GlobalString("log-format"))
+		}
+		switch c.GlobalString("output") {
+		case "text", "json":
+		default:
+			return fmt.Errorf("invalid --output %q: must be text or json", c.GlobalString("output"))
+		}
+
+		var err error
+		shutdownTracing, err = telemetry.Setup(context.Background(), "cargosync", c.GlobalString("trace-otlp-endpoint"), c.GlobalString("trace-file"))
+		return err
+	}
+	app.After = func(c *cli.Context) error {
+		if shutdownTracing == nil {
+			return nil
+		}
+		return shutdownTracing(context.Background())
+	}
+	app.Commands = []cli.Command{
+		syncCommand,
+		fetchCommand,
+		applyCommand,
+		inspectCommand,
+		imagesCommand,
+		gcCommand,
+		verifyCommand,
+		diffCommand,
+		benchCommand,
+	}
+
+	if err := app.Run(os.Args); err != nil {
+		fmt.Fprintf(os.Stderr, "cargosync: %v\n", err)
+		os.Exit(1)
+	}
+}
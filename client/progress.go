@@ -0,0 +1,184 @@
+package main
+
+import (
+	"deltadiff/api"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/containerd/console"
+	units "github.com/containerd/containerd/pkg/progress"
+)
+
+// Phases of an update shown by progress.
+const (
+	phaseWaiting       = "waiting for server"
+	phaseReceiving     = "receiving delta"
+	phaseDecompressing = "decompressing delta"
+	phaseApplying      = "applying delta"
+	phaseLayer         = "building layer"
+	phaseUnpacking     = "unpacking image"
+)
+
+// serverPhases describes what the server reports it is doing while the
+// client waits for the delta.
+var serverPhases = map[api.DeltaPhase]string{
+	api.DeltaPhase_DELTA_PHASE_PULLING:     phaseWaiting + " (pulling images)",
+	api.DeltaPhase_DELTA_PHASE_GENERATING:  phaseWaiting + " (generating delta)",
+	api.DeltaPhase_DELTA_PHASE_COMPRESSING: phaseWaiting + " (compressing delta)",
+}
+
+// progress shows the phase of an update on stdout. On a terminal, a single
+// status line is redrawn in place, with the bytes, rate and ETA while the
+// delta is received; otherwise a line is printed as each phase starts.
+type progress struct {
+	mu  sync.Mutex
+	out io.Writer
+	// nil when stdout is not a terminal
+	console console.Console
+
+	phase      string
+	phaseStart time.Time
+	// bytes received and expected; total is 0 if the server didn't say
+	received, total int64
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func newProgress() *progress {
+	p := &progress{out: os.Stdout}
+	if c, err := console.ConsoleFromFile(os.Stdout); err == nil {
+		p.console = c
+		p.stop = make(chan struct{})
+		p.done = make(chan struct{})
+		go p.redraw()
+	}
+	return p
+}
+
+// redraw keeps the status line current while nothing else changes, so the
+// elapsed time and rate don't stall.
+func (p *progress) redraw() {
+	defer close(p.done)
+	ticker := time.NewTicker(200 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+			p.mu.Lock()
+			p.draw()
+			p.mu.Unlock()
+		}
+	}
+}
+
+// setPhase moves on to the next phase of the update.
+func (p *progress) setPhase(phase string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if phase == p.phase {
+		return
+	}
+	p.endPhase()
+	p.phase = phase
+	p.phaseStart = time.Now()
+	if p.console == nil {
+		fmt.Fprintf(p.out, "%s...\n", capitalize(phase))
+		return
+	}
+	p.draw()
+}
+
+// setTotal sets the number of bytes of the delta that will be received.
+func (p *progress) setTotal(n int64) {
+	p.mu.Lock()
+	p.total = n
+	p.mu.Unlock()
+}
+
+// add counts n more bytes of the delta as received.
+func (p *progress) add(n int) {
+	p.mu.Lock()
+	p.received += int64(n)
+	p.mu.Unlock()
+}
+
+// printf prints a line of output without it running into the status line.
+func (p *progress) printf(format string, args ...interface{}) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.console != nil {
+		fmt.Fprint(p.out, "\r\x1b[2K")
+	}
+	fmt.Fprintf(p.out, format, args...)
+	if p.console != nil {
+		p.draw()
+	}
+}
+
+// finish ends the last phase and clears the status line. It is safe to
+// call more than once.
+func (p *progress) finish() {
+	p.mu.Lock()
+	p.endPhase()
+	p.phase = ""
+	p.mu.Unlock()
+
+	if p.console != nil {
+		select {
+		case <-p.stop:
+		default:
+			close(p.stop)
+		}
+		<-p.done
+		fmt.Fprint(p.out, "\r\x1b[2K")
+	}
+}
+
+// endPhase prints a summary of the delta once it has been received.
+func (p *progress) endPhase() {
+	if p.phase != phaseReceiving {
+		return
+	}
+	elapsed := time.Since(p.phaseStart)
+	if p.console != nil {
+		fmt.Fprint(p.out, "\r\x1b[2K")
+	}
+	fmt.Fprintf(p.out, "Received %v in %v (%v)\n",
+		units.Bytes(p.received), elapsed.Round(time.Millisecond), units.NewBytesPerSecond(p.received, elapsed))
+}
+
+// draw writes the status line. p.mu must be held.
+func (p *progress) draw() {
+	if p.phase == "" {
+		return
+	}
+	elapsed := time.Since(p.phaseStart)
+	line := fmt.Sprintf("%s  %v", capitalize(p.phase), elapsed.Round(time.Second))
+	if p.phase == phaseReceiving {
+		rate := units.NewBytesPerSecond(p.received, elapsed)
+		line = fmt.Sprintf("%s  %v", capitalize(p.phase), units.Bytes(p.received))
+		if p.total > 0 {
+			line += fmt.Sprintf(" / %v (%d%%)", units.Bytes(p.total), p.received*100/p.total)
+		}
+		line += fmt.Sprintf("  %v", rate)
+		if p.total > p.received && rate > 0 {
+			eta := time.Duration(float64(p.total-p.received) / float64(rate) * float64(time.Second))
+			line += fmt.Sprintf("  ETA %v", eta.Round(time.Second))
+		}
+	}
+	if size, err := p.console.Size(); err == nil && size.Width > 0 && len(line) >= int(size.Width) {
+		line = line[:size.Width-1]
+	}
+	fmt.Fprint(p.out, "\r\x1b[2K"+line)
+}
+
+func capitalize(s string) string {
+	return strings.ToUpper(s[:1]) + s[1:]
+}
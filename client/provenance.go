@@ -0,0 +1,91 @@
+package main
+
+import (
+	"time"
+
+	digest "github.com/opencontainers/go-digest"
+)
+
+// Labels recording where a reconstructed image came from. They are put on
+// the containerd image and, for squashed OCI images, on the manifest.
+const (
+	labelUpstreamDigest   = "cargosync.io/upstream.digest"
+	labelUpstreamManifest = "cargosync.io/upstream.manifest"
+	labelBaseName         = "cargosync.io/base.name"
+	labelBaseDigest       = "cargosync.io/base.digest"
+	labelDeltaDigest      = "cargosync.io/delta.digest"
+	labelServer           = "cargosync.io/server"
+	labelReconstructed    = "cargosync.io/reconstructed"
+	labelMode             = "cargosync.io/mode"
+)
+
+// provenanceLabels are all the provenance label keys.
+var provenanceLabels = []string{
+	labelUpstreamDigest,
+	labelUpstreamManifest,
+	labelBaseName,
+	labelBaseDigest,
+	labelDeltaDigest,
+	labelServer,
+	labelReconstructed,
+	labelMode,
+}
+
+// How the image was reconstructed.
+const (
+	modeExact    = "exact"
+	modeSquashed = "squashed"
+)
+
+// provenance is the lineage of a reconstructed image.
+type provenance struct {
+	// digest the target reference resolved to upstream, usually an index
+	Upstream digest.Digest `json:"upstream"`
+	// digest of the upstream manifest for our platform
+	UpstreamManifest digest.Digest `json:"upstreamManifest"`
+	Base             string        `json:"base"`
+	BaseDigest       digest.Digest `json:"baseDigest"`
+	Delta            digest.Digest `json:"delta"`
+	// server the delta came from, or the bundle it was read from
+	Server        string    `json:"server"`
+	Reconstructed time.Time `json:"reconstructed"`
+	Mode          string    `json:"mode"`
+}
+
+func (p provenance) labels() map[string]string {
+	labels := map[string]string{
+		labelUpstreamDigest:   p.Upstream.String(),
+		labelUpstreamManifest: p.UpstreamManifest.String(),
+		labelBaseName:         p.Base,
+		labelBaseDigest:       p.BaseDigest.String(),
+		labelDeltaDigest:      p.Delta.String(),
+		labelServer:           p.Server,
+		labelReconstructed:    p.Reconstructed.Format(time.RFC3339),
+		labelMode:             p.Mode,
+	}
+	for k, v := range labels {
+		if v == "" {
+			delete(labels, k)
+		}
+	}
+	return labels
+}
+
+// provenanceFromLabels reads the lineage back from image labels, or returns
+// nil if the image wasn't reconstructed by us.
+func provenanceFromLabels(labels map[string]string) *provenance {
+	if labels[labelUpstreamManifest] == "" {
+		return nil
+	}
+	p := &provenance{
+		Upstream:         digest.Digest(labels[labelUpstreamDigest]),
+		UpstreamManifest: digest.Digest(labels[labelUpstreamManifest]),
+		Base:             labels[labelBaseName],
+		BaseDigest:       digest.Digest(labels[labelBaseDigest]),
+		Delta:            digest.Digest(labels[labelDeltaDigest]),
+		Server:           labels[labelServer],
+		Mode:             labels[labelMode],
+	}
+	p.Reconstructed, _ = time.Parse(time.RFC3339, labels[labelReconstructed])
+	return p
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"context"
+	"deltadiff/registry"
+
+	"github.com/containerd/containerd/remotes"
+	"github.com/containerd/containerd/remotes/docker"
+	"github.com/urfave/cli"
+)
+
+// registryFlags set how the client reaches registries itself, the same way
+// as the server's flags of the same names.
+var registryFlags = []cli.Flag{
+	cli.StringFlag{
+		Name:   "registry-hosts-dir",
+		Usage:  "directory of containerd hosts.toml files setting the mirrors, CAs and plain-HTTP use of each registry",
+		Value:  "/etc/containerd/certs.d",
+		EnvVar: "CARGOSYNC_REGISTRY_HOSTS_DIR",
+	},
+	cli.StringFlag{
+		Name:   "registry-config",
+		Usage:  "directory of the docker config.json holding registry credentials or naming credential helpers (default: ~/.docker)",
+		EnvVar: "DOCKER_CONFIG",
+	},
+}
+
+// registryResolver returns a resolver for the registries configured by the
+// registry flags of c.
+func registryResolver(ctx context.Context, c *cli.Context) (remotes.Resolver, error) {
+	hosts, err := registry.Hosts(ctx, c.String("registry-hosts-dir"), c.String("registry-config"))
+	if err != nil {
+		return nil, err
+	}
+	return docker.NewResolver(docker.ResolverOptions{Hosts: hosts}), nil
+}
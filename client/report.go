@@ -0,0 +1,260 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/containerd/containerd/log"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/urfave/cli"
+)
+
+var reportFlag = cli.StringFlag{
+	Name:  "report",
+	Usage: "write a machine-readable report of the update to this file, whether it succeeds or not",
+}
+
+var reportFormatFlag = cli.StringFlag{
+	Name:  "report-format",
+	Usage: "format of --report: json, or prometheus for node_exporter's textfile collector",
+	Value: "json",
+}
+
+// updateReport is the outcome of an update, written to --report for fleet
+// tooling to collect.
+type updateReport struct {
+	Command  string    `json:"command"`
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished"`
+	// success or failure
+	Outcome string `json:"outcome"`
+	Error   string `json:"error,omitempty"`
+
+	Base       string        `json:"base"`
+	BaseDigest digest.Digest `json:"baseDigest,omitempty"`
+	Target     string        `json:"target"`
+	// digest of the stored image
+	TargetDigest digest.Digest `json:"targetDigest,omitempty"`
+	// digest the target reference resolved to upstream
+	UpstreamDigest digest.Digest `json:"upstreamDigest,omitempty"`
+	Mode           string        `json:"mode,omitempty"`
+	// why a squashed layer was stored although --exact was given
+	Fallback string `json:"fallback,omitempty"`
+
+	// size of the compressed delta
+	DeltaBytes int64 `json:"deltaBytes"`
+	// everything received from the server: the delta, unless it was
+	// fetched beforehand, and the manifest, config, index and layer
+	// metadata
+	ReceivedBytes    int64   `json:"receivedBytes"`
+	ImageBytes       int64   `json:"imageBytes,omitempty"`
+	CompressionRatio float64 `json:"compressionRatio,omitempty"`
+
+	// seconds spent in each phase that ran: fetch, decompress, apply,
+	// layer, image and unpack
+	Phases  map[string]float64 `json:"phases"`
+	Seconds float64            `json:"seconds"`
+
+	// CPU time and peak memory of the client, and of the rsync and zstd
+	// processes it ran
+	Resources struct {
+		UserSeconds        float64 `json:"userSeconds"`
+		SystemSeconds      float64 `json:"systemSeconds"`
+		MaxRSSBytes        int64   `json:"maxRSSBytes"`
+		ChildUserSeconds   float64 `json:"childUserSeconds"`
+		ChildSystemSeconds float64 `json:"childSystemSeconds"`
+		ChildMaxRSSBytes   int64   `json:"childMaxRSSBytes"`
+	} `json:"resources"`
+
+	path, format string
+}
+
+// newReport starts the report of an update command.
+func newReport(c *cli.Context) (*updateReport, error) {
+	switch c.String("report-format") {
+	case "json", "prometheus":
+	default:
+		return nil, fmt.Errorf("invalid --report-format %q: use json or prometheus", c.String("report-format"))
+	}
+	return &updateReport{
+		Command: c.Command.Name,
+		Started: time.Now().UTC(),
+		Phases:  map[string]float64{},
+		path:    c.String("report"),
+		format:  c.String("report-format"),
+	}, nil
+}
+
+// phase records how long a phase of the update took.
+func (r *updateReport) phase(name string, d time.Duration) {
+	r.Phases[name] = d.Seconds()
+}
+
+// applied records the result of applyDelta.
+func (r *updateReport) applied(res applyResult) {
+	r.phase("apply", res.applyDelta)
+	r.phase("layer", res.createLayer)
+	r.phase("image", res.createImage)
+	r.phase("unpack", res.unpack)
+	r.BaseDigest = res.prov.BaseDigest
+	r.UpstreamDigest = res.prov.Upstream
+	r.Mode = res.prov.Mode
+	if r.Fallback == "" {
+		r.Fallback = res.fallback
+	}
+}
+
+// deltaFile records the size of the compressed delta at path.
+func (r *updateReport) deltaFile(path string) {
+	if info, err := os.Stat(path); err == nil {
+		r.DeltaBytes = info.Size()
+	}
+}
+
+// finish completes the report with the outcome of the update and writes
+// it, if --report was given. It returns updateErr, or the error writing
+// the report if the update itself succeeded.
+func (r *updateReport) finish(updateErr error) error {
+	if r.path == "" {
+		return updateErr
+	}
+
+	r.Finished = time.Now().UTC()
+	r.Seconds = r.Finished.Sub(r.Started).Seconds()
+	r.Outcome = "success"
+	if updateErr != nil {
+		r.Outcome = "failure"
+		r.Error = updateErr.Error()
+	}
+	if r.DeltaBytes > 0 && r.ImageBytes > 0 {
+		r.CompressionRatio = float64(r.ImageBytes) / float64(r.DeltaBytes)
+	}
+	r.usage()
+
+	var err error
+	if r.format == "prometheus" {
+		err = r.writeTextfile()
+	} else {
+		err = r.writeJSON()
+	}
+	if err != nil {
+		err = fmt.Errorf("error writing report to %s: %w", r.path, err)
+		if updateErr != nil {
+			log.L.WithError(err).Warn("cannot write the report of the failed update")
+			return updateErr
+		}
+		return err
+	}
+	return updateErr
+}
+
+// usage records the resources used by the client and its children so far.
+func (r *updateReport) usage() {
+	var self, children syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &self); err == nil {
+		r.Resources.UserSeconds = seconds(self.Utime)
+		r.Resources.SystemSeconds = seconds(self.Stime)
+		// Linux reports the maximum resident set size in KiB
+		r.Resources.MaxRSSBytes = self.Maxrss * 1024
+	}
+	if err := syscall.Getrusage(syscall.RUSAGE_CHILDREN, &children); err == nil {
+		r.Resources.ChildUserSeconds = seconds(children.Utime)
+		r.Resources.ChildSystemSeconds = seconds(children.Stime)
+		r.Resources.ChildMaxRSSBytes = children.Maxrss * 1024
+	}
+}
+
+func seconds(tv syscall.Timeval) float64 {
+	return time.Duration(tv.Nano()).Seconds()
+}
+
+func (r *updateReport) writeJSON() error {
+	b, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	// Write to a temporary file first, so a collector never reads a
+	// partial report.
+	f, err := os.CreateTemp(filepath.Dir(r.path), filepath.Base(r.path)+".part-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(append(b, '\n'))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(f.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), r.path)
+}
+
+// writeTextfile writes the report as Prometheus metrics. The references,
+// digests and mode are labels of cargosync_update_info; the other metrics
+// have no labels besides the phase or process, so series stay bounded.
+func (r *updateReport) writeTextfile() error {
+	reg := prometheus.NewRegistry()
+	gauge := func(name, help string, labels []string) *prometheus.GaugeVec {
+		g := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "cargosync",
+			Subsystem: "update",
+			Name:      name,
+			Help:      help,
+		}, labels)
+		reg.MustRegister(g)
+		return g
+	}
+	boolValue := func(b bool) float64 {
+		if b {
+			return 1
+		}
+		return 0
+	}
+
+	gauge("info", "Images of the last update.",
+		[]string{"command", "base", "base_digest", "target", "target_digest", "upstream_digest", "mode"}).
+		WithLabelValues(r.Command, r.Base, r.BaseDigest.String(), r.Target, r.TargetDigest.String(), r.UpstreamDigest.String(), r.Mode).
+		Set(1)
+	gauge("success", "Whether the last update succeeded.", nil).
+		WithLabelValues().Set(boolValue(r.Outcome == "success"))
+	gauge("fallback", "Whether the last update stored a squashed layer although --exact was given.", nil).
+		WithLabelValues().Set(boolValue(r.Fallback != ""))
+	gauge("finished_timestamp_seconds", "When the last update finished.", nil).
+		WithLabelValues().Set(float64(r.Finished.UnixNano()) / 1e9)
+	gauge("duration_seconds", "Time the last update took.", nil).
+		WithLabelValues().Set(r.Seconds)
+	phases := gauge("phase_duration_seconds", "Time spent in each phase of the last update.", []string{"phase"})
+	for name, s := range r.Phases {
+		phases.WithLabelValues(name).Set(s)
+	}
+	gauge("delta_bytes", "Size of the compressed delta of the last update.", nil).
+		WithLabelValues().Set(float64(r.DeltaBytes))
+	gauge("received_bytes", "Bytes received from the server by the last update, the delta and image metadata included.", nil).
+		WithLabelValues().Set(float64(r.ReceivedBytes))
+	gauge("image_bytes", "Size of the image reconstructed by the last update.", nil).
+		WithLabelValues().Set(float64(r.ImageBytes))
+	gauge("compression_ratio", "Size of the image divided by the size of its compressed delta.", nil).
+		WithLabelValues().Set(r.CompressionRatio)
+	cpu := gauge("cpu_seconds", "CPU time used by the last update.", []string{"process", "mode"})
+	cpu.WithLabelValues("client", "user").Set(r.Resources.UserSeconds)
+	cpu.WithLabelValues("client", "system").Set(r.Resources.SystemSeconds)
+	cpu.WithLabelValues("children", "user").Set(r.Resources.ChildUserSeconds)
+	cpu.WithLabelValues("children", "system").Set(r.Resources.ChildSystemSeconds)
+	rss := gauge("max_rss_bytes", "Peak resident memory of the last update.", []string{"process"})
+	rss.WithLabelValues("client").Set(float64(r.Resources.MaxRSSBytes))
+	rss.WithLabelValues("children").Set(float64(r.Resources.ChildMaxRSSBytes))
+
+	if err := prometheus.WriteToTextfile(r.path, reg); err != nil {
+		return err
+	}
+	return os.Chmod(r.path, 0644)
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/snapshots"
+)
+
+const (
+	// Label put on every snapshot the client creates, holding the run ID.
+	runLabel = "cargosync.io/run"
+	// Prefix of the per-run working directories in --tmp-dir.
+	runDirPrefix = "cargosync-run-"
+)
+
+// run holds the per-invocation state that keeps concurrent updates, for
+// example from a cron job and an operator, from touching each other's
+// snapshots and files.
+type run struct {
+	id string
+	// private working directory for downloaded and decompressed deltas
+	dir string
+}
+
+func newRun(tmpDir string) (*run, error) {
+	b := make([]byte, 6)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	id := fmt.Sprintf("%d-%s", time.Now().Unix(), hex.EncodeToString(b))
+
+	dir, err := os.MkdirTemp(tmpDir, runDirPrefix+id+"-")
+	if err != nil {
+		return nil, fmt.Errorf("error creating working directory in %s: %w", tmpDir, err)
+	}
+	return &run{id: id, dir: dir}, nil
+}
+
+// path returns the path of a file in the run's working directory.
+func (r *run) path(name string) string {
+	return filepath.Join(r.dir, name)
+}
+
+// snapshotKey returns a snapshot key unique to this run.
+func (r *run) snapshotKey(name string) string {
+	return fmt.Sprintf("cargosync-%s-%s", name, r.id)
+}
+
+// snapshotOpts labels a snapshot so that gc can tell it was made by us.
+func (r *run) snapshotOpts() snapshots.Opt {
+	return snapshots.WithLabels(map[string]string{runLabel: r.id})
+}
+
+// close removes the run's working directory.
+func (r *run) close() error {
+	return os.RemoveAll(r.dir)
+}
+
+// removeStale removes snapshots and working directories left behind by
+// runs that started more than olderThan ago. Only artifacts carrying our
+// labels or prefix are considered, so other users of the snapshotter and
+// temp dir are left alone, and runs still in progress are not disturbed.
+func removeStale(ctx context.Context, client *containerd.Client, snapshotterName, tmpDir string, olderThan time.Duration) error {
+	cutoff := time.Now().Add(-olderThan)
+
+	snapshotter := client.SnapshotService(snapshotterName)
+	var stale []string
+	if err := snapshotter.Walk(ctx, func(ctx context.Context, info snapshots.Info) error {
+		if info.Created.Before(cutoff) {
+			stale = append(stale, info.Name)
+		}
+		return nil
+	}, fmt.Sprintf("labels.%q", runLabel)); err != nil {
+		return fmt.Errorf("error listing snapshots: %w", err)
+	}
+	for _, key := range stale {
+		if err := snapshotter.Remove(ctx, key); err != nil && !errdefs.IsNotFound(err) {
+			return fmt.Errorf("error removing snapshot %s: %w", key, err)
+		}
+		log.G(ctx).WithField("snapshot", key).Info("removed stale snapshot")
+	}
+
+	entries, err := os.ReadDir(tmpDir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() || !strings.HasPrefix(entry.Name(), runDirPrefix) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return err
+		}
+		if info.ModTime().After(cutoff) {
+			continue
+		}
+		path := filepath.Join(tmpDir, entry.Name())
+		if err := os.RemoveAll(path); err != nil {
+			return fmt.Errorf("error removing working directory: %w", err)
+		}
+		log.G(ctx).WithField("dir", path).Info("removed stale working directory")
+	}
+	return nil
+}
@@ -0,0 +1,418 @@
+package layermeta
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"deltadiff/manifest"
+	"encoding/json"
+	"fmt"
+	"hash/crc64"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/containerd/containerd/archive/compression"
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/images"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/vbatts/tar-split/tar/asm"
+	"github.com/vbatts/tar-split/tar/storage"
+)
+
+// Levels tried to reproduce a gzip stream, most common first.
+var gzipLevels = []int{gzip.DefaultCompression, 1, 2, 3, 4, 5, 7, 8, 9}
+
+// Generate Write the metadata archive for the layers of m to w, using workDir
+// for temporary files. Layers that can't be regenerated exactly, because of
+// their compression or duplicate entries, are marked as such rather than
+// failing the whole archive.
+func Generate(ctx context.Context, provider content.Provider, m *manifest.ImageManifest, workDir string, w io.Writer) error {
+	dir, err := os.MkdirTemp(workDir, "layermeta-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	for _, sub := range []string{tarSplitDir, payloadDir} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0755); err != nil {
+			return err
+		}
+	}
+
+	layers := m.Layers()
+
+	// A file needs its payload shipped if any later layer changes or
+	// removes it, so first collect what every layer touches.
+	later := make([]*layerPaths, len(layers))
+	touched := newLayerPaths()
+	for i := len(layers) - 1; i >= 0; i-- {
+		later[i] = touched.clone()
+		if err := touched.addLayer(ctx, provider, layers[i]); err != nil {
+			return fmt.Errorf("error reading layer %s: %w", layers[i].Digest, err)
+		}
+	}
+
+	idx := Index{
+		Version:  Version,
+		Manifest: m.Descriptor().Digest,
+	}
+	for i, desc := range layers {
+		l := Layer{
+			Digest:    desc.Digest,
+			MediaType: desc.MediaType,
+		}
+		if err := describeLayer(ctx, provider, desc, &l, dir, tarSplitPath(dir, i), later[i]); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			l.Unsupported = err.Error()
+			l.Gzip = nil
+			l.Payloads = nil
+			os.Remove(tarSplitPath(dir, i))
+		}
+		idx.Layers = append(idx.Layers, l)
+	}
+
+	p, err := json.Marshal(idx)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(dir, indexFile), p, 0644); err != nil {
+		return err
+	}
+	return writeArchive(dir, &idx, w)
+}
+
+// describeLayer Record the compression and tar-split metadata of desc in l.
+func describeLayer(ctx context.Context, provider content.Provider, desc ocispec.Descriptor, l *Layer, dir, tarSplit string, later *layerPaths) error {
+	c, err := images.DiffCompression(ctx, desc.MediaType)
+	if err != nil {
+		return err
+	}
+	switch c {
+	case "":
+	case "gzip":
+		if l.Gzip, err = gzipParams(ctx, provider, desc); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("%s compression is not reproducible", c)
+	}
+
+	f, err := os.Create(tarSplit)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	zw := gzip.NewWriter(f)
+
+	rc, err := openLayer(ctx, provider, desc)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	putter := &payloadPutter{dir: dir, later: later}
+	tarStream, err := asm.NewInputTarStream(rc, storage.NewJSONPacker(zw), putter)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(io.Discard, tarStream); err != nil {
+		return err
+	}
+	if len(putter.payloads) > 0 {
+		l.Payloads = putter.payloads
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// openLayer Open the uncompressed tar stream of a layer.
+func openLayer(ctx context.Context, provider content.Provider, desc ocispec.Descriptor) (io.ReadCloser, error) {
+	ra, err := provider.ReaderAt(ctx, desc)
+	if err != nil {
+		return nil, err
+	}
+	ds, err := compression.DecompressStream(content.NewReader(ra))
+	if err != nil {
+		ra.Close()
+		return nil, err
+	}
+	return readClosers{ds, ra}, nil
+}
+
+type readClosers struct {
+	compression.DecompressReadCloser
+	ra content.ReaderAt
+}
+
+func (r readClosers) Close() error {
+	r.DecompressReadCloser.Close()
+	return r.ra.Close()
+}
+
+// gzipParams Find the compress/gzip settings that reproduce the blob desc
+// byte for byte.
+func gzipParams(ctx context.Context, provider content.Provider, desc ocispec.Descriptor) (*GzipParams, error) {
+	ra, err := provider.ReaderAt(ctx, desc)
+	if err != nil {
+		return nil, err
+	}
+	defer ra.Close()
+
+	blob := content.NewReader(ra)
+	zr, err := gzip.NewReader(blob)
+	if err != nil {
+		return nil, err
+	}
+	zr.Multistream(false)
+	hdr := zr.Header
+	if _, err := io.Copy(io.Discard, zr); err != nil {
+		return nil, err
+	}
+	if n, _ := io.Copy(io.Discard, blob); n > 0 {
+		return nil, fmt.Errorf("gzip stream has more than one member")
+	}
+
+	params := &GzipParams{
+		Name:    hdr.Name,
+		Comment: hdr.Comment,
+		ModTime: hdr.ModTime,
+		OS:      hdr.OS,
+		Extra:   hdr.Extra,
+	}
+	for _, level := range gzipLevels {
+		params.Level = level
+		dgst, err := recompress(ctx, provider, desc, params)
+		if err != nil {
+			return nil, err
+		}
+		if dgst == desc.Digest {
+			return params, nil
+		}
+	}
+	return nil, fmt.Errorf("gzip stream was not written by compress/gzip")
+}
+
+func recompress(ctx context.Context, provider content.Provider, desc ocispec.Descriptor, params *GzipParams) (digest.Digest, error) {
+	rc, err := openLayer(ctx, provider, desc)
+	if err != nil {
+		return "", err
+	}
+	defer rc.Close()
+
+	h := sha256.New()
+	zw, err := params.newWriter(h)
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(zw, rc); err != nil {
+		return "", err
+	}
+	if err := zw.Close(); err != nil {
+		return "", err
+	}
+	return digest.NewDigest(digest.SHA256, h), nil
+}
+
+// payloadPutter Computes the checksums tar-split records, and keeps the
+// contents of files that won't be in the final filesystem.
+type payloadPutter struct {
+	dir      string
+	later    *layerPaths
+	payloads map[string]digest.Digest
+}
+
+func (p *payloadPutter) Put(name string, r io.Reader) (int64, []byte, error) {
+	crc := crc64.New(storage.CRCTable)
+	if !p.later.shadows(name) {
+		n, err := io.Copy(crc, r)
+		return n, crc.Sum(nil), err
+	}
+
+	f, err := os.CreateTemp(filepath.Join(p.dir, payloadDir), "tmp-")
+	if err != nil {
+		return 0, nil, err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	digester := digest.SHA256.Digester()
+	n, err := io.Copy(io.MultiWriter(f, crc, digester.Hash()), r)
+	if err != nil {
+		return 0, nil, err
+	}
+	if err := f.Close(); err != nil {
+		return 0, nil, err
+	}
+	dgst := digester.Digest()
+	if err := os.Rename(f.Name(), payloadPath(p.dir, dgst)); err != nil {
+		return 0, nil, err
+	}
+	if p.payloads == nil {
+		p.payloads = map[string]digest.Digest{}
+	}
+	p.payloads[name] = dgst
+	return n, crc.Sum(nil), nil
+}
+
+// layerPaths What a set of layers does to the paths of the layers below.
+type layerPaths struct {
+	// paths with an entry
+	entries map[string]bool
+	// paths whose entry is not a directory
+	nonDirs map[string]bool
+	// paths removed with a whiteout
+	whiteouts map[string]bool
+	// directories whose lower contents are hidden
+	opaque map[string]bool
+}
+
+func newLayerPaths() *layerPaths {
+	return &layerPaths{
+		entries:   map[string]bool{},
+		nonDirs:   map[string]bool{},
+		whiteouts: map[string]bool{},
+		opaque:    map[string]bool{},
+	}
+}
+
+func (p *layerPaths) clone() *layerPaths {
+	c := newLayerPaths()
+	for _, pair := range [][2]map[string]bool{
+		{c.entries, p.entries},
+		{c.nonDirs, p.nonDirs},
+		{c.whiteouts, p.whiteouts},
+		{c.opaque, p.opaque},
+	} {
+		for k := range pair[1] {
+			pair[0][k] = true
+		}
+	}
+	return c
+}
+
+func (p *layerPaths) addLayer(ctx context.Context, provider content.Provider, desc ocispec.Descriptor) error {
+	rc, err := openLayer(ctx, provider, desc)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	tr := tar.NewReader(rc)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		p.add(hdr)
+	}
+}
+
+func (p *layerPaths) add(hdr *tar.Header) {
+	name := cleanPath(hdr.Name)
+	dir, base := path.Split(name)
+	dir = cleanPath(dir)
+	switch {
+	case base == ".wh..wh..opq":
+		p.opaque[dir] = true
+	case strings.HasPrefix(base, ".wh."):
+		p.whiteouts[cleanPath(path.Join(dir, strings.TrimPrefix(base, ".wh.")))] = true
+	default:
+		p.entries[name] = true
+		if hdr.Typeflag != tar.TypeDir {
+			p.nonDirs[name] = true
+		}
+	}
+}
+
+// shadows Whether the layers change or remove the file name of a lower layer.
+func (p *layerPaths) shadows(name string) bool {
+	name = cleanPath(name)
+	if p.entries[name] || p.whiteouts[name] || p.opaque["."] {
+		return true
+	}
+	for dir := path.Dir(name); dir != "."; dir = path.Dir(dir) {
+		if p.whiteouts[dir] || p.opaque[dir] || p.nonDirs[dir] {
+			return true
+		}
+	}
+	return false
+}
+
+// cleanPath Normalize a tar entry name to a relative path, "." for the root.
+func cleanPath(name string) string {
+	name = strings.TrimPrefix(path.Clean("/"+name), "/")
+	if name == "" {
+		return "."
+	}
+	return name
+}
+
+// writeArchive Write the files of dir that idx references as a metadata
+// archive. Payloads stored for a layer that turned out to be unsupported
+// are left out, so are files a failed layer left behind.
+func writeArchive(dir string, idx *Index, w io.Writer) error {
+	names := []string{indexFile}
+	payloads := map[digest.Digest]bool{}
+	for i, l := range idx.Layers {
+		if l.Unsupported != "" {
+			continue
+		}
+		names = append(names, path.Join(tarSplitDir, strconv.Itoa(i)+".json.gz"))
+		for _, dgst := range l.Payloads {
+			payloads[dgst] = true
+		}
+	}
+	for _, dgst := range sortedDigests(payloads) {
+		names = append(names, path.Join(payloadDir, dgst.Encoded()))
+	}
+
+	tw := tar.NewWriter(w)
+	for _, name := range names {
+		if err := writeArchiveFile(tw, dir, name); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+func writeArchiveFile(tw *tar.Writer, dir, name string) error {
+	f, err := os.Open(filepath.Join(dir, filepath.FromSlash(name)))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if err := tw.WriteHeader(&tar.Header{
+		Name: name,
+		Mode: 0644,
+		Size: info.Size(),
+	}); err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, f)
+	return err
+}
+
+func sortedDigests(set map[digest.Digest]bool) []digest.Digest {
+	digests := make([]digest.Digest, 0, len(set))
+	for dgst := range set {
+		digests = append(digests, dgst)
+	}
+	sort.Slice(digests, func(i, j int) bool { return digests[i] < digests[j] })
+	return digests
+}
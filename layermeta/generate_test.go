@@ -0,0 +1,203 @@
+package layermeta
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"deltadiff/manifest"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/errdefs"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// memoryProvider serves blobs from memory. The blob named in failing can
+// only be read once in full; later reads fail at offset failAt, the way a
+// layer that can't be described fails partway through.
+type memoryProvider struct {
+	blobs   map[digest.Digest][]byte
+	failing digest.Digest
+	failAt  int64
+	opened  int
+}
+
+func (p *memoryProvider) ReaderAt(ctx context.Context, desc ocispec.Descriptor) (content.ReaderAt, error) {
+	b, ok := p.blobs[desc.Digest]
+	if !ok {
+		return nil, errdefs.ErrNotFound
+	}
+	r := &memoryReaderAt{Reader: bytes.NewReader(b), failAt: -1}
+	if desc.Digest == p.failing {
+		if p.opened > 0 {
+			r.failAt = p.failAt
+		}
+		p.opened++
+	}
+	return r, nil
+}
+
+type memoryReaderAt struct {
+	*bytes.Reader
+	failAt int64
+}
+
+func (r *memoryReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if r.failAt >= 0 && off+int64(len(p)) > r.failAt {
+		if off >= r.failAt {
+			return 0, errors.New("read failed")
+		}
+		n, _ := r.Reader.ReadAt(p[:r.failAt-off], off)
+		return n, errors.New("read failed")
+	}
+	return r.Reader.ReadAt(p, off)
+}
+
+func (r *memoryReaderAt) Close() error {
+	return nil
+}
+
+type tarFile struct {
+	name, content string
+}
+
+func tarLayer(t *testing.T, files ...tarFile) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, f := range files {
+		if err := tw.WriteHeader(&tar.Header{Name: f.name, Mode: 0644, Size: int64(len(f.content)), Typeflag: tar.TypeReg}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(f.content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// testManifest returns a manifest for layers, and a provider serving them.
+func testManifest(t *testing.T, layers ...[]byte) (*manifest.ImageManifest, *memoryProvider) {
+	t.Helper()
+	provider := &memoryProvider{blobs: map[digest.Digest][]byte{}}
+	config := []byte("{}")
+	m := ocispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    ocispec.Descriptor{MediaType: ocispec.MediaTypeImageConfig, Digest: digest.FromBytes(config), Size: int64(len(config))},
+	}
+	for _, layer := range layers {
+		desc := ocispec.Descriptor{MediaType: ocispec.MediaTypeImageLayer, Digest: digest.FromBytes(layer), Size: int64(len(layer))}
+		provider.blobs[desc.Digest] = layer
+		m.Layers = append(m.Layers, desc)
+	}
+	p, err := json.Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	im, err := manifest.ParseManifest(ocispec.Descriptor{MediaType: ocispec.MediaTypeImageManifest, Digest: digest.FromBytes(p), Size: int64(len(p))}, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return im, provider
+}
+
+func TestGenerateUnsupportedLayer(t *testing.T) {
+	shadowed := strings.Repeat("a", 1000)
+	// The bottom layer has a file the top layer replaces, so its payload
+	// is stored while the bottom layer is described.
+	bottom := tarLayer(t, tarFile{"a", shadowed}, tarFile{"b", strings.Repeat("b", 1000)})
+	top := tarLayer(t, tarFile{"a", "replaced"})
+
+	tests := []struct {
+		name   string
+		failAt int64
+	}{
+		// a's header is the first 512 bytes, its content the next 1000
+		{"while storing the payload", 600},
+		{"after storing the payload", 2100},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, provider := testManifest(t, bottom, top)
+			provider.failing = m.Layers()[0].Digest
+			provider.failAt = tt.failAt
+
+			var archive bytes.Buffer
+			if err := Generate(context.Background(), provider, m, t.TempDir(), &archive); err != nil {
+				t.Fatal(err)
+			}
+
+			dir := t.TempDir()
+			idx, err := Extract(&archive, dir)
+			if err != nil {
+				t.Fatalf("Extract() = %v, want the archive of the other layers", err)
+			}
+			if len(idx.Layers) != 2 {
+				t.Fatalf("index has %d layers, want 2", len(idx.Layers))
+			}
+			if idx.Layers[0].Unsupported == "" || idx.Layers[0].Payloads != nil {
+				t.Errorf("bottom layer = %+v, want it unsupported without payloads", idx.Layers[0])
+			}
+			if idx.Layers[1].Unsupported != "" {
+				t.Errorf("top layer is unsupported: %s", idx.Layers[1].Unsupported)
+			}
+
+			for _, sub := range []string{payloadDir, tarSplitDir} {
+				entries, err := os.ReadDir(filepath.Join(dir, sub))
+				if err != nil {
+					t.Fatal(err)
+				}
+				var names []string
+				for _, e := range entries {
+					names = append(names, e.Name())
+				}
+				want := map[string][]string{payloadDir: nil, tarSplitDir: {"1.json.gz"}}[sub]
+				if strings.Join(names, ",") != strings.Join(want, ",") {
+					t.Errorf("%s = %v, want %v", sub, names, want)
+				}
+			}
+		})
+	}
+}
+
+func TestGeneratePayloads(t *testing.T) {
+	shadowed := strings.Repeat("a", 1000)
+	m, provider := testManifest(t,
+		tarLayer(t, tarFile{"a", shadowed}, tarFile{"b", "kept"}),
+		tarLayer(t, tarFile{"a", "replaced"}))
+
+	var archive bytes.Buffer
+	if err := Generate(context.Background(), provider, m, t.TempDir(), &archive); err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	idx, err := Extract(&archive, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := idx.Reproducible(); err != nil {
+		t.Fatal(err)
+	}
+	want := digest.FromString(shadowed)
+	if got := idx.Layers[0].Payloads["a"]; got != want {
+		t.Fatalf("payload of a = %s, want %s", got, want)
+	}
+	p, err := os.ReadFile(payloadPath(dir, want))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(p) != shadowed {
+		t.Errorf("payload of a = %q", p)
+	}
+}
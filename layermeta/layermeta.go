@@ -0,0 +1,167 @@
+// Package layermeta carries what is needed to regenerate the original layer
+// blobs of an image from its extracted filesystem: the tar-split metadata of
+// every layer, which holds the raw headers, padding and entry order, the
+// parameters of its gzip stream, and the contents of files that the final
+// filesystem doesn't have because a later layer changed or removed them.
+//
+// The metadata travels as an uncompressed tar archive, see Generate and
+// Extract.
+package layermeta
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"time"
+
+	digest "github.com/opencontainers/go-digest"
+)
+
+// Version The version of the archive format.
+const Version = 1
+
+const (
+	indexFile   = "layers.json"
+	tarSplitDir = "tar-split"
+	payloadDir  = "payloads"
+)
+
+var (
+	tarSplitName = regexp.MustCompile(`^` + tarSplitDir + `/([0-9]+)\.json\.gz$`)
+	payloadName  = regexp.MustCompile(`^` + payloadDir + `/([a-f0-9]{64})$`)
+)
+
+// Index Describes how to regenerate the layers of one manifest.
+type Index struct {
+	Version  int           `json:"version"`
+	Manifest digest.Digest `json:"manifest"`
+	Layers   []Layer       `json:"layers"`
+}
+
+// Layer How to regenerate one layer blob.
+type Layer struct {
+	Digest    digest.Digest `json:"digest"`
+	MediaType string        `json:"mediaType"`
+	// Why the layer can't be regenerated; empty if it can.
+	Unsupported string `json:"unsupported,omitempty"`
+	// Parameters of the gzip stream; nil for uncompressed layers.
+	Gzip *GzipParams `json:"gzip,omitempty"`
+	// Contents of files the final filesystem doesn't have, by tar entry name.
+	Payloads map[string]digest.Digest `json:"payloads,omitempty"`
+}
+
+// GzipParams The settings that reproduce a gzip stream with compress/gzip.
+type GzipParams struct {
+	Level   int       `json:"level"`
+	Name    string    `json:"name,omitempty"`
+	Comment string    `json:"comment,omitempty"`
+	ModTime time.Time `json:"modTime"`
+	OS      byte      `json:"os"`
+	Extra   []byte    `json:"extra,omitempty"`
+}
+
+func (g *GzipParams) newWriter(w io.Writer) (*gzip.Writer, error) {
+	zw, err := gzip.NewWriterLevel(w, g.Level)
+	if err != nil {
+		return nil, err
+	}
+	zw.Header = gzip.Header{
+		Name:    g.Name,
+		Comment: g.Comment,
+		ModTime: g.ModTime,
+		OS:      g.OS,
+		Extra:   g.Extra,
+	}
+	return zw, nil
+}
+
+// Reproducible Check that every layer can be regenerated.
+func (idx *Index) Reproducible() error {
+	for _, l := range idx.Layers {
+		if l.Unsupported != "" {
+			return fmt.Errorf("layer %s can't be regenerated: %s", l.Digest, l.Unsupported)
+		}
+	}
+	return nil
+}
+
+func tarSplitPath(dir string, i int) string {
+	return filepath.Join(dir, tarSplitDir, strconv.Itoa(i)+".json.gz")
+}
+
+func payloadPath(dir string, dgst digest.Digest) string {
+	return filepath.Join(dir, payloadDir, dgst.Encoded())
+}
+
+// Extract Unpack a metadata archive read from r into dir. Only the files the
+// format defines are accepted, and payloads are checked against their names.
+func Extract(r io.Reader, dir string) (*Index, error) {
+	for _, sub := range []string{tarSplitDir, payloadDir} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0755); err != nil {
+			return nil, err
+		}
+	}
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error reading layer metadata: %w", err)
+		}
+
+		var verifier digest.Verifier
+		switch {
+		case hdr.Name == indexFile, tarSplitName.MatchString(hdr.Name):
+		case payloadName.MatchString(hdr.Name):
+			verifier = digest.NewDigestFromEncoded(digest.SHA256, payloadName.FindStringSubmatch(hdr.Name)[1]).Verifier()
+		default:
+			return nil, fmt.Errorf("unexpected file %q in layer metadata", hdr.Name)
+		}
+
+		if err := extractFile(tr, filepath.Join(dir, filepath.FromSlash(hdr.Name)), verifier); err != nil {
+			return nil, fmt.Errorf("error extracting %s: %w", hdr.Name, err)
+		}
+	}
+
+	p, err := os.ReadFile(filepath.Join(dir, indexFile))
+	if err != nil {
+		return nil, fmt.Errorf("layer metadata has no %s: %w", indexFile, err)
+	}
+	var idx Index
+	if err := json.Unmarshal(p, &idx); err != nil {
+		return nil, fmt.Errorf("error decoding %s: %w", indexFile, err)
+	}
+	if idx.Version != Version {
+		return nil, fmt.Errorf("unsupported layer metadata version %d (expected %d)", idx.Version, Version)
+	}
+	return &idx, nil
+}
+
+func extractFile(r io.Reader, path string, verifier digest.Verifier) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w := io.Writer(f)
+	if verifier != nil {
+		w = io.MultiWriter(f, verifier)
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		return err
+	}
+	if verifier != nil && !verifier.Verified() {
+		return fmt.Errorf("content does not match its digest")
+	}
+	return f.Close()
+}
@@ -0,0 +1,96 @@
+package layermeta
+
+import (
+	"compress/gzip"
+	"context"
+	"deltadiff/manifest"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/labels"
+	"github.com/containerd/continuity/fs"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/vbatts/tar-split/tar/asm"
+	"github.com/vbatts/tar-split/tar/storage"
+)
+
+// Rebuild Regenerate layer i of idx, whose metadata was extracted to dir,
+// from the filesystem at root, and store it in the content store as desc.
+// The content store checks the result against desc, so nothing is stored
+// unless it is identical to the original blob.
+func Rebuild(ctx context.Context, cs content.Store, dir string, idx *Index, i int, root string, desc ocispec.Descriptor, diffID digest.Digest) error {
+	if i >= len(idx.Layers) {
+		return fmt.Errorf("no metadata for layer %d", i)
+	}
+	l := idx.Layers[i]
+	if l.Digest != desc.Digest {
+		return fmt.Errorf("metadata is for layer %s, not %s", l.Digest, desc.Digest)
+	}
+	if l.Unsupported != "" {
+		return fmt.Errorf("layer %s can't be regenerated: %s", l.Digest, l.Unsupported)
+	}
+
+	f, err := os.Open(tarSplitPath(dir, i))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		return err
+	}
+
+	getter := fileGetter{root: root, dir: dir, payloads: l.Payloads}
+	tarStream := asm.NewOutputTarStream(getter, storage.NewJSONUnpacker(zr))
+	defer tarStream.Close()
+
+	blob := io.Reader(tarStream)
+	if l.Gzip != nil {
+		pr, pw := io.Pipe()
+		defer pr.Close()
+		go func() {
+			pw.CloseWithError(compress(pw, tarStream, l.Gzip))
+		}()
+		blob = pr
+	}
+
+	return manifest.WriteBlob(ctx, cs, "cargosync-exact-"+desc.Digest.Encoded(), blob, desc,
+		map[string]string{labels.LabelUncompressed: diffID.String()})
+}
+
+func compress(w io.Writer, r io.Reader, params *GzipParams) error {
+	zw, err := params.newWriter(w)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(zw, r); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// fileGetter Reads file contents from the extracted filesystem, or from the
+// shipped payloads for files it doesn't have.
+type fileGetter struct {
+	root     string
+	dir      string
+	payloads map[string]digest.Digest
+}
+
+func (g fileGetter) Get(name string) (io.ReadCloser, error) {
+	if dgst, ok := g.payloads[name]; ok {
+		if err := dgst.Validate(); err != nil {
+			return nil, err
+		}
+		return os.Open(payloadPath(g.dir, dgst))
+	}
+	// Resolve symlinks within root, so the image can't point us elsewhere.
+	p, err := fs.RootPath(g.root, name)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(p)
+}
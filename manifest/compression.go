@@ -0,0 +1,72 @@
+package manifest
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/images"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Compression The compression of a reconstructed layer.
+type Compression string
+
+const (
+	CompressionGzip Compression = "gzip"
+	CompressionZstd Compression = "zstd"
+	CompressionNone Compression = "none"
+)
+
+// ParseCompression Parse gzip, zstd or none.
+func ParseCompression(s string) (Compression, error) {
+	switch c := Compression(s); c {
+	case CompressionGzip, CompressionZstd, CompressionNone:
+		return c, nil
+	}
+	return "", fmt.Errorf("unknown layer compression %q: must be gzip, zstd or none", s)
+}
+
+// LayerMediaType The media type of a layer compressed with c, in a manifest
+// of type manifestType. Docker schema2 manifests have no zstd layer type, so
+// that combination is rejected.
+func LayerMediaType(manifestType string, c Compression) (string, error) {
+	switch manifestType {
+	case images.MediaTypeDockerSchema2Manifest:
+		switch c {
+		case CompressionGzip:
+			return images.MediaTypeDockerSchema2LayerGzip, nil
+		case CompressionNone:
+			return images.MediaTypeDockerSchema2Layer, nil
+		}
+	case ocispec.MediaTypeImageManifest:
+		switch c {
+		case CompressionGzip:
+			return ocispec.MediaTypeImageLayerGzip, nil
+		case CompressionZstd:
+			return ocispec.MediaTypeImageLayerZstd, nil
+		case CompressionNone:
+			return ocispec.MediaTypeImageLayer, nil
+		}
+	default:
+		return "", fmt.Errorf("unknown parent image manifest type: %s", manifestType)
+	}
+	return "", fmt.Errorf("%s layers can't be expressed in a %s manifest: %w", c, manifestType, errdefs.ErrNotImplemented)
+}
+
+// layerCompression The compression of a layer, from its media type.
+func layerCompression(ctx context.Context, mediaType string) (Compression, error) {
+	c, err := images.DiffCompression(ctx, mediaType)
+	if err != nil {
+		return "", err
+	}
+	switch c {
+	case "":
+		return CompressionNone, nil
+	case "gzip":
+		return CompressionGzip, nil
+	case "zstd":
+		return CompressionZstd, nil
+	}
+	return "", fmt.Errorf("layer media type %s doesn't tell its compression", mediaType)
+}
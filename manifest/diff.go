@@ -0,0 +1,144 @@
+package manifest
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/containerd/containerd/content"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Change One value that differs between two versions of an image. Key names
+// the entry of fields that are sets or maps, such as an environment variable
+// or a label. Old is empty for added values and New for removed ones.
+type Change struct {
+	Field string `json:"field"`
+	Key   string `json:"key,omitempty"`
+	Old   string `json:"old,omitempty"`
+	New   string `json:"new,omitempty"`
+}
+
+// ImageDiff What changed in the metadata of an image between two versions.
+type ImageDiff struct {
+	Config        []Change             `json:"config"`
+	Annotations   []Change             `json:"annotations"`
+	LayersAdded   []ocispec.Descriptor `json:"layersAdded"`
+	LayersRemoved []ocispec.Descriptor `json:"layersRemoved"`
+}
+
+// Diff Compare the config and manifest of two versions of an image. Layers
+// are compared by digest, so a layer moved to another position is neither
+// added nor removed.
+func Diff(ctx context.Context, provider content.Provider, from, to *ImageManifest) (*ImageDiff, error) {
+	var configs [2]ocispec.Image
+	for i, m := range []*ImageManifest{from, to} {
+		p, err := content.ReadBlob(ctx, provider, m.Config())
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(p, &configs[i]); err != nil {
+			return nil, fmt.Errorf("error decoding image config %s: %w", m.Config().Digest, err)
+		}
+	}
+	return diffImages(from, to, configs[0].Config, configs[1].Config), nil
+}
+
+func diffImages(from, to *ImageManifest, before, after ocispec.ImageConfig) *ImageDiff {
+	d := &ImageDiff{
+		Config:        []Change{},
+		Annotations:   diffMaps("annotations", from.Annotations(), to.Annotations()),
+		LayersAdded:   []ocispec.Descriptor{},
+		LayersRemoved: []ocispec.Descriptor{},
+	}
+
+	d.Config = append(d.Config, diffMaps("Env", envMap(before.Env), envMap(after.Env))...)
+	d.Config = append(d.Config, diffValues("Entrypoint", jsonString(before.Entrypoint), jsonString(after.Entrypoint))...)
+	d.Config = append(d.Config, diffValues("Cmd", jsonString(before.Cmd), jsonString(after.Cmd))...)
+	d.Config = append(d.Config, diffMaps("ExposedPorts", setMap(before.ExposedPorts), setMap(after.ExposedPorts))...)
+	d.Config = append(d.Config, diffMaps("Labels", before.Labels, after.Labels)...)
+	d.Config = append(d.Config, diffValues("User", before.User, after.User)...)
+	d.Config = append(d.Config, diffMaps("Volumes", setMap(before.Volumes), setMap(after.Volumes))...)
+
+	inFrom := map[string]bool{}
+	for _, layer := range from.Layers() {
+		inFrom[layer.Digest.String()] = true
+	}
+	inTo := map[string]bool{}
+	for _, layer := range to.Layers() {
+		inTo[layer.Digest.String()] = true
+		if !inFrom[layer.Digest.String()] {
+			d.LayersAdded = append(d.LayersAdded, layer)
+		}
+	}
+	for _, layer := range from.Layers() {
+		if !inTo[layer.Digest.String()] {
+			d.LayersRemoved = append(d.LayersRemoved, layer)
+		}
+	}
+	return d
+}
+
+func diffValues(field, before, after string) []Change {
+	if before == after {
+		return nil
+	}
+	return []Change{{Field: field, Old: before, New: after}}
+}
+
+// diffMaps The changes between two maps, sorted by key.
+func diffMaps(field string, before, after map[string]string) []Change {
+	keys := map[string]bool{}
+	for k := range before {
+		keys[k] = true
+	}
+	for k := range after {
+		keys[k] = true
+	}
+	sorted := make([]string, 0, len(keys))
+	for k := range keys {
+		sorted = append(sorted, k)
+	}
+	sort.Strings(sorted)
+
+	var changes []Change
+	for _, k := range sorted {
+		o, inBefore := before[k]
+		n, inAfter := after[k]
+		if inBefore == inAfter && o == n {
+			continue
+		}
+		changes = append(changes, Change{Field: field, Key: k, Old: o, New: n})
+	}
+	return changes
+}
+
+// envMap Environment variables by name.
+func envMap(env []string) map[string]string {
+	m := map[string]string{}
+	for _, kv := range env {
+		k, v, _ := strings.Cut(kv, "=")
+		m[k] = v
+	}
+	return m
+}
+
+// setMap The keys of a set, such as exposed ports or volumes, mapped to
+// themselves so they show up as values of the changes.
+func setMap(set map[string]struct{}) map[string]string {
+	m := map[string]string{}
+	for k := range set {
+		m[k] = k
+	}
+	return m
+}
+
+func jsonString(v []string) string {
+	if v == nil {
+		return ""
+	}
+	p, _ := json.Marshal(v)
+	return string(p)
+}
@@ -0,0 +1,386 @@
+package manifest
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/leases"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// ConfigChange Changes to the container config of an image. Nil fields are
+// left alone, and empty ones are removed.
+type ConfigChange struct {
+	Env        []string
+	Entrypoint []string
+	Cmd        []string
+	Labels     map[string]string
+	WorkingDir *string
+	User       *string
+}
+
+// AppendLayer Add layer on top of the layers of the manifest.
+func (m *ImageManifest) AppendLayer(ctx context.Context, contentStore content.Store, layer ocispec.Descriptor, opts ...ReplaceOpt) error {
+	n := len(m.layers)
+	return m.ReplaceLayers(ctx, contentStore, n, n, []ocispec.Descriptor{layer}, opts...)
+}
+
+// RemoveLayers Remove the layers from start up to, not including, end.
+func (m *ImageManifest) RemoveLayers(ctx context.Context, contentStore content.Store, start, end int, opts ...ReplaceOpt) error {
+	return m.ReplaceLayers(ctx, contentStore, start, end, nil, opts...)
+}
+
+// ReplaceLayers Replace the layers from start up to, not including, end with
+// layers. The diffIDs of the config follow, and so does its history: the
+// entries of the replaced layers are dropped and one is added for each new
+// layer, from WithHistory or else a generic one. Entries of config changes
+// between the replaced layers are kept, since their changes still apply.
+func (m *ImageManifest) ReplaceLayers(ctx context.Context, contentStore content.Store, start, end int, layers []ocispec.Descriptor, opts ...ReplaceOpt) error {
+	if start < 0 || end < start || end > len(m.layers) {
+		return fmt.Errorf("invalid layer range [%d, %d) of %d layers: %w", start, end, len(m.layers), errdefs.ErrInvalidArgument)
+	}
+	options := newReplaceOptions(opts)
+	if options.history != nil && len(options.history) != len(layers) {
+		return fmt.Errorf("%d history entries given for %d layers: %w", len(options.history), len(layers), errdefs.ErrInvalidArgument)
+	}
+
+	return m.edit(ctx, contentStore, nil, options, func(updated *ImageManifest, config *document, created *time.Time) error {
+		newLayers := make([]ocispec.Descriptor, len(layers))
+		newDiffIDs := make([]digest.Digest, len(layers))
+		for i, layer := range layers {
+			var err error
+			if newLayers[i], newDiffIDs[i], err = updated.prepareLayer(ctx, contentStore, layer); err != nil {
+				return err
+			}
+		}
+
+		var rootFS ocispec.RootFS
+		if err := config.decode("rootfs", &rootFS); err != nil {
+			return err
+		}
+		current := updated.Layers()
+		if len(rootFS.DiffIDs) != len(current) {
+			return fmt.Errorf("image config has %d diff IDs for %d layers", len(rootFS.DiffIDs), len(current))
+		}
+		rootFS.DiffIDs = splice(rootFS.DiffIDs, start, end, newDiffIDs)
+		if _, err := config.set("rootfs", rootFS, false); err != nil {
+			return err
+		}
+
+		entries := options.history
+		if entries == nil {
+			for range layers {
+				entries = append(entries, ocispec.History{
+					Created:   created,
+					CreatedBy: "cargosync: layer added",
+				})
+			}
+		}
+		if err := spliceHistory(config, len(current), start, end, entries); err != nil {
+			return err
+		}
+
+		_, err := updated.SetLayers(splice(current, start, end, newLayers))
+		return err
+	})
+}
+
+// UpdateConfig Change the container config of the image, recording the
+// change in the history like the ENV or ENTRYPOINT of a Dockerfile would be.
+// Fields of the config that ConfigChange doesn't know are kept.
+func (m *ImageManifest) UpdateConfig(ctx context.Context, contentStore content.Store, change ConfigChange, opts ...ReplaceOpt) error {
+	return m.edit(ctx, contentStore, nil, newReplaceOptions(opts), func(updated *ImageManifest, config *document, created *time.Time) error {
+		raw := config.fields["config"]
+		if len(raw) == 0 || string(raw) == "null" {
+			raw = json.RawMessage("{}")
+		}
+		container, err := parseDocument(ocispec.Descriptor{}, raw)
+		if err != nil {
+			return fmt.Errorf("error decoding container config: %w", err)
+		}
+
+		var changed []string
+		set := func(key string, v interface{}, isNil, empty bool) error {
+			if isNil {
+				return nil
+			}
+			changed = append(changed, key)
+			_, err := container.set(key, v, empty)
+			return err
+		}
+		for _, err := range []error{
+			set("Env", change.Env, change.Env == nil, len(change.Env) == 0),
+			set("Entrypoint", change.Entrypoint, change.Entrypoint == nil, len(change.Entrypoint) == 0),
+			set("Cmd", change.Cmd, change.Cmd == nil, len(change.Cmd) == 0),
+			set("Labels", change.Labels, change.Labels == nil, len(change.Labels) == 0),
+			set("WorkingDir", change.WorkingDir, change.WorkingDir == nil, change.WorkingDir != nil && *change.WorkingDir == ""),
+			set("User", change.User, change.User == nil, change.User != nil && *change.User == ""),
+		} {
+			if err != nil {
+				return err
+			}
+		}
+		if len(changed) == 0 {
+			return nil
+		}
+		if _, err := config.set("config", json.RawMessage(container.Bytes()), false); err != nil {
+			return err
+		}
+
+		var entries []json.RawMessage
+		if err := config.decode("history", &entries); err != nil {
+			return err
+		}
+		p, err := json.Marshal(ocispec.History{
+			Created:    created,
+			CreatedBy:  "cargosync: set " + strings.Join(changed, ", "),
+			EmptyLayer: true,
+		})
+		if err != nil {
+			return err
+		}
+		_, err = config.set("history", append(entries, p), false)
+		return err
+	})
+}
+
+// UpdateAnnotations Add annotations to the manifest, removing those set to
+// an empty value. Docker manifests have no annotations.
+func (m *ImageManifest) UpdateAnnotations(ctx context.Context, contentStore content.Store, annotations map[string]string, opts ...ReplaceOpt) error {
+	if m.desc.MediaType != ocispec.MediaTypeImageManifest {
+		return fmt.Errorf("%s manifests have no annotations: %w", m.desc.MediaType, errdefs.ErrNotImplemented)
+	}
+	options := newReplaceOptions(opts)
+	merged := map[string]string{}
+	for k, v := range annotations {
+		merged[k] = v
+	}
+	for k, v := range options.annotations {
+		merged[k] = v
+	}
+	options.annotations = merged
+	return m.edit(ctx, contentStore, nil, options, func(*ImageManifest, *document, *time.Time) error {
+		return nil
+	})
+}
+
+// edit Change a copy of the manifest and its image config with change, then
+// store both and make the manifest the result. The image config is
+// imageConfig if given, or else the one the manifest points to. change gets
+// the created time of the config after the created policy is applied. The
+// manifest is converted to the format of the options before, and their
+// annotations are merged in afterwards. The manifest is written with the
+// labels that keep its config and layers.
+func (m *ImageManifest) edit(ctx context.Context, contentStore content.Store, imageConfig []byte, options replaceOptions, change func(updated *ImageManifest, config *document, created *time.Time) error) error {
+	if options.lease != "" {
+		ctx = leases.WithLease(ctx, options.lease)
+	}
+	// Nothing references the config until the manifest is stored, and
+	// nothing references the manifest until the caller creates an image.
+	if _, ok := leases.FromContext(ctx); !ok {
+		return fmt.Errorf("a lease is needed to keep the written blobs until an image references them: %w", errdefs.ErrFailedPrecondition)
+	}
+
+	configDesc := m.Config()
+	if imageConfig == nil {
+		var err error
+		if imageConfig, err = content.ReadBlob(ctx, contentStore, configDesc); err != nil {
+			return err
+		}
+	}
+	// Work on the config as a generic JSON object, so that we can patch
+	// it without requiring knowledge of the entire schema.
+	config, err := parseDocument(ocispec.Descriptor{MediaType: configDesc.MediaType}, imageConfig)
+	if err != nil {
+		return fmt.Errorf("error decoding image config: %w", err)
+	}
+
+	var created *time.Time
+	if err := config.decode("created", &created); err != nil {
+		return err
+	}
+	if options.created != nil {
+		created = options.created(created)
+		if _, err := config.set("created", created, created == nil); err != nil {
+			return err
+		}
+	}
+
+	// Work on a copy, so m is left alone if storing the result fails.
+	// Converting first gives the layers added by change the new types.
+	updated := m.clone()
+	if err := updated.convert(options.format); err != nil {
+		return err
+	}
+	if err := change(updated, &config, created); err != nil {
+		return err
+	}
+
+	// Store the config if it changed. The descriptor is taken from the
+	// updated manifest, which may have converted its media type.
+	if config.desc.Digest != configDesc.Digest {
+		newConfig := updated.Config()
+		newConfig.Digest = config.desc.Digest
+		newConfig.Size = config.desc.Size
+		if err := WriteBlob(ctx, contentStore,
+			options.ingestRef("config", newConfig.Digest),
+			bytes.NewReader(config.Bytes()),
+			newConfig,
+			nil); err != nil {
+			return err
+		}
+		if _, err := updated.SetConfig(newConfig); err != nil {
+			return err
+		}
+	}
+
+	// Docker manifests have no annotations, so they are only set on OCI ones.
+	if len(options.annotations) > 0 && updated.desc.MediaType == ocispec.MediaTypeImageManifest {
+		annotations := updated.Annotations()
+		if annotations == nil {
+			annotations = map[string]string{}
+		}
+		for k, v := range options.annotations {
+			if v == "" {
+				delete(annotations, k)
+			} else {
+				annotations[k] = v
+			}
+		}
+		if _, err := updated.SetAnnotations(annotations); err != nil {
+			return err
+		}
+	}
+
+	// Save the new manifest, with the labels that tell the garbage
+	// collector to NOT delete the content it references.
+	newDesc := updated.Descriptor()
+	if err := WriteBlob(ctx,
+		contentStore,
+		options.ingestRef("manifest", newDesc.Digest),
+		bytes.NewReader(updated.Bytes()),
+		newDesc,
+		updated.GCLabels()); err != nil {
+		return err
+	}
+
+	*m = *updated
+	return nil
+}
+
+// prepareLayer Give layer the media type the manifest uses for its
+// compression, and find its diffID: an uncompressed layer is its own, others
+// must be labelled with theirs like the ones containerd's differ writes.
+func (m *ImageManifest) prepareLayer(ctx context.Context, contentStore content.Store, layer ocispec.Descriptor) (ocispec.Descriptor, digest.Digest, error) {
+	compression, err := layerCompression(ctx, layer.MediaType)
+	if err != nil {
+		return layer, "", err
+	}
+	layer.MediaType, err = LayerMediaType(m.desc.MediaType, compression)
+	if err != nil {
+		return layer, "", err
+	}
+
+	if compression == CompressionNone {
+		return layer, layer.Digest, nil
+	}
+	info, err := contentStore.Info(ctx, layer.Digest)
+	if err != nil {
+		return layer, "", err
+	}
+	diffIDStr, ok := info.Labels[containerdUncompressed]
+	if !ok {
+		return layer, "", fmt.Errorf("layer %s has no diffID label", layer.Digest)
+	}
+	diffID, err := digest.Parse(diffIDStr)
+	return layer, diffID, err
+}
+
+// spliceHistory Replace the history entries of the layers from start up to,
+// not including, end with entries. layers is the number of layers before
+// the change. An image without history is left without.
+func spliceHistory(config *document, layers, start, end int, entries []ocispec.History) error {
+	var history []map[string]json.RawMessage
+	if err := config.decode("history", &history); err != nil {
+		return err
+	}
+	if len(history) == 0 {
+		return nil
+	}
+
+	// Tools pair the non-empty entries with the layers, in order.
+	var layerEntries []int
+	isLayer := map[int]bool{}
+	for i, entry := range history {
+		var empty bool
+		if raw, ok := entry["empty_layer"]; ok {
+			if err := json.Unmarshal(raw, &empty); err != nil {
+				return fmt.Errorf("error decoding history: %w", err)
+			}
+		}
+		if !empty {
+			layerEntries = append(layerEntries, i)
+			isLayer[i] = true
+		}
+	}
+	if len(layerEntries) != layers {
+		return fmt.Errorf("image config has %d history entries for %d layers", len(layerEntries), layers)
+	}
+
+	// The new entries go where the first replaced layer was, or at the end
+	// when appending.
+	at := len(history)
+	if start < layers {
+		at = layerEntries[start]
+	}
+	removed := func(i int) bool {
+		return isLayer[i] && start < layers && i >= layerEntries[start] && end > start && i <= layerEntries[end-1]
+	}
+
+	result := make([]json.RawMessage, 0, len(history)+len(entries))
+	for i := 0; i <= len(history); i++ {
+		if i == at {
+			for _, e := range entries {
+				p, err := json.Marshal(e)
+				if err != nil {
+					return err
+				}
+				result = append(result, p)
+			}
+		}
+		if i == len(history) || removed(i) {
+			continue
+		}
+		// Only re-encoded as a map, so fields we don't know survive.
+		p, err := json.Marshal(history[i])
+		if err != nil {
+			return err
+		}
+		result = append(result, p)
+	}
+	_, err := config.set("history", result, false)
+	return err
+}
+
+// splice Replace s[start:end] with items, without modifying s.
+func splice[T any](s []T, start, end int, items []T) []T {
+	result := make([]T, 0, len(s)-(end-start)+len(items))
+	result = append(result, s[:start]...)
+	result = append(result, items...)
+	return append(result, s[end:]...)
+}
+
+func newReplaceOptions(opts []ReplaceOpt) replaceOptions {
+	var options replaceOptions
+	for _, opt := range opts {
+		opt(&options)
+	}
+	return options
+}
@@ -0,0 +1,289 @@
+package manifest
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/content/local"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/leases"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// memoryLabels keeps the labels of a test content store.
+type memoryLabels struct {
+	mu     sync.Mutex
+	labels map[digest.Digest]map[string]string
+}
+
+func (m *memoryLabels) Get(d digest.Digest) (map[string]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.labels[d], nil
+}
+
+func (m *memoryLabels) Set(d digest.Digest, labels map[string]string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.labels[d] = labels
+	return nil
+}
+
+func (m *memoryLabels) Update(d digest.Digest, update map[string]string) (map[string]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	labels := m.labels[d]
+	if labels == nil {
+		labels = map[string]string{}
+	}
+	for k, v := range update {
+		if v == "" {
+			delete(labels, k)
+		} else {
+			labels[k] = v
+		}
+	}
+	m.labels[d] = labels
+	return labels, nil
+}
+
+// newTestStore returns a content store in a temporary directory and a
+// context with a lease, as edits require.
+func newTestStore(t *testing.T) (context.Context, content.Store) {
+	t.Helper()
+	cs, err := local.NewLabeledStore(t.TempDir(), &memoryLabels{labels: map[digest.Digest]map[string]string{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return leases.WithLease(context.Background(), "test"), cs
+}
+
+// writeJSON stores v and returns its descriptor.
+func writeJSON(t *testing.T, ctx context.Context, cs content.Store, mediaType string, v interface{}) ocispec.Descriptor {
+	t.Helper()
+	p, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	desc := ocispec.Descriptor{MediaType: mediaType, Digest: digest.FromBytes(p), Size: int64(len(p))}
+	if err := content.WriteBlob(ctx, cs, desc.Digest.String(), strings.NewReader(string(p)), desc); err != nil {
+		t.Fatal(err)
+	}
+	return desc
+}
+
+// historyConfig returns a config document with history entries created by
+// each of createdBy; those starting with "ENV" are empty layers.
+func historyConfig(t *testing.T, createdBy ...string) document {
+	t.Helper()
+	var history []map[string]interface{}
+	for _, c := range createdBy {
+		entry := map[string]interface{}{"created_by": c, "x-tool": "kept"}
+		if strings.HasPrefix(c, "ENV") {
+			entry["empty_layer"] = true
+		}
+		history = append(history, entry)
+	}
+	config := map[string]interface{}{"architecture": "amd64"}
+	if history != nil {
+		config["history"] = history
+	}
+	p, err := json.Marshal(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := parseDocument(ocispec.Descriptor{}, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func createdBy(t *testing.T, config *document) []string {
+	t.Helper()
+	var history []map[string]interface{}
+	if err := config.decode("history", &history); err != nil {
+		t.Fatal(err)
+	}
+	var result []string
+	for _, h := range history {
+		s, _ := h["created_by"].(string)
+		if h["x-tool"] != nil && h["x-tool"] != "kept" {
+			t.Errorf("unknown field of %q changed to %v", s, h["x-tool"])
+		}
+		result = append(result, s)
+	}
+	return result
+}
+
+func TestSpliceHistory(t *testing.T) {
+	original := []string{"layer 0", "ENV A=1", "layer 1", "layer 2"}
+	tests := []struct {
+		name       string
+		history    []string
+		layers     int
+		start, end int
+		entries    []string
+		want       []string
+	}{
+		{"replace one", original, 3, 1, 2, []string{"new"}, []string{"layer 0", "ENV A=1", "new", "layer 2"}},
+		{"replace all keeps config changes", original, 3, 0, 3, []string{"new"}, []string{"new", "ENV A=1"}},
+		{"replace with several", original, 3, 2, 3, []string{"new 1", "new 2"}, []string{"layer 0", "ENV A=1", "layer 1", "new 1", "new 2"}},
+		{"append", original, 3, 3, 3, []string{"new"}, []string{"layer 0", "ENV A=1", "layer 1", "layer 2", "new"}},
+		{"insert", original, 3, 1, 1, []string{"new"}, []string{"layer 0", "ENV A=1", "new", "layer 1", "layer 2"}},
+		{"remove", original, 3, 1, 3, nil, []string{"layer 0", "ENV A=1"}},
+		{"config change after the last layer", []string{"layer 0", "ENV A=1"}, 1, 0, 1, []string{"new"}, []string{"new", "ENV A=1"}},
+		{"no history", nil, 3, 0, 1, []string{"new"}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := historyConfig(t, tt.history...)
+			var entries []ocispec.History
+			for _, e := range tt.entries {
+				entries = append(entries, ocispec.History{CreatedBy: e})
+			}
+			if err := spliceHistory(&config, tt.layers, tt.start, tt.end, entries); err != nil {
+				t.Fatal(err)
+			}
+			if got := createdBy(t, &config); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("history = %q, want %q", got, tt.want)
+			}
+			if _, ok := config.fields["history"]; tt.history == nil && ok {
+				t.Errorf("history was added to a config without one: %s", config.Bytes())
+			}
+		})
+	}
+}
+
+func TestSpliceHistoryLayerCount(t *testing.T) {
+	config := historyConfig(t, "layer 0", "ENV A=1", "layer 1")
+	err := spliceHistory(&config, 3, 0, 1, nil)
+	if err == nil || !strings.Contains(err.Error(), "2 history entries for 3 layers") {
+		t.Errorf("spliceHistory() error = %v", err)
+	}
+}
+
+// testImage stores an OCI image with uncompressed layers, so their digests
+// are their diffIDs, and returns its manifest.
+func testImage(t *testing.T, ctx context.Context, cs content.Store, layers ...string) *ImageManifest {
+	t.Helper()
+	var descs []ocispec.Descriptor
+	var diffIDs []digest.Digest
+	var history []map[string]interface{}
+	for _, l := range layers {
+		desc := ocispec.Descriptor{MediaType: ocispec.MediaTypeImageLayer, Digest: digest.FromString(l), Size: int64(len(l))}
+		descs = append(descs, desc)
+		diffIDs = append(diffIDs, desc.Digest)
+		history = append(history, map[string]interface{}{"created_by": l, "x-tool": "kept"})
+	}
+	config := writeJSON(t, ctx, cs, ocispec.MediaTypeImageConfig, map[string]interface{}{
+		"architecture": "amd64",
+		"os":           "linux",
+		"x-config":     "kept",
+		"rootfs":       map[string]interface{}{"type": "layers", "diff_ids": diffIDs},
+		"history":      history,
+	})
+	desc := writeJSON(t, ctx, cs, ocispec.MediaTypeImageManifest, map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     ocispec.MediaTypeImageManifest,
+		"config":        config,
+		"layers":        descs,
+		"x-manifest":    "kept",
+	})
+	m, err := LoadImageManifest(ctx, cs, desc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestReplaceLayers(t *testing.T) {
+	ctx, cs := newTestStore(t)
+	m := testImage(t, ctx, cs, "layer 0", "layer 1", "layer 2")
+	layer := ocispec.Descriptor{MediaType: ocispec.MediaTypeImageLayer, Digest: digest.FromString("new"), Size: 3}
+
+	if err := m.ReplaceLayers(ctx, cs, 1, 3, []ocispec.Descriptor{layer}, WithHistory(ocispec.History{CreatedBy: "new"})); err != nil {
+		t.Fatal(err)
+	}
+
+	// The manifest and its config were stored, with the GC labels.
+	info, err := cs.Info(ctx, m.Descriptor().Digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Labels["containerd.io/gc.ref.content.0"] != m.Config().Digest.String() {
+		t.Errorf("manifest labels = %v", info.Labels)
+	}
+	stored, err := LoadImageManifest(ctx, cs, m.Descriptor())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []digest.Digest
+	for _, l := range stored.Layers() {
+		got = append(got, l.Digest)
+	}
+	if want := []digest.Digest{digest.FromString("layer 0"), layer.Digest}; !reflect.DeepEqual(got, want) {
+		t.Errorf("layers = %v, want %v", got, want)
+	}
+	if !strings.Contains(string(stored.Bytes()), `"x-manifest":"kept"`) {
+		t.Errorf("manifest lost an unknown field: %s", stored.Bytes())
+	}
+
+	p, err := content.ReadBlob(ctx, cs, stored.Config())
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err := parseDocument(stored.Config(), p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rootFS ocispec.RootFS
+	if err := config.decode("rootfs", &rootFS); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(rootFS.DiffIDs, got) {
+		t.Errorf("diff IDs = %v, want %v", rootFS.DiffIDs, got)
+	}
+	if h := createdBy(t, &config); !reflect.DeepEqual(h, []string{"layer 0", "new"}) {
+		t.Errorf("history = %q", h)
+	}
+	if !strings.Contains(string(p), `"x-config":"kept"`) {
+		t.Errorf("config lost an unknown field: %s", p)
+	}
+}
+
+func TestReplaceLayersErrors(t *testing.T) {
+	ctx, cs := newTestStore(t)
+	m := testImage(t, ctx, cs, "layer 0", "layer 1")
+	before := m.Descriptor()
+	layer := ocispec.Descriptor{MediaType: ocispec.MediaTypeImageLayer, Digest: digest.FromString("new"), Size: 3}
+
+	for _, tt := range []struct {
+		name       string
+		ctx        context.Context
+		start, end int
+		opts       []ReplaceOpt
+		check      func(error) bool
+	}{
+		{"end past the layers", ctx, 1, 3, nil, errdefs.IsInvalidArgument},
+		{"start after end", ctx, 2, 1, nil, errdefs.IsInvalidArgument},
+		{"history of the wrong length", ctx, 0, 1, []ReplaceOpt{WithHistory(ocispec.History{}, ocispec.History{})}, errdefs.IsInvalidArgument},
+		{"no lease", context.Background(), 0, 1, nil, errdefs.IsFailedPrecondition},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			err := m.ReplaceLayers(tt.ctx, cs, tt.start, tt.end, []ocispec.Descriptor{layer}, tt.opts...)
+			if !tt.check(err) {
+				t.Errorf("ReplaceLayers() error = %v", err)
+			}
+			if m.Descriptor().Digest != before.Digest {
+				t.Errorf("manifest changed after a failed edit")
+			}
+		})
+	}
+}
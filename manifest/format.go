@@ -0,0 +1,132 @@
+package manifest
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/images"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Format The media types a manifest and its config and layers are written in.
+type Format string
+
+const (
+	// FormatPreserve Keep the format of the upstream manifest.
+	FormatPreserve Format = "preserve"
+	FormatOCI      Format = "oci"
+	FormatDocker   Format = "docker"
+)
+
+// ParseFormat Parse oci, docker or preserve.
+func ParseFormat(s string) (Format, error) {
+	switch f := Format(s); f {
+	case FormatPreserve, FormatOCI, FormatDocker:
+		return f, nil
+	}
+	return "", fmt.Errorf("unknown output format %q: must be oci, docker or preserve", s)
+}
+
+// ManifestMediaType The media type of a manifest of type current once
+// converted to the format.
+func (f Format) ManifestMediaType(current string) string {
+	switch f {
+	case FormatOCI:
+		return ocispec.MediaTypeImageManifest
+	case FormatDocker:
+		return images.MediaTypeDockerSchema2Manifest
+	}
+	return current
+}
+
+// Layer media types of Docker schema2 and their OCI counterparts. Foreign
+// layers are OCI's non-distributable ones.
+var dockerToOCILayers = map[string]string{
+	images.MediaTypeDockerSchema2Layer:            ocispec.MediaTypeImageLayer,
+	images.MediaTypeDockerSchema2LayerGzip:        ocispec.MediaTypeImageLayerGzip,
+	images.MediaTypeDockerSchema2LayerForeign:     ocispec.MediaTypeImageLayerNonDistributable,
+	images.MediaTypeDockerSchema2LayerForeignGzip: ocispec.MediaTypeImageLayerNonDistributableGzip,
+}
+
+// Convert Rewrite the manifest, its config and layer descriptors in the
+// media types of format f. The blobs themselves are the same in both
+// formats, so only the manifest and the config descriptor change. Docker
+// manifests have no annotations, so they are dropped; a subject or artifact
+// type can't be expressed at all, and neither can zstd layers.
+func (m *ImageManifest) Convert(ctx context.Context, contentStore content.Store, f Format, opts ...ReplaceOpt) error {
+	options := newReplaceOptions(opts)
+	options.format = f
+	return m.edit(ctx, contentStore, nil, options, func(*ImageManifest, *document, *time.Time) error {
+		return nil
+	})
+}
+
+// convert Change the media types of the manifest to format f, in memory.
+func (m *ImageManifest) convert(f Format) error {
+	mediaType := f.ManifestMediaType(m.desc.MediaType)
+	if mediaType == m.desc.MediaType {
+		return nil
+	}
+
+	var configType string
+	layerTypes := map[string]string{}
+	switch mediaType {
+	case ocispec.MediaTypeImageManifest:
+		configType = ocispec.MediaTypeImageConfig
+		layerTypes = dockerToOCILayers
+	case images.MediaTypeDockerSchema2Manifest:
+		if m.Subject() != nil || m.ArtifactType() != "" {
+			return fmt.Errorf("manifest %s has a subject or artifact type, which Docker manifests can't hold: %w", m.desc.Digest, errdefs.ErrNotImplemented)
+		}
+		configType = images.MediaTypeDockerSchema2Config
+		for docker, oci := range dockerToOCILayers {
+			layerTypes[oci] = docker
+		}
+	}
+
+	config := m.Config()
+	switch config.MediaType {
+	case images.MediaTypeDockerSchema2Config, ocispec.MediaTypeImageConfig:
+	default:
+		return fmt.Errorf("config media type %s is not an image config: %w", config.MediaType, errdefs.ErrNotImplemented)
+	}
+	config.MediaType = configType
+
+	layers := m.Layers()
+	for i, layer := range layers {
+		if t, ok := layerTypes[layer.MediaType]; ok {
+			layers[i].MediaType = t
+		} else if !isLayerTypeOf(layer.MediaType, layerTypes) {
+			return fmt.Errorf("layer %s of type %s can't be converted to %s: %w", layer.Digest, layer.MediaType, mediaType, errdefs.ErrNotImplemented)
+		}
+	}
+
+	if _, err := m.setMediaType(mediaType); err != nil {
+		return err
+	}
+	if _, err := m.SetConfig(config); err != nil {
+		return err
+	}
+	if _, err := m.SetLayers(layers); err != nil {
+		return err
+	}
+	if mediaType == images.MediaTypeDockerSchema2Manifest {
+		if _, err := m.SetAnnotations(nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isLayerTypeOf Whether mediaType is already one of the types converted to.
+func isLayerTypeOf(mediaType string, types map[string]string) bool {
+	for _, t := range types {
+		if t == mediaType {
+			return true
+		}
+	}
+	return false
+}
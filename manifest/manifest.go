@@ -4,345 +4,173 @@ package manifest
 // Many thanks to the darch team for their work on this!
 
 import (
-	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
-	"runtime"
-	"strings"
+	"io"
+	"time"
 
 	"github.com/containerd/containerd/content"
-	"github.com/containerd/containerd/images"
 	digest "github.com/opencontainers/go-digest"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 )
 
 const containerdUncompressed = "containerd.io/uncompressed"
 
-// Manifest The manifest that can be mutated.
+// Manifest The manifest that can be mutated. Every change keeps the diffIDs
+// and history of the image config in line with the layers, and stores the
+// new config and manifest in the content store.
 type Manifest interface {
-	ReplaceWithLayer(ctx context.Context, contentStore content.Store, layer ocispec.Descriptor, imageConfig []byte) error
+	ReplaceWithLayer(ctx context.Context, contentStore content.Store, layer ocispec.Descriptor, imageConfig []byte, opts ...ReplaceOpt) error
+	AppendLayer(ctx context.Context, contentStore content.Store, layer ocispec.Descriptor, opts ...ReplaceOpt) error
+	ReplaceLayers(ctx context.Context, contentStore content.Store, start, end int, layers []ocispec.Descriptor, opts ...ReplaceOpt) error
+	RemoveLayers(ctx context.Context, contentStore content.Store, start, end int, opts ...ReplaceOpt) error
+	UpdateConfig(ctx context.Context, contentStore content.Store, change ConfigChange, opts ...ReplaceOpt) error
+	UpdateAnnotations(ctx context.Context, contentStore content.Store, annotations map[string]string, opts ...ReplaceOpt) error
+	Convert(ctx context.Context, contentStore content.Store, f Format, opts ...ReplaceOpt) error
 	Descriptor() ocispec.Descriptor
 }
 
-type ManifestImpl struct {
-	D    map[string]json.RawMessage
-	Desc ocispec.Descriptor
-}
-
-func (m *ManifestImpl) getManifestImpl() *ManifestImpl {
-	return m
-}
-
 // LoadManifest Load a manifest in-memory for easy interaction.
 func LoadManifest(ctx context.Context, contentStore content.Store, desc ocispec.Descriptor) (Manifest, error) {
-	p, err := content.ReadBlob(ctx, contentStore, desc)
-	if err != nil {
-		return nil, err
-	}
-
-	m := map[string]json.RawMessage{}
-	if err := json.Unmarshal(p, &m); err != nil {
-		return nil, err
-	}
-
-	return &ManifestImpl{
-		D:    m,
-		Desc: desc,
-	}, nil
+	return LoadImageManifest(ctx, contentStore, desc)
 }
 
-// For accessing the ManifestImpl fields from outside the package
-func LoadManifestImpl(ctx context.Context, contentStore content.Store, desc ocispec.Descriptor) (*ManifestImpl, error) {
-	p, err := content.ReadBlob(ctx, contentStore, desc)
+// LoadManifestForPlatform Load the manifest for a platform. desc can be a
+// manifest, or an index or manifest list that is resolved with ResolvePlatform.
+func LoadManifestForPlatform(ctx context.Context, contentStore content.Store, desc ocispec.Descriptor, platform ocispec.Platform) (*ImageManifest, error) {
+	desc, err := ResolvePlatform(ctx, contentStore, desc, platform)
 	if err != nil {
 		return nil, err
 	}
-
-	m := map[string]json.RawMessage{}
-	if err := json.Unmarshal(p, &m); err != nil {
-		return nil, err
-	}
-
-	return &ManifestImpl{
-		D:    m,
-		Desc: desc,
-	}, nil
+	return LoadImageManifest(ctx, contentStore, desc)
 }
 
-func LoadManifestFromList(ctx context.Context, desc ocispec.Descriptor, contentStore content.Store, os string, arch string) (Manifest, error) {
-
-	p, err := content.ReadBlob(ctx, contentStore, desc)
-	if err != nil {
-		return nil, err
-	}
-
-	m := map[string]json.RawMessage{}
-	if err := json.Unmarshal(p, &m); err != nil {
-		return nil, err
-	}
-
-	manifestListJSON, err := m["manifests"].MarshalJSON()
-	if err != nil {
-		return nil, err
-	}
-	var manifestList []json.RawMessage
-
-	if err = json.Unmarshal(manifestListJSON, &manifestList); err != nil {
-		return nil, err
-	}
-
-	// iterate over the manifests and choose the one with architecture the same as the one wanted
-	manifest_json := map[string]json.RawMessage{}
-	for _, manifest := range manifestList {
-		if err := json.Unmarshal(manifest, &manifest_json); err != nil {
-			fmt.Println("error unmarshalling manifest")
-			return nil, err
-		}
-
-		platform := map[string]json.RawMessage{}
-		if err := json.Unmarshal(manifest_json["platform"], &platform); err != nil {
-			fmt.Println("error unmarshalling platform")
-			return nil, err
+// ReplaceWithLayer Replace all layers of the manifest with layer. The image
+// config, imageConfig if given or else the one the manifest points to, is
+// patched to match and stored together with the new manifest. The blobs are
+// written under the lease of ctx, or the one given with WithLease, which must
+// be kept until an image references the manifest.
+func (m *ImageManifest) ReplaceWithLayer(ctx context.Context, contentStore content.Store, layer ocispec.Descriptor, imageConfig []byte, opts ...ReplaceOpt) error {
+	options := newReplaceOptions(opts)
+	return m.edit(ctx, contentStore, imageConfig, options, func(updated *ImageManifest, config *document, created *time.Time) error {
+		// These builds can be done on docker images, or OCI image, so
+		// the layer gets the type the manifest expects.
+		layer, diffID, err := updated.prepareLayer(ctx, contentStore, layer)
+		if err != nil {
+			return err
 		}
 
-		// check if the platform is the same as the current machine's platform
-		// if it is, then we have found the manifest we want to use, so we retrieve
-		// the descriptor and load the manifest!
-
-		if string(platform["os"]) == `"`+os+`"` && strings.EqualFold(string(platform["architecture"]), `"`+arch+`"`) {
-			desc, err := GetDescriptor(manifest)
-			if err != nil {
-				return nil, err
-			}
-			return LoadManifest(ctx, contentStore, desc)
+		// Replace the diff_ids with the one of the new layer.
+		var rootFS ocispec.RootFS
+		if err := config.decode("rootfs", &rootFS); err != nil {
+			return err
 		}
-	}
-	return nil, fmt.Errorf("no manifest found for %s/%s", runtime.GOOS, runtime.GOARCH)
-}
-
-func LoadManifestImplFromList(ctx context.Context, desc ocispec.Descriptor, contentStore content.Store, os string, arch string) (*ManifestImpl, error) {
-	// Same as LoadManifestFromList, but returns a ManifestImpl instead of a Manifest
-
-	p, err := content.ReadBlob(ctx, contentStore, desc)
-	if err != nil {
-		return nil, err
-	}
-
-	m := map[string]json.RawMessage{}
-	if err := json.Unmarshal(p, &m); err != nil {
-		return nil, err
-	}
-
-	manifestListJSON, err := m["manifests"].MarshalJSON()
-	if err != nil {
-		return nil, err
-	}
-	var manifestList []json.RawMessage
-
-	if err = json.Unmarshal(manifestListJSON, &manifestList); err != nil {
-		return nil, err
-	}
-
-	// iterate over the manifests and choose the one with architecture the same as the one wanted
-	manifest_json := map[string]json.RawMessage{}
-	for _, manifest := range manifestList {
-		if err := json.Unmarshal(manifest, &manifest_json); err != nil {
-			fmt.Println("error unmarshalling manifest")
-			return nil, err
+		replaced := len(rootFS.DiffIDs)
+		rootFS.DiffIDs = []digest.Digest{diffID}
+		if _, err := config.set("rootfs", rootFS, false); err != nil {
+			return err
 		}
 
-		platform := map[string]json.RawMessage{}
-		if err := json.Unmarshal(manifest_json["platform"], &platform); err != nil {
-			fmt.Println("error unmarshalling platform")
-			return nil, err
+		history, err := rewriteHistory(config, created, replaced, options)
+		if err != nil {
+			return err
 		}
-
-		// check if the platform is the same as the current machine's platform
-		// if it is, then we have found the manifest we want to use, so we retrieve
-		// the descriptor and load the manifest!
-
-		if string(platform["os"]) == `"`+os+`"` && strings.EqualFold(string(platform["architecture"]), `"`+arch+`"`) {
-			desc, err := GetDescriptor(manifest)
-			if err != nil {
-				return nil, err
-			}
-			return LoadManifestImpl(ctx, contentStore, desc)
+		if _, err := config.set("history", history, false); err != nil {
+			return err
 		}
-	}
-	return nil, fmt.Errorf("no manifest found for %s/%s", runtime.GOOS, runtime.GOARCH)
-}
 
-func (m *ManifestImpl) ReplaceWithLayer(ctx context.Context, contentStore content.Store, layer ocispec.Descriptor, imageConfig []byte) error {
-	d := m.D
-
-	// These builds can be done on docker images, or OCI image.
-	// Let's make sure the new layer uses the same content type as the manifest expects.
-	switch m.Desc.MediaType {
-	case images.MediaTypeDockerSchema2Manifest:
-		layer.MediaType = images.MediaTypeDockerSchema2LayerGzip
-	case ocispec.MediaTypeImageManifest:
-		layer.MediaType = ocispec.MediaTypeImageLayerGzip
-	default:
-		return fmt.Errorf("unknown parent image manifest type: %s", m.Desc.MediaType)
-	}
-
-	// Get the diffId for the diff descriptor.
-	info, err := contentStore.Info(ctx, layer.Digest)
-	if err != nil {
+		_, err = updated.SetLayers([]ocispec.Descriptor{layer})
 		return err
-	}
-	diffIDStr, ok := info.Labels[containerdUncompressed]
-	if !ok {
-		return fmt.Errorf("invalid differ response with no diffID")
-	}
-	diffIDDigest, err := digest.Parse(diffIDStr)
-	if err != nil {
-		return err
-	}
-
-	// Deserialize the image config
-	imageConfigDesc, err := GetDescriptor(d["config"])
-	if err != nil {
-		return err
-	}
+	})
+}
 
-	// Patch the config and store it in the content store.
-	imageConfigDesc, err = patchImageConfig(ctx, contentStore, imageConfigDesc, diffIDDigest, imageConfig)
-	if err != nil {
+// WriteBlob Write the blob read from r to the content store under the ingest
+// ref, and make sure it has labels even if it was already there, which
+// content.WriteBlob leaves alone.
+func WriteBlob(ctx context.Context, cs content.Store, ref string, r io.Reader, desc ocispec.Descriptor, labels map[string]string) error {
+	if err := content.WriteBlob(ctx, cs, ref, r, desc, content.WithLabels(labels)); err != nil {
 		return err
 	}
-
-	// Store the image config back into our json object.
-	imageConfigJSON, err := json.Marshal(imageConfigDesc)
-	if err != nil {
-		return err
+	if len(labels) == 0 {
+		return nil
 	}
-	d["config"] = imageConfigJSON
 
-	// Update the layers on the manifest.
-	layers := []ocispec.Descriptor{}
-	layersJSON, err := d["layers"].MarshalJSON()
+	info, err := cs.Info(ctx, desc.Digest)
 	if err != nil {
 		return err
 	}
-	if err = json.Unmarshal(layersJSON, &layers); err != nil {
-		return err
+	var fieldpaths []string
+	for k, v := range labels {
+		if info.Labels[k] != v {
+			fieldpaths = append(fieldpaths, "labels."+k)
+		}
 	}
-	layers = nil // IMPORTANT: clear the layers
-	layers = append(layers, layer)
-	layersJSON, err = json.Marshal(layers)
-	if err != nil {
-		return err
+	if len(fieldpaths) == 0 {
+		return nil
 	}
-	d["layers"] = layersJSON
+	info.Labels = labels
+	_, err = cs.Update(ctx, info, fieldpaths...)
+	return err
+}
 
-	// Now that we have all the data ready, let's try to store it.
-	// Prepare the labels that will tell the garbage collector
-	// to NOT delete the content this manifest references.
+// GCLabels The labels that keep the garbage collector from deleting the
+// config and layers while the manifest is stored.
+func (m *ImageManifest) GCLabels() map[string]string {
 	labels := map[string]string{
-		"containerd.io/gc.ref.content.0": imageConfigDesc.Digest.String(),
+		"containerd.io/gc.ref.content.0": m.Config().Digest.String(),
 	}
-	for i, layer := range layers {
+	for i, layer := range m.Layers() {
 		labels[fmt.Sprintf("containerd.io/gc.ref.content.%d", i+1)] = layer.Digest.String()
 	}
-
-	// Save our new image manifest, which now hows our new layer,
-	// and a patched image config with a reference to the new layer.
-	newDesc := m.Desc
-	manifestBytes, err := json.Marshal(d)
-	if err != nil {
-		return err
-	}
-	newDesc.Digest = digest.FromBytes(manifestBytes)
-	newDesc.Size = int64(len(manifestBytes))
-	if err := content.WriteBlob(ctx,
-		contentStore,
-		"custom-ref",
-		bytes.NewReader(manifestBytes),
-		newDesc,
-		content.WithLabels(labels)); err != nil {
-		return err
-	}
-
-	m.Desc = newDesc
-	m.D = d
-
-	return nil
+	return labels
 }
 
-func (m *ManifestImpl) Descriptor() ocispec.Descriptor {
-	return m.Desc
+// GCLabels The labels that keep the garbage collector from deleting the
+// manifests while the index is stored.
+func (idx *ImageIndex) GCLabels() map[string]string {
+	labels := map[string]string{}
+	for i, desc := range idx.Manifests() {
+		labels[fmt.Sprintf("containerd.io/gc.ref.content.%d", i)] = desc.Digest.String()
+	}
+	return labels
 }
 
-func patchImageConfig(ctx context.Context, contentStore content.Store, imageConfig ocispec.Descriptor, newLayer digest.Digest, imageConfigBytes []byte) (ocispec.Descriptor, error) {
-	result := imageConfig
+// rewriteHistory Make the history match the single reconstructed layer. The
+// original entries are kept for reference but marked as empty layers, and an
+// entry recording the reconstruction is appended for the new layer. Tools
+// pair non-empty entries with layers, so there must be exactly one.
+func rewriteHistory(config *document, created *time.Time, replaced int, options replaceOptions) ([]json.RawMessage, error) {
+	var entries []map[string]json.RawMessage
+	if err := config.decode("history", &entries); err != nil {
+		return nil, err
+	}
 
-	var p []byte
-	var err error
-	if imageConfigBytes == nil {
-		// Get the current image configuration.
-		p, err = content.ReadBlob(ctx, contentStore, imageConfig)
+	history := make([]json.RawMessage, 0, len(entries)+1)
+	for _, entry := range entries {
+		// Only empty_layer is touched, so fields we don't know survive.
+		entry["empty_layer"] = json.RawMessage("true")
+		p, err := json.Marshal(entry)
 		if err != nil {
-			return result, err
+			return nil, err
 		}
-	} else {
-		p = imageConfigBytes
-	}
-
-	// Deserialize the image configuration to a generic json object.
-	// We do this so that we can patch it, without requiring knowledge
-	// of the entire schema.
-	m := map[string]json.RawMessage{}
-	if err := json.Unmarshal(p, &m); err != nil {
-		return result, err
-	}
-
-	// Pull the rootfs section out, so that we can append a layer to the diff_ids array.
-	var rootFS ocispec.RootFS
-	p, err = m["rootfs"].MarshalJSON()
-	if err != nil {
-		return result, err
-	}
-	if err = json.Unmarshal(p, &rootFS); err != nil {
-		return result, err
-	}
-	rootFS.DiffIDs = nil // IMPORTANT: clear the diff_ids
-	rootFS.DiffIDs = append(rootFS.DiffIDs, newLayer)
-	p, err = json.Marshal(rootFS)
-	if err != nil {
-		return ocispec.Descriptor{}, err
-	}
-	m["rootfs"] = p
-
-	// Convert our entire image configuration back to bytes, and write it to the content store.
-	p, err = json.Marshal(m)
-	if err != nil {
-		return ocispec.Descriptor{}, err
+		history = append(history, p)
 	}
 
-	result.Digest = digest.FromBytes(p)
-	result.Size = int64(len(p))
-	err = content.WriteBlob(ctx, contentStore,
-		"custom-ref",
-		bytes.NewReader(p),
-		result,
-	)
-	if err != nil {
-		return result, err
+	createdBy := "cargosync: reconstructed as a single layer"
+	if options.base != "" {
+		createdBy += " from " + options.base
+		if options.baseDigest != "" {
+			createdBy += "@" + options.baseDigest.String()
+		}
 	}
-
-	return result, nil
-}
-
-func GetDescriptor(m json.RawMessage) (ocispec.Descriptor, error) {
-	var r ocispec.Descriptor
-	p, err := m.MarshalJSON()
+	p, err := json.Marshal(ocispec.History{
+		Created:   created,
+		CreatedBy: createdBy,
+		Comment:   fmt.Sprintf("replaces %d layer(s) of the original image", replaced),
+	})
 	if err != nil {
-		return r, err
-	}
-	if err = json.Unmarshal(p, &r); err != nil {
-		return r, err
+		return nil, err
 	}
-	return r, nil
+	return append(history, p), nil
 }
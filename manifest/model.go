@@ -0,0 +1,529 @@
+package manifest
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/images"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// document A JSON object whose fields are kept as raw JSON, in their original
+// order. Setting a field only re-encodes that field, so unknown fields, and
+// the known ones that weren't touched, are written back byte-for-byte.
+type document struct {
+	desc   ocispec.Descriptor
+	raw    []byte
+	keys   []string
+	fields map[string]json.RawMessage
+}
+
+func parseDocument(desc ocispec.Descriptor, p []byte) (document, error) {
+	if desc.Digest != "" {
+		if err := desc.Digest.Validate(); err != nil {
+			return document{}, err
+		}
+		if dgst := desc.Digest.Algorithm().FromBytes(p); dgst != desc.Digest {
+			return document{}, fmt.Errorf("content digest %s does not match descriptor %s", dgst, desc.Digest)
+		}
+	} else {
+		desc.Digest = digest.FromBytes(p)
+	}
+	desc.Size = int64(len(p))
+
+	d := document{
+		desc:   desc,
+		raw:    p,
+		fields: map[string]json.RawMessage{},
+	}
+	dec := json.NewDecoder(bytes.NewReader(p))
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('{') {
+		return document{}, fmt.Errorf("%s is not a JSON object", desc.Digest)
+	}
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return document{}, err
+		}
+		key := tok.(string)
+		var value json.RawMessage
+		if err := dec.Decode(&value); err != nil {
+			return document{}, err
+		}
+		if _, ok := d.fields[key]; !ok {
+			d.keys = append(d.keys, key)
+		}
+		d.fields[key] = value
+	}
+	if _, err := dec.Token(); err != nil {
+		return document{}, err
+	}
+	// The raw bytes are kept and re-served, so nothing may follow the
+	// object but whitespace.
+	if _, err := dec.Token(); err != io.EOF {
+		return document{}, fmt.Errorf("%s has data after the JSON object", desc.Digest)
+	}
+	return d, nil
+}
+
+// decode Unmarshal field key into v. Missing fields leave v untouched.
+func (d *document) decode(key string, v interface{}) error {
+	raw, ok := d.fields[key]
+	if !ok {
+		return nil
+	}
+	if err := json.Unmarshal(raw, v); err != nil {
+		return fmt.Errorf("error decoding %q of %s: %w", key, d.desc.Digest, err)
+	}
+	return nil
+}
+
+// set Replace field key with v, or remove it if omit is true, and return the
+// new descriptor of the document.
+func (d *document) set(key string, v interface{}, omit bool) (ocispec.Descriptor, error) {
+	if omit {
+		if _, ok := d.fields[key]; !ok {
+			return d.desc, nil
+		}
+		delete(d.fields, key)
+		for i, k := range d.keys {
+			if k == key {
+				d.keys = append(d.keys[:i:i], d.keys[i+1:]...)
+				break
+			}
+		}
+		return d.update()
+	}
+
+	raw, ok := v.(json.RawMessage)
+	if !ok {
+		var err error
+		if raw, err = json.Marshal(v); err != nil {
+			return ocispec.Descriptor{}, err
+		}
+	}
+	if _, ok := d.fields[key]; !ok {
+		d.keys = append(d.keys, key)
+	}
+	d.fields[key] = raw
+	return d.update()
+}
+
+func (d *document) update() (ocispec.Descriptor, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, key := range d.keys {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		k, err := json.Marshal(key)
+		if err != nil {
+			return ocispec.Descriptor{}, err
+		}
+		buf.Write(k)
+		buf.WriteByte(':')
+		buf.Write(d.fields[key])
+	}
+	buf.WriteByte('}')
+
+	d.raw = buf.Bytes()
+	d.desc.Digest = digest.FromBytes(d.raw)
+	d.desc.Size = int64(len(d.raw))
+	return d.desc, nil
+}
+
+func (d document) clone() document {
+	c := d
+	c.keys = append([]string(nil), d.keys...)
+	c.fields = make(map[string]json.RawMessage, len(d.fields))
+	for k, v := range d.fields {
+		c.fields[k] = v
+	}
+	return c
+}
+
+// Descriptor The descriptor of the current contents.
+func (d *document) Descriptor() ocispec.Descriptor {
+	return d.desc
+}
+
+// Bytes The current contents, which the descriptor was computed from.
+func (d *document) Bytes() []byte {
+	return d.raw
+}
+
+// ArtifactType The artifactType, empty for images.
+func (d *document) ArtifactType() string {
+	var s string
+	_ = d.decode("artifactType", &s)
+	return s
+}
+
+// SetArtifactType Set the artifactType, removing it if empty.
+func (d *document) SetArtifactType(artifactType string) (ocispec.Descriptor, error) {
+	return d.set("artifactType", artifactType, artifactType == "")
+}
+
+// rawDescriptor A descriptor together with the JSON it was decoded from, so
+// unchanged descriptors keep any fields ocispec.Descriptor doesn't know.
+type rawDescriptor struct {
+	desc ocispec.Descriptor
+	raw  json.RawMessage
+}
+
+func decodeDescriptors(d *document, key string) ([]rawDescriptor, error) {
+	var raws []json.RawMessage
+	if err := d.decode(key, &raws); err != nil {
+		return nil, err
+	}
+	descs := make([]rawDescriptor, 0, len(raws))
+	for _, raw := range raws {
+		var desc ocispec.Descriptor
+		if err := json.Unmarshal(raw, &desc); err != nil {
+			return nil, fmt.Errorf("error decoding %q of %s: %w", key, d.desc.Digest, err)
+		}
+		descs = append(descs, rawDescriptor{desc: desc, raw: raw})
+	}
+	return descs, nil
+}
+
+func decodeDescriptor(d *document, key string) (*rawDescriptor, error) {
+	raw, ok := d.fields[key]
+	if !ok || string(raw) == "null" {
+		return nil, nil
+	}
+	var desc ocispec.Descriptor
+	if err := d.decode(key, &desc); err != nil {
+		return nil, err
+	}
+	return &rawDescriptor{desc: desc, raw: raw}, nil
+}
+
+// encodeDescriptor Reuse the original JSON of desc if it wasn't changed.
+func encodeDescriptor(desc ocispec.Descriptor, prev []rawDescriptor) (rawDescriptor, error) {
+	for _, p := range prev {
+		if reflect.DeepEqual(p.desc, desc) {
+			return p, nil
+		}
+	}
+	raw, err := json.Marshal(desc)
+	if err != nil {
+		return rawDescriptor{}, err
+	}
+	return rawDescriptor{desc: desc, raw: raw}, nil
+}
+
+func encodeDescriptors(descs []ocispec.Descriptor, prev []rawDescriptor) ([]rawDescriptor, json.RawMessage, error) {
+	result := make([]rawDescriptor, 0, len(descs))
+	var buf bytes.Buffer
+	buf.WriteByte('[')
+	for i, desc := range descs {
+		r, err := encodeDescriptor(desc, prev)
+		if err != nil {
+			return nil, nil, err
+		}
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		buf.Write(r.raw)
+		result = append(result, r)
+	}
+	buf.WriteByte(']')
+	return result, buf.Bytes(), nil
+}
+
+func descriptorsOf(raws []rawDescriptor) []ocispec.Descriptor {
+	descs := make([]ocispec.Descriptor, 0, len(raws))
+	for _, r := range raws {
+		descs = append(descs, r.desc)
+	}
+	return descs
+}
+
+func sameDescriptors(raws []rawDescriptor, descs []ocispec.Descriptor) bool {
+	if len(raws) != len(descs) {
+		return false
+	}
+	for i := range descs {
+		if !reflect.DeepEqual(raws[i].desc, descs[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func copyAnnotations(annotations map[string]string) map[string]string {
+	if annotations == nil {
+		return nil
+	}
+	c := make(map[string]string, len(annotations))
+	for k, v := range annotations {
+		c[k] = v
+	}
+	return c
+}
+
+// ImageManifest A Docker schema2 or OCI image manifest. Mutations return the
+// new descriptor of the manifest; nothing is written to a content store.
+type ImageManifest struct {
+	document
+	config      rawDescriptor
+	layers      []rawDescriptor
+	subject     *rawDescriptor
+	annotations map[string]string
+}
+
+// ParseManifest Decode the manifest p, described by desc. If desc has a
+// digest, p must match it.
+func ParseManifest(desc ocispec.Descriptor, p []byte) (*ImageManifest, error) {
+	d, err := parseDocument(desc, p)
+	if err != nil {
+		return nil, err
+	}
+	if d.desc.MediaType == "" {
+		_ = d.decode("mediaType", &d.desc.MediaType)
+	}
+	if d.desc.MediaType == images.MediaTypeDockerSchema1Manifest {
+		return nil, fmt.Errorf("%s is a schema1 manifest, which must be converted with ConvertSchema1: %w", d.desc.Digest, errdefs.ErrNotImplemented)
+	}
+	if !images.IsManifestType(d.desc.MediaType) {
+		return nil, fmt.Errorf("%s is not an image manifest: media type %q", d.desc.Digest, d.desc.MediaType)
+	}
+
+	m := &ImageManifest{document: d}
+	config, err := decodeDescriptor(&m.document, "config")
+	if err != nil {
+		return nil, err
+	}
+	if config == nil {
+		return nil, fmt.Errorf("manifest %s has no config", d.desc.Digest)
+	}
+	m.config = *config
+	if m.layers, err = decodeDescriptors(&m.document, "layers"); err != nil {
+		return nil, err
+	}
+	if m.subject, err = decodeDescriptor(&m.document, "subject"); err != nil {
+		return nil, err
+	}
+	if err := m.decode("annotations", &m.annotations); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// LoadImageManifest Read and decode the manifest desc from a content store.
+func LoadImageManifest(ctx context.Context, provider content.Provider, desc ocispec.Descriptor) (*ImageManifest, error) {
+	p, err := content.ReadBlob(ctx, provider, desc)
+	if err != nil {
+		return nil, err
+	}
+	return ParseManifest(desc, p)
+}
+
+func (m *ImageManifest) clone() *ImageManifest {
+	c := *m
+	c.document = m.document.clone()
+	c.layers = append([]rawDescriptor(nil), m.layers...)
+	c.annotations = copyAnnotations(m.annotations)
+	return &c
+}
+
+// Config The descriptor of the image config.
+func (m *ImageManifest) Config() ocispec.Descriptor {
+	return m.config.desc
+}
+
+// SetConfig Point the manifest at another image config.
+func (m *ImageManifest) SetConfig(config ocispec.Descriptor) (ocispec.Descriptor, error) {
+	r, err := encodeDescriptor(config, []rawDescriptor{m.config})
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	if bytes.Equal(r.raw, m.config.raw) {
+		return m.desc, nil
+	}
+	m.config = r
+	return m.set("config", r.raw, false)
+}
+
+// setMediaType Change the media type of the manifest, in its descriptor and
+// its mediaType field.
+func (m *ImageManifest) setMediaType(mediaType string) (ocispec.Descriptor, error) {
+	m.desc.MediaType = mediaType
+	return m.set("mediaType", mediaType, false)
+}
+
+// Layers The layer descriptors, base layer first.
+func (m *ImageManifest) Layers() []ocispec.Descriptor {
+	return descriptorsOf(m.layers)
+}
+
+// SetLayers Replace the layer descriptors.
+func (m *ImageManifest) SetLayers(layers []ocispec.Descriptor) (ocispec.Descriptor, error) {
+	if sameDescriptors(m.layers, layers) {
+		return m.desc, nil
+	}
+	result, raw, err := encodeDescriptors(layers, m.layers)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	m.layers = result
+	return m.set("layers", raw, false)
+}
+
+// Subject The manifest this one refers to, or nil.
+func (m *ImageManifest) Subject() *ocispec.Descriptor {
+	if m.subject == nil {
+		return nil
+	}
+	desc := m.subject.desc
+	return &desc
+}
+
+// SetSubject Set the subject, removing it if nil.
+func (m *ImageManifest) SetSubject(subject *ocispec.Descriptor) (ocispec.Descriptor, error) {
+	if subject == nil {
+		m.subject = nil
+		return m.set("subject", nil, true)
+	}
+	var prev []rawDescriptor
+	if m.subject != nil {
+		prev = append(prev, *m.subject)
+	}
+	r, err := encodeDescriptor(*subject, prev)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	if m.subject != nil && bytes.Equal(r.raw, m.subject.raw) {
+		return m.desc, nil
+	}
+	m.subject = &r
+	return m.set("subject", r.raw, false)
+}
+
+// Annotations A copy of the manifest annotations.
+func (m *ImageManifest) Annotations() map[string]string {
+	return copyAnnotations(m.annotations)
+}
+
+// SetAnnotations Replace the annotations, removing them if empty.
+func (m *ImageManifest) SetAnnotations(annotations map[string]string) (ocispec.Descriptor, error) {
+	if reflect.DeepEqual(annotations, m.annotations) {
+		return m.desc, nil
+	}
+	m.annotations = copyAnnotations(annotations)
+	return m.set("annotations", annotations, len(annotations) == 0)
+}
+
+// ImageIndex A Docker manifest list or OCI image index.
+type ImageIndex struct {
+	document
+	manifests   []rawDescriptor
+	subject     *rawDescriptor
+	annotations map[string]string
+}
+
+// ParseIndex Decode the index p, described by desc. If desc has a digest, p
+// must match it.
+func ParseIndex(desc ocispec.Descriptor, p []byte) (*ImageIndex, error) {
+	d, err := parseDocument(desc, p)
+	if err != nil {
+		return nil, err
+	}
+	if d.desc.MediaType == "" {
+		_ = d.decode("mediaType", &d.desc.MediaType)
+	}
+	if !images.IsIndexType(d.desc.MediaType) {
+		return nil, fmt.Errorf("%s is not an index: media type %q", d.desc.Digest, d.desc.MediaType)
+	}
+
+	idx := &ImageIndex{document: d}
+	if idx.manifests, err = decodeDescriptors(&idx.document, "manifests"); err != nil {
+		return nil, err
+	}
+	if idx.subject, err = decodeDescriptor(&idx.document, "subject"); err != nil {
+		return nil, err
+	}
+	if err := idx.decode("annotations", &idx.annotations); err != nil {
+		return nil, err
+	}
+	return idx, nil
+}
+
+// LoadImageIndex Read and decode the index desc from a content store.
+func LoadImageIndex(ctx context.Context, provider content.Provider, desc ocispec.Descriptor) (*ImageIndex, error) {
+	p, err := content.ReadBlob(ctx, provider, desc)
+	if err != nil {
+		return nil, err
+	}
+	return ParseIndex(desc, p)
+}
+
+// Manifests The descriptors of the manifests and nested indexes.
+func (idx *ImageIndex) Manifests() []ocispec.Descriptor {
+	return descriptorsOf(idx.manifests)
+}
+
+// SetManifests Replace the manifest descriptors.
+func (idx *ImageIndex) SetManifests(manifests []ocispec.Descriptor) (ocispec.Descriptor, error) {
+	if sameDescriptors(idx.manifests, manifests) {
+		return idx.desc, nil
+	}
+	result, raw, err := encodeDescriptors(manifests, idx.manifests)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	idx.manifests = result
+	return idx.set("manifests", raw, false)
+}
+
+// Subject The manifest this index refers to, or nil.
+func (idx *ImageIndex) Subject() *ocispec.Descriptor {
+	if idx.subject == nil {
+		return nil
+	}
+	desc := idx.subject.desc
+	return &desc
+}
+
+// SetSubject Set the subject, removing it if nil.
+func (idx *ImageIndex) SetSubject(subject *ocispec.Descriptor) (ocispec.Descriptor, error) {
+	if subject == nil {
+		idx.subject = nil
+		return idx.set("subject", nil, true)
+	}
+	var prev []rawDescriptor
+	if idx.subject != nil {
+		prev = append(prev, *idx.subject)
+	}
+	r, err := encodeDescriptor(*subject, prev)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	if idx.subject != nil && bytes.Equal(r.raw, idx.subject.raw) {
+		return idx.desc, nil
+	}
+	idx.subject = &r
+	return idx.set("subject", r.raw, false)
+}
+
+// Annotations A copy of the index annotations.
+func (idx *ImageIndex) Annotations() map[string]string {
+	return copyAnnotations(idx.annotations)
+}
+
+// SetAnnotations Replace the annotations, removing them if empty.
+func (idx *ImageIndex) SetAnnotations(annotations map[string]string) (ocispec.Descriptor, error) {
+	if reflect.DeepEqual(annotations, idx.annotations) {
+		return idx.desc, nil
+	}
+	idx.annotations = copyAnnotations(annotations)
+	return idx.set("annotations", annotations, len(annotations) == 0)
+}
@@ -0,0 +1,253 @@
+package manifest
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/containerd/containerd/images"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// The documents are written the way registries and other tools may serve
+// them: with indentation, fields in no particular order, fields this
+// package doesn't know, and escapes encoding/json wouldn't produce.
+
+const ociManifest = `{
+   "schemaVersion": 2,
+   "mediaType": "application/vnd.oci.image.manifest.v1+json",
+   "x-vendor": {"build": 42, "tags": ["a", "b"]},
+   "config": {
+      "mediaType": "application/vnd.oci.image.config.v1+json",
+      "size": 1470,
+      "digest": "sha256:1111111111111111111111111111111111111111111111111111111111111111",
+      "x-descriptor-extra": true
+   },
+   "layers": [
+      {
+         "mediaType": "application/vnd.oci.image.layer.v1.tar+gzip",
+         "size": 3370706,
+         "digest": "sha256:2222222222222222222222222222222222222222222222222222222222222222",
+         "annotations": {"org.example.note": "caf\u00e9 \u003c3"}
+      },
+      {
+         "mediaType": "application/vnd.oci.image.layer.v1.tar+gzip",
+         "size": 1024,
+         "digest": "sha256:3333333333333333333333333333333333333333333333333333333333333333"
+      }
+   ],
+   "annotations": {
+      "org.opencontainers.image.created": "2023-09-01T00:00:00Z"
+   }
+}`
+
+const dockerManifest = `{"schemaVersion":2,"mediaType":"application/vnd.docker.distribution.manifest.v2+json","config":{"mediaType":"application/vnd.docker.container.image.v1+json","size":7023,"digest":"sha256:4444444444444444444444444444444444444444444444444444444444444444"},"layers":[{"mediaType":"application/vnd.docker.image.rootfs.diff.tar.gzip","size":32654,"digest":"sha256:5555555555555555555555555555555555555555555555555555555555555555","urls":["https://example.com/layer"]}],"x-extra":[1,2.50,null]}`
+
+const ociIndex = `{
+  "schemaVersion": 2,
+  "mediaType": "application/vnd.oci.image.index.v1+json",
+  "manifests": [
+    {
+      "mediaType": "application/vnd.oci.image.manifest.v1+json",
+      "size": 7143,
+      "digest": "sha256:6666666666666666666666666666666666666666666666666666666666666666",
+      "platform": {"architecture": "arm64", "os": "linux", "variant": "v8"},
+      "x-descriptor-extra": {"nested": "yes"}
+    },
+    {
+      "mediaType": "application/vnd.oci.image.manifest.v1+json",
+      "size": 7682,
+      "digest": "sha256:7777777777777777777777777777777777777777777777777777777777777777",
+      "platform": {"architecture": "amd64", "os": "linux"}
+    }
+  ],
+  "x-unknown": "kept",
+  "annotations": {"com.example.key": "value"}
+}`
+
+const dockerList = `{"manifests":[{"digest":"sha256:8888888888888888888888888888888888888888888888888888888888888888","mediaType":"application/vnd.docker.distribution.manifest.v2+json","platform":{"architecture":"amd64","os":"linux"},"size":528}],"mediaType":"application/vnd.docker.distribution.manifest.list.v2+json","schemaVersion":2}`
+
+func TestManifestRoundTrip(t *testing.T) {
+	for name, p := range map[string]string{
+		"oci":    ociManifest,
+		"docker": dockerManifest,
+	} {
+		t.Run(name, func(t *testing.T) {
+			dgst := digest.FromString(p)
+			m, err := ParseManifest(ocispec.Descriptor{Digest: dgst}, []byte(p))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(m.Bytes(), []byte(p)) {
+				t.Fatalf("Bytes() changed the manifest:\n%s", m.Bytes())
+			}
+
+			// Setting what is already there must not re-encode anything.
+			for _, set := range []func() (ocispec.Descriptor, error){
+				func() (ocispec.Descriptor, error) { return m.SetConfig(m.Config()) },
+				func() (ocispec.Descriptor, error) { return m.SetLayers(m.Layers()) },
+				func() (ocispec.Descriptor, error) { return m.SetSubject(m.Subject()) },
+				func() (ocispec.Descriptor, error) { return m.SetAnnotations(m.Annotations()) },
+				func() (ocispec.Descriptor, error) { return m.SetArtifactType(m.ArtifactType()) },
+			} {
+				desc, err := set()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if desc.Digest != dgst {
+					t.Fatalf("digest changed to %s, want %s:\n%s", desc.Digest, dgst, m.Bytes())
+				}
+			}
+			if !bytes.Equal(m.Bytes(), []byte(p)) {
+				t.Errorf("setters changed the manifest:\n%s", m.Bytes())
+			}
+
+			// Decoding what was stored must give the same manifest.
+			again, err := ParseManifest(m.Descriptor(), m.Bytes())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if again.Descriptor().Digest != dgst {
+				t.Errorf("re-parsed digest = %s, want %s", again.Descriptor().Digest, dgst)
+			}
+		})
+	}
+}
+
+func TestManifestEditKeepsUnknownFields(t *testing.T) {
+	m, err := ParseManifest(ocispec.Descriptor{}, []byte(ociManifest))
+	if err != nil {
+		t.Fatal(err)
+	}
+	layers := m.Layers()
+	top := ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageLayerGzip,
+		Digest:    digest.FromString("new layer"),
+		Size:      9,
+	}
+	desc, err := m.SetLayers(append(layers[:1], top))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if desc.Digest != digest.FromBytes(m.Bytes()) || desc.Size != int64(len(m.Bytes())) {
+		t.Errorf("descriptor %v doesn't match the contents", desc)
+	}
+
+	got := string(m.Bytes())
+	for _, want := range []string{
+		// unknown fields, as they were
+		`"x-vendor":{"build": 42, "tags": ["a", "b"]}`,
+		`"x-descriptor-extra": true`,
+		// the untouched layer keeps its original encoding
+		`"annotations": {"org.example.note": "caf\u00e9 \u003c3"}`,
+		`"sha256:` + top.Digest.Encoded() + `"`,
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("manifest lacks %s:\n%s", want, got)
+		}
+	}
+	if strings.Contains(got, "3333333333") {
+		t.Errorf("replaced layer is still in the manifest:\n%s", got)
+	}
+	// Fields keep their order.
+	if i, j := strings.Index(got, `"x-vendor"`), strings.Index(got, `"layers"`); i < 0 || j < i {
+		t.Errorf("fields were reordered:\n%s", got)
+	}
+
+	if _, err := m.SetAnnotations(nil); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(m.Bytes()), `"annotations":{"org.opencontainers`) || strings.Contains(string(m.Bytes()), "org.opencontainers.image.created") {
+		t.Errorf("annotations weren't removed:\n%s", m.Bytes())
+	}
+}
+
+func TestIndexRoundTrip(t *testing.T) {
+	for name, p := range map[string]string{
+		"oci":    ociIndex,
+		"docker": dockerList,
+	} {
+		t.Run(name, func(t *testing.T) {
+			dgst := digest.FromString(p)
+			idx, err := ParseIndex(ocispec.Descriptor{Digest: dgst}, []byte(p))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := idx.SetManifests(idx.Manifests()); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := idx.SetAnnotations(idx.Annotations()); err != nil {
+				t.Fatal(err)
+			}
+			if idx.Descriptor().Digest != dgst || !bytes.Equal(idx.Bytes(), []byte(p)) {
+				t.Errorf("index changed to %s:\n%s", idx.Descriptor().Digest, idx.Bytes())
+			}
+		})
+	}
+}
+
+func TestIndexEditKeepsUnknownFields(t *testing.T) {
+	idx, err := ParseIndex(ocispec.Descriptor{}, []byte(ociIndex))
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifests := idx.Manifests()
+	manifests[1].Digest = digest.FromString("rebuilt")
+	if _, err := idx.SetManifests(manifests); err != nil {
+		t.Fatal(err)
+	}
+	got := string(idx.Bytes())
+	for _, want := range []string{
+		`"x-unknown":"kept"`,
+		`"x-descriptor-extra": {"nested": "yes"}`,
+		`"sha256:` + manifests[1].Digest.Encoded() + `"`,
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("index lacks %s:\n%s", want, got)
+		}
+	}
+	if idx.Descriptor().MediaType != ocispec.MediaTypeImageIndex {
+		t.Errorf("media type = %s", idx.Descriptor().MediaType)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		desc ocispec.Descriptor
+		p    string
+		want string
+	}{
+		{"digest mismatch", ocispec.Descriptor{Digest: digest.FromString("other")}, ociManifest, "does not match"},
+		{"invalid digest", ocispec.Descriptor{Digest: "sha256:xyz"}, ociManifest, "invalid"},
+		{"not an object", ocispec.Descriptor{}, `["schemaVersion"]`, "not a JSON object"},
+		{"truncated", ocispec.Descriptor{}, ociManifest[:100], "unexpected EOF"},
+		{"trailing garbage", ocispec.Descriptor{}, ociManifest + "garbage", "data after the JSON object"},
+		{"second object", ocispec.Descriptor{}, ociManifest + "\n{}", "data after the JSON object"},
+		{"trailing brace", ocispec.Descriptor{}, ociManifest + "}", "data after the JSON object"},
+		{"index", ocispec.Descriptor{}, ociIndex, "not an image manifest"},
+		{"schema1", ocispec.Descriptor{MediaType: images.MediaTypeDockerSchema1Manifest}, `{"schemaVersion":1}`, "ConvertSchema1"},
+		{"no config", ocispec.Descriptor{}, `{"mediaType":"application/vnd.oci.image.manifest.v1+json","layers":[]}`, "has no config"},
+		{"bad layers", ocispec.Descriptor{}, `{"mediaType":"application/vnd.oci.image.manifest.v1+json","config":{},"layers":{}}`, "error decoding \"layers\""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseManifest(tt.desc, []byte(tt.p))
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("ParseManifest() error = %v, want one containing %q", err, tt.want)
+			}
+		})
+	}
+
+	if _, err := ParseIndex(ocispec.Descriptor{}, []byte(ociManifest)); err == nil || !strings.Contains(err.Error(), "not an index") {
+		t.Errorf("ParseIndex() of a manifest error = %v", err)
+	}
+	if _, err := ParseIndex(ocispec.Descriptor{}, []byte(ociIndex+"garbage")); err == nil || !strings.Contains(err.Error(), "data after the JSON object") {
+		t.Errorf("ParseIndex() with trailing data error = %v", err)
+	}
+	// Trailing whitespace, a newline in particular, is common and harmless.
+	if _, err := ParseManifest(ocispec.Descriptor{}, []byte(ociManifest+"\n \t")); err != nil {
+		t.Errorf("ParseManifest() with trailing whitespace: %v", err)
+	}
+}
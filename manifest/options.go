@@ -0,0 +1,122 @@
+package manifest
+
+import (
+	"fmt"
+	"time"
+
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// ReplaceOpt Options for the changes to a Manifest.
+type ReplaceOpt func(*replaceOptions)
+
+type replaceOptions struct {
+	base       string
+	baseDigest digest.Digest
+	created    CreatedPolicy
+	// merged into the annotations of OCI manifests
+	annotations map[string]string
+	// ingest ref prefix and lease for the written blobs
+	ref   string
+	lease string
+	// history entries of the layers added by ReplaceLayers
+	history []ocispec.History
+	// format the manifest is converted to first
+	format Format
+}
+
+// ingestRef The ingest ref for writing the kind of blob with digest dgst.
+// Without a caller prefix the ref is derived from the digest, so writers of
+// different content never share an ingest, and writers of the same content
+// wait for each other.
+func (o replaceOptions) ingestRef(kind string, dgst digest.Digest) string {
+	if o.ref != "" {
+		return o.ref + "-" + kind
+	}
+	return "cargosync-" + kind + "-" + dgst.Encoded()
+}
+
+// WithBase Record the image the layer was reconstructed from in the history.
+func WithBase(ref string, dgst digest.Digest) ReplaceOpt {
+	return func(o *replaceOptions) {
+		o.base = ref
+		o.baseDigest = dgst
+	}
+}
+
+// WithCreated Choose the created time of the patched config with policy.
+func WithCreated(policy CreatedPolicy) ReplaceOpt {
+	return func(o *replaceOptions) {
+		o.created = policy
+	}
+}
+
+// WithAnnotations Add annotations to the manifest, if it is an OCI one.
+func WithAnnotations(annotations map[string]string) ReplaceOpt {
+	return func(o *replaceOptions) {
+		o.annotations = annotations
+	}
+}
+
+// WithIngestRef Write the blobs under ingest refs starting with ref, which
+// must be unique to the reconstruction.
+func WithIngestRef(ref string) ReplaceOpt {
+	return func(o *replaceOptions) {
+		o.ref = ref
+	}
+}
+
+// WithLease Write the blobs under the lease with the given ID, for callers
+// whose context doesn't carry one. The blobs are only kept until the lease
+// is deleted, so the caller must reference the manifest before that.
+func WithLease(id string) ReplaceOpt {
+	return func(o *replaceOptions) {
+		o.lease = id
+	}
+}
+
+// WithHistory Record entries in the history for the layers added by
+// ReplaceLayers or AppendLayer, one for each layer.
+func WithHistory(entries ...ocispec.History) ReplaceOpt {
+	return func(o *replaceOptions) {
+		o.history = entries
+	}
+}
+
+// WithFormat Convert the manifest to format f before changing it.
+func WithFormat(f Format) ReplaceOpt {
+	return func(o *replaceOptions) {
+		o.format = f
+	}
+}
+
+// CreatedPolicy Decide the created time of a patched image config, given the
+// one of the original config, which may be nil.
+type CreatedPolicy func(original *time.Time) *time.Time
+
+// ParseCreatedPolicy Parse a created policy:
+//   - "keep" keeps the created time of the target image, so the same update
+//     reconstructs the same config everywhere;
+//   - "now" uses the time of the reconstruction;
+//   - an RFC 3339 time uses that time, for example for reproducible builds.
+func ParseCreatedPolicy(s string) (CreatedPolicy, error) {
+	switch s {
+	case "", "keep":
+		return func(original *time.Time) *time.Time {
+			return original
+		}, nil
+	case "now":
+		return func(*time.Time) *time.Time {
+			t := time.Now().UTC()
+			return &t
+		}, nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid created policy %q: must be keep, now or an RFC 3339 time", s)
+	}
+	return func(*time.Time) *time.Time {
+		return &t
+	}, nil
+}
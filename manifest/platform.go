@@ -0,0 +1,157 @@
+package manifest
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/platforms"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Indexes nested deeper than this are rejected, which also guards against
+// cycles in malicious content.
+const maxIndexDepth = 8
+
+// ResolvePlatform Find the manifest best matching platform.
+// desc can be a manifest, which is returned as-is if its config is for a
+// matching platform, or a Docker manifest list or OCI image index, possibly
+// nesting further indexes. Entries are matched
+// with containerd's platform matchers, so compatible variants (arm/v6 on an
+// arm/v7 host) are accepted when there is no exact match. If platform has an
+// OSVersion, entries for a different OS build are skipped. Entries without a
+// platform, like attestation manifests, are ignored.
+func ResolvePlatform(ctx context.Context, provider content.Provider, desc ocispec.Descriptor, platform ocispec.Platform) (ocispec.Descriptor, error) {
+	m := newPlatformMatcher(platform)
+	if images.IsManifestType(desc.MediaType) {
+		if err := checkConfigPlatform(ctx, provider, desc, m, platform); err != nil {
+			return ocispec.Descriptor{}, err
+		}
+		return desc, nil
+	}
+	best, ok, err := resolvePlatform(ctx, provider, desc, m, 0)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	if !ok {
+		return ocispec.Descriptor{}, fmt.Errorf("no manifest found for %s in %s: %w", platforms.Format(platform), desc.Digest, errdefs.ErrNotFound)
+	}
+	return best, nil
+}
+
+func resolvePlatform(ctx context.Context, provider content.Provider, desc ocispec.Descriptor, m platformMatcher, depth int) (ocispec.Descriptor, bool, error) {
+	switch {
+	case images.IsManifestType(desc.MediaType):
+		return desc, true, nil
+	case images.IsIndexType(desc.MediaType):
+	default:
+		return ocispec.Descriptor{}, false, fmt.Errorf("unsupported media type %q for %s: %w", desc.MediaType, desc.Digest, errdefs.ErrNotImplemented)
+	}
+	if depth >= maxIndexDepth {
+		return ocispec.Descriptor{}, false, fmt.Errorf("index %s is nested too deeply", desc.Digest)
+	}
+
+	index, err := LoadImageIndex(ctx, provider, desc)
+	if err != nil {
+		return ocispec.Descriptor{}, false, err
+	}
+
+	var (
+		best  ocispec.Descriptor
+		found bool
+	)
+	for _, child := range index.Manifests() {
+		if images.IsIndexType(child.MediaType) {
+			// A nested index can be restricted to a platform of its own;
+			// if so, skip it when that doesn't match.
+			if child.Platform != nil && !m.Match(*child.Platform) {
+				continue
+			}
+			nested, ok, err := resolvePlatform(ctx, provider, child, m, depth+1)
+			if err != nil {
+				return ocispec.Descriptor{}, false, err
+			}
+			if ok && (!found || m.Less(*nested.Platform, *best.Platform)) {
+				best, found = nested, true
+			}
+			continue
+		}
+		if !images.IsManifestType(child.MediaType) || child.Platform == nil || !m.Match(*child.Platform) {
+			continue
+		}
+		if !found || m.Less(*child.Platform, *best.Platform) {
+			best, found = child, true
+		}
+	}
+	return best, found, nil
+}
+
+// checkConfigPlatform Fail unless the config of the manifest desc is for a
+// platform m accepts. A manifest that isn't in an index names no platform
+// of its own, so its config is all there is to go by.
+func checkConfigPlatform(ctx context.Context, provider content.Provider, desc ocispec.Descriptor, m platformMatcher, platform ocispec.Platform) error {
+	im, err := LoadImageManifest(ctx, provider, desc)
+	if err != nil {
+		return err
+	}
+	p, err := content.ReadBlob(ctx, provider, im.Config())
+	if err != nil {
+		return fmt.Errorf("error reading config of %s: %w", desc.Digest, err)
+	}
+	var config ocispec.Image
+	if err := json.Unmarshal(p, &config); err != nil {
+		return fmt.Errorf("error decoding config of %s: %w", desc.Digest, err)
+	}
+	configPlatform := platforms.Normalize(config.Platform)
+	if !m.Match(configPlatform) {
+		return fmt.Errorf("manifest %s is for %s, not %s: %w", desc.Digest, platforms.Format(configPlatform), platforms.Format(platform), errdefs.ErrNotFound)
+	}
+	return nil
+}
+
+// platformMatcher extends containerd's matchers with os.version, which they
+// only consider on Windows hosts.
+type platformMatcher struct {
+	platforms.MatchComparer
+	osVersion string
+}
+
+func newPlatformMatcher(platform ocispec.Platform) platformMatcher {
+	return platformMatcher{
+		MatchComparer: platforms.Only(platform),
+		osVersion:     platform.OSVersion,
+	}
+}
+
+func (m platformMatcher) Match(platform ocispec.Platform) bool {
+	if !m.MatchComparer.Match(platform) {
+		return false
+	}
+	return m.osVersion == "" || platform.OSVersion == "" || osBuild(platform.OSVersion) == osBuild(m.osVersion)
+}
+
+// Less orders platforms by containerd's preference, then prefers an exact
+// os.version over a compatible one.
+func (m platformMatcher) Less(a, b ocispec.Platform) bool {
+	if m.MatchComparer.Less(a, b) {
+		return true
+	}
+	if m.MatchComparer.Less(b, a) {
+		return false
+	}
+	return m.osVersion != "" && a.OSVersion == m.osVersion && b.OSVersion != m.osVersion
+}
+
+// osBuild returns the major.minor.build part of an os.version; images for
+// the same build run regardless of the revision.
+func osBuild(osVersion string) string {
+	parts := strings.SplitN(osVersion, ".", 4)
+	if len(parts) > 3 {
+		parts = parts[:3]
+	}
+	return strings.Join(parts, ".")
+}
@@ -0,0 +1,293 @@
+package manifest
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/images"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// platformManifest returns an index entry for a manifest built for
+// platform, written as os/arch[/variant][:os.version]. The manifest itself
+// is never read, so it isn't stored.
+func platformManifest(platform string) ocispec.Descriptor {
+	name, osVersion, _ := strings.Cut(platform, ":")
+	parts := strings.Split(name, "/")
+	p := &ocispec.Platform{OS: parts[0], Architecture: parts[1], OSVersion: osVersion}
+	if len(parts) > 2 {
+		p.Variant = parts[2]
+	}
+	return ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageManifest,
+		Digest:    digest.FromString(platform),
+		Size:      1,
+		Platform:  p,
+	}
+}
+
+// attestation returns an index entry without a platform, like the
+// attestation manifests of BuildKit.
+func attestation() ocispec.Descriptor {
+	return ocispec.Descriptor{
+		MediaType:   ocispec.MediaTypeImageManifest,
+		Digest:      digest.FromString("attestation"),
+		Size:        1,
+		Annotations: map[string]string{"vnd.docker.reference.type": "attestation-manifest"},
+	}
+}
+
+func writeIndex(t *testing.T, ctx context.Context, cs content.Store, mediaType string, manifests ...ocispec.Descriptor) ocispec.Descriptor {
+	t.Helper()
+	return writeJSON(t, ctx, cs, mediaType, ocispec.Index{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: mediaType,
+		Manifests: manifests,
+	})
+}
+
+func TestResolvePlatform(t *testing.T) {
+	tests := []struct {
+		name      string
+		manifests []string
+		platform  ocispec.Platform
+		want      string
+	}{
+		{
+			name:      "exact match",
+			manifests: []string{"linux/amd64", "linux/arm64/v8", "linux/arm/v7"},
+			platform:  ocispec.Platform{OS: "linux", Architecture: "arm64", Variant: "v8"},
+			want:      "linux/arm64/v8",
+		},
+		{
+			name:      "arm64 without a variant is v8",
+			manifests: []string{"linux/amd64", "linux/arm64/v8"},
+			platform:  ocispec.Platform{OS: "linux", Architecture: "arm64"},
+			want:      "linux/arm64/v8",
+		},
+		{
+			name:      "entry without a variant",
+			manifests: []string{"linux/amd64", "linux/arm64"},
+			platform:  ocispec.Platform{OS: "linux", Architecture: "arm64", Variant: "v8"},
+			want:      "linux/arm64",
+		},
+		{
+			name:      "exact variant preferred",
+			manifests: []string{"linux/arm/v5", "linux/arm/v6", "linux/arm/v7"},
+			platform:  ocispec.Platform{OS: "linux", Architecture: "arm", Variant: "v7"},
+			want:      "linux/arm/v7",
+		},
+		{
+			name:      "closest older variant",
+			manifests: []string{"linux/arm/v5", "linux/arm/v6"},
+			platform:  ocispec.Platform{OS: "linux", Architecture: "arm", Variant: "v7"},
+			want:      "linux/arm/v6",
+		},
+		{
+			name:      "arm64 runs arm",
+			manifests: []string{"linux/amd64", "linux/arm/v7"},
+			platform:  ocispec.Platform{OS: "linux", Architecture: "arm64"},
+			want:      "linux/arm/v7",
+		},
+		{
+			name:      "native architecture preferred",
+			manifests: []string{"linux/386", "linux/amd64"},
+			platform:  ocispec.Platform{OS: "linux", Architecture: "amd64"},
+			want:      "linux/amd64",
+		},
+		{
+			name:      "amd64 runs 386",
+			manifests: []string{"linux/arm64", "linux/386"},
+			platform:  ocispec.Platform{OS: "linux", Architecture: "amd64"},
+			want:      "linux/386",
+		},
+		{
+			name:      "newer variant not accepted",
+			manifests: []string{"linux/arm/v7"},
+			platform:  ocispec.Platform{OS: "linux", Architecture: "arm", Variant: "v6"},
+		},
+		{
+			name:      "other OS not accepted",
+			manifests: []string{"windows/amd64", "linux/arm64"},
+			platform:  ocispec.Platform{OS: "linux", Architecture: "amd64"},
+		},
+		{
+			name:      "os.version of the same build",
+			manifests: []string{"windows/amd64:10.0.20348.2000", "windows/amd64:10.0.17763.4000"},
+			platform:  ocispec.Platform{OS: "windows", Architecture: "amd64", OSVersion: "10.0.17763.5000"},
+			want:      "windows/amd64:10.0.17763.4000",
+		},
+		{
+			name:      "exact os.version preferred",
+			manifests: []string{"windows/amd64:10.0.17763.4000", "windows/amd64:10.0.17763.5000"},
+			platform:  ocispec.Platform{OS: "windows", Architecture: "amd64", OSVersion: "10.0.17763.5000"},
+			want:      "windows/amd64:10.0.17763.5000",
+		},
+		{
+			name:      "os.version of another build",
+			manifests: []string{"windows/amd64:10.0.20348.2000"},
+			platform:  ocispec.Platform{OS: "windows", Architecture: "amd64", OSVersion: "10.0.17763.5000"},
+		},
+		{
+			name:      "entry without os.version",
+			manifests: []string{"windows/amd64"},
+			platform:  ocispec.Platform{OS: "windows", Architecture: "amd64", OSVersion: "10.0.17763.5000"},
+			want:      "windows/amd64",
+		},
+		{
+			name:      "any os.version when none is asked for",
+			manifests: []string{"windows/amd64:10.0.20348.2000"},
+			platform:  ocispec.Platform{OS: "windows", Architecture: "amd64"},
+			want:      "windows/amd64:10.0.20348.2000",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cs := newTestStore(t)
+			var manifests []ocispec.Descriptor
+			for _, m := range tt.manifests {
+				manifests = append(manifests, platformManifest(m))
+			}
+			manifests = append(manifests, attestation())
+
+			for _, mediaType := range []string{ocispec.MediaTypeImageIndex, images.MediaTypeDockerSchema2ManifestList} {
+				index := writeIndex(t, ctx, cs, mediaType, manifests...)
+				got, err := ResolvePlatform(ctx, cs, index, tt.platform)
+				if tt.want == "" {
+					if !errdefs.IsNotFound(err) {
+						t.Errorf("%s: ResolvePlatform() = %v, %v, want a not found error", mediaType, got.Platform, err)
+					}
+					continue
+				}
+				if err != nil {
+					t.Fatalf("%s: %v", mediaType, err)
+				}
+				if want := platformManifest(tt.want); got.Digest != want.Digest {
+					t.Errorf("%s: ResolvePlatform() = %v, want %s", mediaType, got.Platform, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestResolvePlatformManifest(t *testing.T) {
+	tests := []struct {
+		name     string
+		config   ocispec.Platform
+		platform ocispec.Platform
+		ok       bool
+	}{
+		{"same platform", ocispec.Platform{OS: "linux", Architecture: "amd64"}, ocispec.Platform{OS: "linux", Architecture: "amd64"}, true},
+		{"compatible variant", ocispec.Platform{OS: "linux", Architecture: "arm", Variant: "v6"}, ocispec.Platform{OS: "linux", Architecture: "arm", Variant: "v7"}, true},
+		{"arm64 without a variant", ocispec.Platform{OS: "linux", Architecture: "aarch64"}, ocispec.Platform{OS: "linux", Architecture: "arm64", Variant: "v8"}, true},
+		{"same os.version build", ocispec.Platform{OS: "windows", Architecture: "amd64", OSVersion: "10.0.17763.4000"}, ocispec.Platform{OS: "windows", Architecture: "amd64", OSVersion: "10.0.17763.5000"}, true},
+		{"other architecture", ocispec.Platform{OS: "linux", Architecture: "amd64"}, ocispec.Platform{OS: "linux", Architecture: "arm64"}, false},
+		{"newer variant", ocispec.Platform{OS: "linux", Architecture: "arm", Variant: "v7"}, ocispec.Platform{OS: "linux", Architecture: "arm", Variant: "v6"}, false},
+		{"other OS", ocispec.Platform{OS: "windows", Architecture: "amd64"}, ocispec.Platform{OS: "linux", Architecture: "amd64"}, false},
+		{"other os.version build", ocispec.Platform{OS: "windows", Architecture: "amd64", OSVersion: "10.0.20348.2000"}, ocispec.Platform{OS: "windows", Architecture: "amd64", OSVersion: "10.0.17763.5000"}, false},
+		{"no platform", ocispec.Platform{}, ocispec.Platform{OS: "linux", Architecture: "amd64"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cs := newTestStore(t)
+			config := writeJSON(t, ctx, cs, ocispec.MediaTypeImageConfig, ocispec.Image{Platform: tt.config})
+			desc := writeJSON(t, ctx, cs, ocispec.MediaTypeImageManifest, ocispec.Manifest{
+				Versioned: specs.Versioned{SchemaVersion: 2},
+				MediaType: ocispec.MediaTypeImageManifest,
+				Config:    config,
+			})
+
+			got, err := ResolvePlatform(ctx, cs, desc, tt.platform)
+			if !tt.ok {
+				if !errdefs.IsNotFound(err) {
+					t.Fatalf("ResolvePlatform() = %s, %v, want a not found error", got.Digest, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			// A single manifest is returned as-is.
+			if got.Digest != desc.Digest || got.Platform != nil {
+				t.Errorf("ResolvePlatform() = %+v, want %+v", got, desc)
+			}
+		})
+	}
+}
+
+func TestResolvePlatformManifestErrors(t *testing.T) {
+	ctx, cs := newTestStore(t)
+	linux := ocispec.Platform{OS: "linux", Architecture: "amd64"}
+
+	missing := ocispec.Descriptor{MediaType: images.MediaTypeDockerSchema2Manifest, Digest: digest.FromString("manifest"), Size: 1}
+	if _, err := ResolvePlatform(ctx, cs, missing, linux); !errdefs.IsNotFound(err) {
+		t.Errorf("ResolvePlatform() of a missing manifest = %v, want a not found error", err)
+	}
+
+	noConfig := writeJSON(t, ctx, cs, ocispec.MediaTypeImageManifest, ocispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    ocispec.Descriptor{MediaType: ocispec.MediaTypeImageConfig, Digest: digest.FromString("config"), Size: 1},
+	})
+	if _, err := ResolvePlatform(ctx, cs, noConfig, linux); err == nil || !strings.Contains(err.Error(), "error reading config") {
+		t.Errorf("ResolvePlatform() without a config = %v, want an error", err)
+	}
+}
+
+func TestResolvePlatformNested(t *testing.T) {
+	ctx, cs := newTestStore(t)
+	arm := writeIndex(t, ctx, cs, ocispec.MediaTypeImageIndex, platformManifest("linux/arm/v6"), platformManifest("linux/arm/v7"))
+	amd64 := writeIndex(t, ctx, cs, ocispec.MediaTypeImageIndex, platformManifest("linux/amd64"))
+	// A nested index restricted to another platform is skipped.
+	amd64.Platform = &ocispec.Platform{OS: "linux", Architecture: "amd64"}
+	index := writeIndex(t, ctx, cs, ocispec.MediaTypeImageIndex, platformManifest("linux/arm/v5"), amd64, arm)
+
+	got, err := ResolvePlatform(ctx, cs, index, ocispec.Platform{OS: "linux", Architecture: "arm", Variant: "v7"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := platformManifest("linux/arm/v7"); got.Digest != want.Digest {
+		t.Errorf("ResolvePlatform() = %v, want linux/arm/v7", got.Platform)
+	}
+
+	got, err = ResolvePlatform(ctx, cs, index, ocispec.Platform{OS: "linux", Architecture: "amd64"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := platformManifest("linux/amd64"); got.Digest != want.Digest {
+		t.Errorf("ResolvePlatform() = %v, want linux/amd64", got.Platform)
+	}
+}
+
+func TestResolvePlatformErrors(t *testing.T) {
+	ctx, cs := newTestStore(t)
+	linux := ocispec.Platform{OS: "linux", Architecture: "amd64"}
+
+	config := ocispec.Descriptor{MediaType: ocispec.MediaTypeImageConfig, Digest: digest.FromString("config"), Size: 1}
+	if _, err := ResolvePlatform(ctx, cs, config, linux); !errors.Is(err, errdefs.ErrNotImplemented) {
+		t.Errorf("ResolvePlatform() of a config = %v, want a not implemented error", err)
+	}
+
+	missing := ocispec.Descriptor{MediaType: ocispec.MediaTypeImageIndex, Digest: digest.FromString("missing"), Size: 1}
+	if _, err := ResolvePlatform(ctx, cs, missing, linux); err == nil {
+		t.Error("ResolvePlatform() of a missing index succeeded")
+	}
+
+	index := writeIndex(t, ctx, cs, ocispec.MediaTypeImageIndex, platformManifest("linux/amd64"))
+	for i := 1; i < maxIndexDepth; i++ {
+		index = writeIndex(t, ctx, cs, ocispec.MediaTypeImageIndex, index)
+	}
+	if _, err := ResolvePlatform(ctx, cs, index, linux); err != nil {
+		t.Errorf("ResolvePlatform() of indexes nested %d deep: %v", maxIndexDepth, err)
+	}
+	index = writeIndex(t, ctx, cs, ocispec.MediaTypeImageIndex, index)
+	if _, err := ResolvePlatform(ctx, cs, index, linux); err == nil || !strings.Contains(err.Error(), "nested too deeply") {
+		t.Errorf("ResolvePlatform() of deeply nested indexes = %v, want an error", err)
+	}
+}
@@ -0,0 +1,303 @@
+package manifest
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/containerd/containerd/archive/compression"
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/leases"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// schema1Manifest The parts of a Docker schema1 manifest the conversion
+// needs. Layers and history are listed top layer first.
+type schema1Manifest struct {
+	FSLayers []struct {
+		BlobSum digest.Digest `json:"blobSum"`
+	} `json:"fsLayers"`
+	History []struct {
+		V1Compatibility string `json:"v1Compatibility"`
+	} `json:"history"`
+}
+
+// v1History The fields of a v1Compatibility entry that make up a history
+// entry of the synthesized config.
+type v1History struct {
+	Author          string    `json:"author,omitempty"`
+	Created         time.Time `json:"created"`
+	Comment         string    `json:"comment,omitempty"`
+	ThrowAway       *bool     `json:"throwaway,omitempty"`
+	ContainerConfig struct {
+		Cmd []string `json:"Cmd,omitempty"`
+	} `json:"container_config,omitempty"`
+}
+
+// Fields of v1Compatibility entries that only make sense in schema1.
+var schema1OnlyFields = []string{"id", "parent", "Size", "throwaway", "layer_id", "parent_id"}
+
+func parseSchema1(p []byte) (*schema1Manifest, error) {
+	var m schema1Manifest
+	if err := json.Unmarshal(p, &m); err != nil {
+		return nil, fmt.Errorf("error decoding schema1 manifest: %w", err)
+	}
+	if len(m.History) == 0 || len(m.History) != len(m.FSLayers) {
+		return nil, fmt.Errorf("schema1 manifest has %d layers for %d history entries", len(m.FSLayers), len(m.History))
+	}
+	return &m, nil
+}
+
+// Schema1Layers The layer blobs a Docker schema1 manifest references, bottom
+// layer first and without repeats, for fetching them before ConvertSchema1.
+// Schema1 doesn't record sizes, so they are left unknown.
+func Schema1Layers(p []byte) ([]ocispec.Descriptor, error) {
+	m, err := parseSchema1(p)
+	if err != nil {
+		return nil, err
+	}
+	var layers []ocispec.Descriptor
+	seen := map[digest.Digest]bool{}
+	for i := len(m.FSLayers) - 1; i >= 0; i-- {
+		dgst := m.FSLayers[i].BlobSum
+		if seen[dgst] {
+			continue
+		}
+		seen[dgst] = true
+		layers = append(layers, ocispec.Descriptor{
+			MediaType: images.MediaTypeDockerSchema2LayerGzip,
+			Digest:    dgst,
+		})
+	}
+	return layers, nil
+}
+
+// VerifySchema1 Check that the Docker schema1 manifest p is the one dgst
+// names. Registries name signed manifests by the digest of the manifest
+// without its signatures, so that form is accepted too.
+func VerifySchema1(p []byte, dgst digest.Digest) error {
+	if err := dgst.Validate(); err != nil {
+		return fmt.Errorf("invalid manifest digest: %w", err)
+	}
+	if dgst.Algorithm().FromBytes(p) == dgst {
+		return nil
+	}
+	if payload, err := stripSignature(p); err == nil && dgst.Algorithm().FromBytes(payload) == dgst {
+		return nil
+	}
+	return fmt.Errorf("schema1 manifest does not match digest %s", dgst)
+}
+
+// ConvertSchema1 Convert the Docker schema1 manifest p to a Docker schema2
+// manifest, or an OCI one with FormatOCI, and store it with a config
+// synthesized from the v1Compatibility history. The layers must be in the
+// content store already, see Schema1Layers, since the config needs their
+// diffIDs. Layers that are empty tar archives, as schema1 writes for
+// instructions that only change the config, become empty history entries.
+func ConvertSchema1(ctx context.Context, contentStore content.Store, p []byte, f Format, opts ...ReplaceOpt) (*ImageManifest, error) {
+	options := newReplaceOptions(opts)
+	if options.lease != "" {
+		ctx = leases.WithLease(ctx, options.lease)
+	}
+	if _, ok := leases.FromContext(ctx); !ok {
+		return nil, fmt.Errorf("a lease is needed to keep the written blobs until an image references them: %w", errdefs.ErrFailedPrecondition)
+	}
+
+	p, err := stripSignature(p)
+	if err != nil {
+		return nil, fmt.Errorf("error reading schema1 manifest: %w", err)
+	}
+	m, err := parseSchema1(p)
+	if err != nil {
+		return nil, err
+	}
+
+	mediaType := images.MediaTypeDockerSchema2Manifest
+	configType := images.MediaTypeDockerSchema2Config
+	layerType := images.MediaTypeDockerSchema2LayerGzip
+	if f == FormatOCI {
+		mediaType = ocispec.MediaTypeImageManifest
+		configType = ocispec.MediaTypeImageConfig
+		layerType = ocispec.MediaTypeImageLayerGzip
+	}
+
+	var (
+		history []ocispec.History
+		diffIDs []digest.Digest
+		layers  []ocispec.Descriptor
+	)
+	for i := len(m.History) - 1; i >= 0; i-- {
+		var h v1History
+		if err := json.Unmarshal([]byte(m.History[i].V1Compatibility), &h); err != nil {
+			return nil, fmt.Errorf("error decoding schema1 history: %w", err)
+		}
+
+		info, err := contentStore.Info(ctx, m.FSLayers[i].BlobSum)
+		if err != nil {
+			return nil, fmt.Errorf("layer %s of the schema1 manifest: %w", m.FSLayers[i].BlobSum, err)
+		}
+		diffID, empty, err := schema1DiffID(ctx, contentStore, info)
+		if err != nil {
+			return nil, fmt.Errorf("error reading layer %s: %w", info.Digest, err)
+		}
+		if h.ThrowAway != nil {
+			empty = *h.ThrowAway
+		}
+
+		created := h.Created
+		history = append(history, ocispec.History{
+			Author:     h.Author,
+			Comment:    h.Comment,
+			Created:    &created,
+			CreatedBy:  strings.Join(h.ContainerConfig.Cmd, " "),
+			EmptyLayer: empty,
+		})
+		if empty {
+			continue
+		}
+		diffIDs = append(diffIDs, diffID)
+		layers = append(layers, ocispec.Descriptor{
+			MediaType: layerType,
+			Digest:    info.Digest,
+			Size:      info.Size,
+		})
+	}
+
+	// The top entry holds the image config; only the fields that are
+	// particular to schema1 are dropped, so the rest survives as is.
+	config, err := parseDocument(ocispec.Descriptor{MediaType: configType}, []byte(m.History[0].V1Compatibility))
+	if err != nil {
+		return nil, fmt.Errorf("error decoding schema1 image config: %w", err)
+	}
+	for _, key := range schema1OnlyFields {
+		if _, err := config.set(key, nil, true); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := config.set("rootfs", ocispec.RootFS{Type: "layers", DiffIDs: diffIDs}, false); err != nil {
+		return nil, err
+	}
+	configDesc, err := config.set("history", history, false)
+	if err != nil {
+		return nil, err
+	}
+	if err := WriteBlob(ctx, contentStore, options.ingestRef("config", configDesc.Digest), bytes.NewReader(config.Bytes()), configDesc, nil); err != nil {
+		return nil, err
+	}
+
+	mp, err := json.Marshal(struct {
+		specs.Versioned
+		MediaType string               `json:"mediaType"`
+		Config    ocispec.Descriptor   `json:"config"`
+		Layers    []ocispec.Descriptor `json:"layers"`
+	}{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: mediaType,
+		Config:    configDesc,
+		Layers:    layers,
+	})
+	if err != nil {
+		return nil, err
+	}
+	converted, err := ParseManifest(ocispec.Descriptor{MediaType: mediaType}, mp)
+	if err != nil {
+		return nil, err
+	}
+	desc := converted.Descriptor()
+	if err := WriteBlob(ctx, contentStore, options.ingestRef("manifest", desc.Digest), bytes.NewReader(mp), desc, converted.GCLabels()); err != nil {
+		return nil, err
+	}
+	return converted, nil
+}
+
+// The diffID of the empty tar archive, two zero blocks.
+const emptyTarDiffID = digest.Digest("sha256:5f70bf18a086007016e948b04aed3b82103a36bea41755b6cddfaf10ace3c6ef")
+
+// schema1DiffID The diffID of a schema1 layer blob, and whether the layer is
+// an empty tar archive, which is all zeros.
+func schema1DiffID(ctx context.Context, provider content.Provider, info content.Info) (digest.Digest, bool, error) {
+	if label, ok := info.Labels[containerdUncompressed]; ok {
+		diffID, err := digest.Parse(label)
+		return diffID, diffID == emptyTarDiffID, err
+	}
+
+	ra, err := provider.ReaderAt(ctx, ocispec.Descriptor{Digest: info.Digest, Size: info.Size})
+	if err != nil {
+		return "", false, err
+	}
+	defer ra.Close()
+	ds, err := compression.DecompressStream(content.NewReader(ra))
+	if err != nil {
+		return "", false, err
+	}
+	defer ds.Close()
+
+	digester := digest.Canonical.Digester()
+	zeros := &zeroChecker{empty: true}
+	if _, err := io.Copy(io.MultiWriter(digester.Hash(), zeros), ds); err != nil {
+		return "", false, err
+	}
+	return digester.Digest(), zeros.empty, nil
+}
+
+type zeroChecker struct {
+	empty bool
+}
+
+func (z *zeroChecker) Write(p []byte) (int, error) {
+	if z.empty {
+		for _, b := range p {
+			if b != 0 {
+				z.empty = false
+				break
+			}
+		}
+	}
+	return len(p), nil
+}
+
+// stripSignature Remove the JWS signatures of a signed schema1 manifest,
+// which aren't part of the manifest itself.
+func stripSignature(p []byte) ([]byte, error) {
+	var signed struct {
+		Signatures []struct {
+			Protected string `json:"protected"`
+		} `json:"signatures"`
+	}
+	if err := json.Unmarshal(p, &signed); err != nil {
+		return nil, err
+	}
+	if len(signed.Signatures) == 0 {
+		return p, nil
+	}
+
+	pb, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(signed.Signatures[0].Protected, "="))
+	if err != nil {
+		return nil, fmt.Errorf("error decoding signature: %w", err)
+	}
+	var protected struct {
+		Length int    `json:"formatLength"`
+		Tail   string `json:"formatTail"`
+	}
+	if err := json.Unmarshal(pb, &protected); err != nil {
+		return nil, err
+	}
+	if protected.Length < 0 || protected.Length > len(p) {
+		return nil, errors.New("invalid signature format length")
+	}
+	tail, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(protected.Tail, "="))
+	if err != nil {
+		return nil, fmt.Errorf("error decoding signature: %w", err)
+	}
+	return append(p[:protected.Length:protected.Length], tail...), nil
+}
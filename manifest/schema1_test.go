@@ -0,0 +1,51 @@
+package manifest
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"testing"
+
+	digest "github.com/opencontainers/go-digest"
+)
+
+const schema1Payload = `{"schemaVersion":1,"name":"library/alpine","tag":"3.1","fsLayers":[{"blobSum":"sha256:a3ed95caeb02ffe68cdd9fd84406680ae93d633cb16422d00e8a7c22955b46d4"}],"history":[{"v1Compatibility":"{\"id\":\"1\"}"}]}`
+
+// signSchema1 returns payload as a signed manifest, the way registries
+// serve them: the signatures are spliced in before the closing brace.
+func signSchema1(payload string) string {
+	protected := fmt.Sprintf(`{"formatLength":%d,"formatTail":%q}`, len(payload)-1, base64.RawURLEncoding.EncodeToString([]byte("}")))
+	return payload[:len(payload)-1] + `,"signatures":[{"protected":"` + base64.RawURLEncoding.EncodeToString([]byte(protected)) + `","signature":"c2ln"}]}`
+}
+
+func TestVerifySchema1(t *testing.T) {
+	signed := signSchema1(schema1Payload)
+	tests := []struct {
+		name     string
+		manifest string
+		digest   digest.Digest
+		wantErr  string
+	}{
+		{"unsigned", schema1Payload, digest.FromString(schema1Payload), ""},
+		{"signed, digest of the payload", signed, digest.FromString(schema1Payload), ""},
+		{"signed, digest of the whole document", signed, digest.FromString(signed), ""},
+		{"changed", strings.Replace(schema1Payload, "3.1", "3.2", 1), digest.FromString(schema1Payload), "does not match"},
+		{"signed and changed", strings.Replace(signed, "3.1", "3.2", 1), digest.FromString(schema1Payload), "does not match"},
+		{"truncated", schema1Payload[:len(schema1Payload)/2], digest.FromString(schema1Payload), "does not match"},
+		{"invalid digest", schema1Payload, "sha256:abc", "invalid manifest digest"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := VerifySchema1([]byte(tt.manifest), tt.digest)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("VerifySchema1() = %v, want an error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,55 @@
+// Package registry configures how the client and the server reach image
+// registries, the same way containerd and docker do, so both binaries
+// honour the same mirrors, certificates and credentials.
+package registry
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/containerd/containerd/remotes/docker"
+	dockerconfig "github.com/containerd/containerd/remotes/docker/config"
+	"github.com/docker/cli/cli/config"
+)
+
+// dockerHubAuthKey is the key docker login stores Docker Hub credentials
+// under, whichever of its hosts images are pulled from.
+const dockerHubAuthKey = "https://index.docker.io/v1/"
+
+// Hosts configures how images are pulled from each registry. The mirrors,
+// CAs, client certificates and plain-HTTP settings come from the hosts.toml
+// files under hostsDir, laid out as for containerd, and the credentials
+// from the config.json in configDir, or docker's default directory if it
+// is empty, including those kept by credential helpers.
+func Hosts(ctx context.Context, hostsDir, configDir string) (docker.RegistryHosts, error) {
+	if configDir == "" {
+		configDir = config.Dir()
+	}
+	cf, err := config.Load(configDir)
+	if err != nil {
+		return nil, fmt.Errorf("error loading registry credentials: %w", err)
+	}
+
+	opts := dockerconfig.HostOptions{
+		Credentials: func(host string) (string, string, error) {
+			key := host
+			if host == "registry-1.docker.io" || host == "docker.io" {
+				key = dockerHubAuthKey
+			}
+			// Credential helpers are run on every call, so credentials
+			// they rotate are picked up without a restart.
+			auth, err := cf.GetAuthConfig(key)
+			if err != nil {
+				return "", "", fmt.Errorf("error getting credentials for %s: %w", host, err)
+			}
+			if auth.IdentityToken != "" {
+				return "", auth.IdentityToken, nil
+			}
+			return auth.Username, auth.Password, nil
+		},
+	}
+	if hostsDir != "" {
+		opts.HostDir = dockerconfig.HostDirFromRoot(hostsDir)
+	}
+	return dockerconfig.ConfigureHosts(ctx, opts), nil
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"deltadiff/api"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/containerd/containerd/identifiers"
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/reference/docker"
+	"github.com/gobwas/glob"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// authPolicy maps client identities to the images they may request. It is
+// read from the JSON file given with --auth-policy.
+type authPolicy struct {
+	Clients []*authClient `json:"clients"`
+
+	// namespace of requests that don't name one
+	defaultNamespace string
+}
+
+// authClient is a client, or a group of clients sharing an identity.
+type authClient struct {
+	// name the client's requests are logged with
+	Name string `json:"name"`
+	// hex SHA-256 digests of the bearer tokens the client may present
+	TokenSHA256 []string `json:"tokenSHA256,omitempty"`
+	// glob patterns of the common names of the client certificates it may
+	// present, with "." separating the parts
+	Certificates []string `json:"certificates,omitempty"`
+	// glob patterns of the image references it may request, normalized
+	// like docker.io/library/alpine:3.18; "*" stays within one path
+	// component and "**" spans several
+	Images []string `json:"images"`
+	// containerd namespaces it may select, besides the server's default
+	Namespaces []string `json:"namespaces,omitempty"`
+
+	tokens       [][]byte
+	certificates []glob.Glob
+	images       []glob.Glob
+}
+
+// loadAuthPolicy reads and checks the policy file at path. Requests that
+// don't name a namespace are served from defaultNamespace, which every
+// client may use.
+func loadAuthPolicy(path, defaultNamespace string) (*authPolicy, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	p := authPolicy{defaultNamespace: defaultNamespace}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&p); err != nil {
+		return nil, fmt.Errorf("error parsing %s: %w", path, err)
+	}
+
+	for i, client := range p.Clients {
+		if client.Name == "" {
+			return nil, fmt.Errorf("%s: client %d has no name", path, i)
+		}
+		if len(client.TokenSHA256) == 0 && len(client.Certificates) == 0 {
+			return nil, fmt.Errorf("%s: client %s has neither tokens nor certificates", path, client.Name)
+		}
+		for _, s := range client.TokenSHA256 {
+			token, err := hex.DecodeString(s)
+			if err != nil || len(token) != sha256.Size {
+				return nil, fmt.Errorf("%s: client %s: %q is not a hex SHA-256 digest", path, client.Name, s)
+			}
+			client.tokens = append(client.tokens, token)
+		}
+		for _, s := range client.Certificates {
+			g, err := glob.Compile(s, '.')
+			if err != nil {
+				return nil, fmt.Errorf("%s: client %s: invalid certificate pattern %q: %w", path, client.Name, s, err)
+			}
+			client.certificates = append(client.certificates, g)
+		}
+		for _, s := range client.Images {
+			g, err := glob.Compile(s, '/')
+			if err != nil {
+				return nil, fmt.Errorf("%s: client %s: invalid image pattern %q: %w", path, client.Name, s, err)
+			}
+			client.images = append(client.images, g)
+		}
+		for _, ns := range client.Namespaces {
+			if err := identifiers.Validate(ns); err != nil {
+				return nil, fmt.Errorf("%s: client %s: invalid namespace: %w", path, client.Name, err)
+			}
+		}
+	}
+	return &p, nil
+}
+
+// identify returns the client that made the request: the one holding the
+// bearer token in the request's metadata or, without a token, the one
+// whose pattern matches the common name of the verified client
+// certificate.
+func (p *authPolicy) identify(ctx context.Context) (*authClient, error) {
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if values := md.Get(api.AuthorizationKey); len(values) > 0 {
+			token, ok := strings.CutPrefix(values[0], "Bearer ")
+			if !ok {
+				return nil, status.Error(codes.Unauthenticated, "authorization must be a bearer token")
+			}
+			sum := sha256.Sum256([]byte(token))
+			for _, client := range p.Clients {
+				for _, t := range client.tokens {
+					if subtle.ConstantTimeCompare(sum[:], t) == 1 {
+						return client, nil
+					}
+				}
+			}
+			return nil, status.Error(codes.Unauthenticated, "invalid token")
+		}
+	}
+
+	if pr, ok := peer.FromContext(ctx); ok {
+		if info, ok := pr.AuthInfo.(credentials.TLSInfo); ok && len(info.State.VerifiedChains) > 0 {
+			cn := info.State.VerifiedChains[0][0].Subject.CommonName
+			for _, client := range p.Clients {
+				for _, g := range client.certificates {
+					if g.Match(cn) {
+						return client, nil
+					}
+				}
+			}
+			return nil, status.Errorf(codes.Unauthenticated, "client certificate %q is not allowed", cn)
+		}
+	}
+	return nil, status.Error(codes.Unauthenticated, "no token or client certificate")
+}
+
+// authorize fails unless client may make req: it must select one of the
+// client's namespaces and only name images the client may request.
+func (p *authPolicy) authorize(client *authClient, req interface{}) error {
+	ns, refs, err := requestScope(req)
+	if err != nil {
+		return err
+	}
+	if ns != "" && ns != p.defaultNamespace && !slices.Contains(client.Namespaces, ns) {
+		return status.Errorf(codes.PermissionDenied, "client %s may not use namespace %q", client.Name, ns)
+	}
+	for _, ref := range refs {
+		named, err := docker.ParseNormalizedNamed(ref)
+		if err != nil {
+			return status.Errorf(codes.InvalidArgument, "invalid image reference %q: %v", ref, err)
+		}
+		normalized := docker.TagNameOnly(named).String()
+		allowed := false
+		for _, g := range client.images {
+			if g.Match(normalized) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return status.Errorf(codes.PermissionDenied, "client %s may not request %s", client.Name, normalized)
+		}
+	}
+	return nil
+}
+
+// requestScope returns the namespace and the image references a request
+// names. Requests of any other type are refused, so an RPC added later isn't
+// served until it is added here.
+func requestScope(req interface{}) (string, []string, error) {
+	switch r := req.(type) {
+	case *api.CalcImageDiffsRequest:
+		return r.Namespace, []string{r.Image1.GetReference(), r.Image2.GetReference()}, nil
+	case *api.DiffImageConfigRequest:
+		return r.Namespace, []string{r.Image1.GetReference(), r.Image2.GetReference()}, nil
+	case *api.ManifestRequest:
+		return r.Namespace, []string{r.Image.GetReference()}, nil
+	case *api.LayerMetadataRequest:
+		return r.Namespace, []string{r.Image.GetReference()}, nil
+	}
+	return "", nil, status.Errorf(codes.PermissionDenied, "requests of type %T are not authorized", req)
+}
+
+// authenticate identifies the client of a request and tags the request's
+// logger with its name.
+func (p *authPolicy) authenticate(ctx context.Context) (context.Context, *authClient, error) {
+	client, err := p.identify(ctx)
+	if err != nil {
+		return ctx, nil, err
+	}
+	return log.WithLogger(ctx, log.G(ctx).WithField("client", client.Name)), client, nil
+}
+
+func (p *authPolicy) unaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	ctx, client, err := p.authenticate(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := p.authorize(client, req); err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+func (p *authPolicy) streamInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	ctx, client, err := p.authenticate(ss.Context())
+	if err != nil {
+		return err
+	}
+	return handler(srv, &authorizedStream{ServerStream: ss, ctx: ctx, policy: p, client: client})
+}
+
+// authorizedStream checks every request received on a stream before the
+// handler sees it, so nothing is pulled or mounted for images the client
+// may not request.
+type authorizedStream struct {
+	grpc.ServerStream
+	ctx    context.Context
+	policy *authPolicy
+	client *authClient
+}
+
+func (s *authorizedStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *authorizedStream) RecvMsg(m interface{}) error {
+	if err := s.ServerStream.RecvMsg(m); err != nil {
+		return err
+	}
+	return s.policy.authorize(s.client, m)
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"deltadiff/api"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+const testToken = "s3cret"
+
+func tokenDigest(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func writePolicy(t *testing.T, policy string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "policy.json")
+	if err := os.WriteFile(path, []byte(policy), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func testPolicy(t *testing.T) *authPolicy {
+	t.Helper()
+	p, err := loadAuthPolicy(writePolicy(t, `{
+  "clients": [
+    {
+      "name": "edge",
+      "tokenSHA256": ["`+tokenDigest(testToken)+`"],
+      "images": ["registry.local/apps/**", "docker.io/library/alpine:*"],
+      "namespaces": ["edge"]
+    },
+    {
+      "name": "lab",
+      "certificates": ["*.lab.example.com"],
+      "images": ["docker.io/library/busybox@sha256:*"]
+    }
+  ]
+}`), "default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestLoadAuthPolicyErrors(t *testing.T) {
+	token := tokenDigest(testToken)
+	tests := []struct {
+		name   string
+		policy string
+		want   string
+	}{
+		{"invalid JSON", `{"clients": [`, "error parsing"},
+		{"unknown field", `{"clients": [{"name": "a", "tokens": ["x"], "images": ["**"]}]}`, "unknown field"},
+		{"no name", `{"clients": [{"tokenSHA256": ["` + token + `"], "images": ["**"]}]}`, "has no name"},
+		{"no credentials", `{"clients": [{"name": "a", "images": ["**"]}]}`, "neither tokens nor certificates"},
+		{"token not hex", `{"clients": [{"name": "a", "tokenSHA256": ["` + testToken + `"], "images": ["**"]}]}`, "not a hex SHA-256 digest"},
+		{"token too short", `{"clients": [{"name": "a", "tokenSHA256": ["abcd"], "images": ["**"]}]}`, "not a hex SHA-256 digest"},
+		{"bad certificate pattern", `{"clients": [{"name": "a", "certificates": ["[a"], "images": ["**"]}]}`, "invalid certificate pattern"},
+		{"bad image pattern", `{"clients": [{"name": "a", "certificates": ["a"], "images": ["[a"]}]}`, "invalid image pattern"},
+		{"bad namespace", `{"clients": [{"name": "a", "certificates": ["a"], "images": ["**"], "namespaces": ["a/b"]}]}`, "invalid namespace"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := loadAuthPolicy(writePolicy(t, tt.policy), "default")
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("loadAuthPolicy() error = %v, want one containing %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadAuthPolicyMissingFile(t *testing.T) {
+	if _, err := loadAuthPolicy(filepath.Join(t.TempDir(), "missing.json"), "default"); !os.IsNotExist(err) {
+		t.Errorf("loadAuthPolicy() error = %v, want not exist", err)
+	}
+}
+
+// certContext returns a context for a request from a client that presented
+// a verified certificate for commonName.
+func certContext(commonName string) context.Context {
+	cert := &x509.Certificate{Subject: pkix.Name{CommonName: commonName}}
+	return peer.NewContext(context.Background(), &peer.Peer{
+		AuthInfo: credentials.TLSInfo{State: tls.ConnectionState{
+			VerifiedChains: [][]*x509.Certificate{{cert}},
+		}},
+	})
+}
+
+func tokenContext(ctx context.Context, authorization string) context.Context {
+	return metadata.NewIncomingContext(ctx, metadata.Pairs(api.AuthorizationKey, authorization))
+}
+
+func TestIdentify(t *testing.T) {
+	p := testPolicy(t)
+	tests := []struct {
+		name string
+		ctx  context.Context
+		// client identified, if the code is OK
+		want string
+		code codes.Code
+	}{
+		{"token", tokenContext(context.Background(), "Bearer "+testToken), "edge", codes.OK},
+		{"wrong token", tokenContext(context.Background(), "Bearer nope"), "", codes.Unauthenticated},
+		{"not a bearer token", tokenContext(context.Background(), "Basic "+testToken), "", codes.Unauthenticated},
+		{"certificate", certContext("node1.lab.example.com"), "lab", codes.OK},
+		{"certificate of a subdomain", certContext("a.node1.lab.example.com"), "", codes.Unauthenticated},
+		{"unknown certificate", certContext("node1.example.org"), "", codes.Unauthenticated},
+		{"token takes precedence", tokenContext(certContext("node1.lab.example.com"), "Bearer "+testToken), "edge", codes.OK},
+		{"wrong token with a certificate", tokenContext(certContext("node1.lab.example.com"), "Bearer nope"), "", codes.Unauthenticated},
+		{"no token or certificate", context.Background(), "", codes.Unauthenticated},
+		{"unverified TLS", peer.NewContext(context.Background(), &peer.Peer{AuthInfo: credentials.TLSInfo{}}), "", codes.Unauthenticated},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, err := p.identify(tt.ctx)
+			if code := status.Code(err); code != tt.code {
+				t.Fatalf("identify() error = %v, want code %v", err, tt.code)
+			}
+			if err == nil && client.Name != tt.want {
+				t.Errorf("identify() = %s, want %s", client.Name, tt.want)
+			}
+		})
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	p := testPolicy(t)
+	edge, lab := p.Clients[0], p.Clients[1]
+	const dgst = "sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+	manifest := func(ref, ns string) *api.ManifestRequest {
+		return &api.ManifestRequest{Image: &api.Image{Reference: ref}, Namespace: ns}
+	}
+	tests := []struct {
+		name   string
+		client *authClient
+		req    interface{}
+		code   codes.Code
+	}{
+		{"nested path", edge, manifest("registry.local/apps/team/web:1.0", ""), codes.OK},
+		{"outside the path", edge, manifest("registry.local/other/web:1.0", ""), codes.PermissionDenied},
+		{"short name", edge, manifest("alpine:3.18", ""), codes.OK},
+		{"no tag counts as latest", edge, manifest("alpine", ""), codes.OK},
+		{"tag pattern doesn't span components", edge, manifest("docker.io/library/alpine/x:1", ""), codes.PermissionDenied},
+		{"digest against a tag pattern", edge, manifest("alpine@"+dgst, ""), codes.PermissionDenied},
+		{"digest against a digest pattern", lab, manifest("busybox@"+dgst, ""), codes.OK},
+		{"tag against a digest pattern", lab, manifest("busybox:1.36", ""), codes.PermissionDenied},
+		{"invalid reference", edge, manifest("evil:../../etc/x", ""), codes.InvalidArgument},
+		{"missing image", edge, &api.ManifestRequest{}, codes.InvalidArgument},
+		{"both images of a delta", edge, &api.CalcImageDiffsRequest{
+			Image1: &api.Image{Reference: "alpine:3.17"},
+			Image2: &api.Image{Reference: "alpine:3.18"},
+		}, codes.OK},
+		{"one image of a delta not allowed", edge, &api.CalcImageDiffsRequest{
+			Image1: &api.Image{Reference: "alpine:3.17"},
+			Image2: &api.Image{Reference: "registry.local/other/web:1.0"},
+		}, codes.PermissionDenied},
+		{"default namespace by name", lab, manifest("busybox@"+dgst, "default"), codes.OK},
+		{"allowed namespace", edge, manifest("alpine:3.18", "edge"), codes.OK},
+		{"other namespace", edge, manifest("alpine:3.18", "k8s.io"), codes.PermissionDenied},
+		{"namespace of another client", lab, manifest("busybox@"+dgst, "edge"), codes.PermissionDenied},
+		{"namespace of a layer metadata request", edge, &api.LayerMetadataRequest{
+			Image: &api.Image{Reference: "alpine:3.18"}, Namespace: "k8s.io",
+		}, codes.PermissionDenied},
+		{"namespace of a config diff", edge, &api.DiffImageConfigRequest{
+			Image1:    &api.Image{Reference: "alpine:3.17"},
+			Image2:    &api.Image{Reference: "alpine:3.18"},
+			Namespace: "edge",
+		}, codes.OK},
+		{"unknown request type", edge, &api.Image{Reference: "alpine:3.18"}, codes.PermissionDenied},
+		{"no request", edge, nil, codes.PermissionDenied},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := p.authorize(tt.client, tt.req); status.Code(err) != tt.code {
+				t.Errorf("authorize() error = %v, want code %v", err, tt.code)
+			}
+		})
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"deltadiff/api"
+	"deltadiff/manifest"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// DiffImageConfig reports what changed in the config and manifest between
+// two versions of an image, resolved and pulled like CalculateDeltaDiffs does.
+func (c *deltaDiffService) DiffImageConfig(ctx context.Context, r *api.DiffImageConfigRequest) (*api.DiffImageConfigResponse, error) {
+	ctx, _, err := c.withNamespace(ctx, r.Namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	_, from, err := c.loadManifest(ctx, r.Image1, r.Os, r.Arch, r.Variant, r.OsVersion)
+	if err != nil {
+		return nil, err
+	}
+	_, to, err := c.loadManifest(ctx, r.Image2, r.Os, r.Arch, r.Variant, r.OsVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	d, err := manifest.Diff(ctx, c.client.ContentStore(), from, to)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "error comparing images: %v", err)
+	}
+	return &api.DiffImageConfigResponse{
+		Config:        apiChanges(d.Config),
+		Annotations:   apiChanges(d.Annotations),
+		LayersAdded:   apiLayers(d.LayersAdded),
+		LayersRemoved: apiLayers(d.LayersRemoved),
+	}, nil
+}
+
+func apiChanges(changes []manifest.Change) []*api.Change {
+	result := make([]*api.Change, len(changes))
+	for i, ch := range changes {
+		result[i] = &api.Change{Field: ch.Field, Key: ch.Key, Old: ch.Old, New: ch.New}
+	}
+	return result
+}
+
+func apiLayers(layers []ocispec.Descriptor) []*api.Layer {
+	result := make([]*api.Layer, len(layers))
+	for i, layer := range layers {
+		result[i] = &api.Layer{Digest: layer.Digest.String(), MediaType: layer.MediaType, Size: layer.Size}
+	}
+	return result
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"deltadiff/api"
+	"deltadiff/layermeta"
+	"deltadiff/telemetry"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// GetLayerMetadata streams what the client needs to regenerate the original
+// layer blobs of an image, see package layermeta. The archive only depends
+// on the manifest, so it is cached under the manifest digest.
+func (c *deltaDiffService) GetLayerMetadata(r *api.LayerMetadataRequest, stream api.DeltaDiffService_GetLayerMetadataServer) error {
+	ctx, _, err := c.withNamespace(stream.Context(), r.Namespace)
+	if err != nil {
+		return err
+	}
+
+	image, m, err := c.loadManifest(ctx, r.Image, r.Os, r.Arch, r.Variant, r.OsVersion)
+	if err != nil {
+		return err
+	}
+	// The image has the normalized name, so the label is the same however
+	// the client spelled the reference.
+	repo := repository(image.Name())
+
+	path := filepath.Join(c.tmpDir, fmt.Sprintf("layer-metadata-%s.tar", m.Descriptor().Digest.Encoded()))
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		// Concurrent requests may both generate the archive; each writes
+		// its own temp file, and the rename makes either one visible whole.
+		f, err := os.CreateTemp(c.tmpDir, "layer-metadata-*.part")
+		if err != nil {
+			return status.Errorf(codes.Internal, "error creating layer metadata: %v", err)
+		}
+		defer os.Remove(f.Name())
+		_, span := telemetry.StartSpan(ctx, "layermeta.Generate")
+		err = layermeta.Generate(ctx, c.client.ContentStore(), m, c.tmpDir, f)
+		telemetry.End(span, &err)
+		if err != nil {
+			f.Close()
+			return status.Errorf(codes.Internal, "error creating layer metadata: %v", err)
+		}
+		if err := f.Close(); err != nil {
+			return status.Errorf(codes.Internal, "error creating layer metadata: %v", err)
+		}
+		if err := os.Rename(f.Name(), path); err != nil {
+			return status.Errorf(codes.Internal, "error creating layer metadata: %v", err)
+		}
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return status.Errorf(codes.Internal, "error reading layer metadata: %v", err)
+	}
+	defer file.Close()
+
+	buf := make([]byte, CHUNK_SIZE)
+	for {
+		n, err := file.Read(buf)
+		if n > 0 {
+			if err := stream.Send(&api.LayerMetadataResponse{Chunk: buf[:n]}); err != nil {
+				return err
+			}
+			bytesServed.WithLabelValues(repo, "layer_metadata").Add(float64(n))
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return status.Errorf(codes.Internal, "error reading layer metadata: %v", err)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"deltadiff/api"
+	"encoding/hex"
+	"time"
+
+	"github.com/containerd/containerd/log"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// requestLogger returns ctx with a logger that tags every line with the ID
+// of the request, taken from the client's metadata if it sent one, and
+// returns that ID in the response header.
+func requestLogger(ctx context.Context, method string) context.Context {
+	var id string
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if ids := md.Get(api.RequestIDKey); len(ids) > 0 && len(ids[0]) <= 64 {
+			id = ids[0]
+		}
+	}
+	if id == "" {
+		b := make([]byte, 8)
+		rand.Read(b)
+		id = hex.EncodeToString(b)
+	}
+	grpc.SetHeader(ctx, metadata.Pairs(api.RequestIDKey, id))
+
+	fields := log.Fields{
+		"request_id": id,
+		"method":     method,
+	}
+	if sc := trace.SpanContextFromContext(ctx); sc.HasTraceID() {
+		fields["trace_id"] = sc.TraceID().String()
+	}
+	return log.WithLogger(ctx, log.G(ctx).WithFields(fields))
+}
+
+// logFinished logs the outcome of a request once it is done.
+func logFinished(ctx context.Context, start time.Time, err error) {
+	entry := log.G(ctx).WithFields(log.Fields{
+		"code":     status.Code(err).String(),
+		"duration": time.Since(start),
+	})
+	if err != nil {
+		entry.WithError(err).Warn("request failed")
+		return
+	}
+	entry.Info("request finished")
+}
+
+func unaryLogger(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	start := time.Now()
+	ctx = requestLogger(ctx, info.FullMethod)
+	log.G(ctx).Debug("request started")
+
+	resp, err := handler(ctx, req)
+	logFinished(ctx, start, err)
+	return resp, err
+}
+
+func streamLogger(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	start := time.Now()
+	ctx := requestLogger(ss.Context(), info.FullMethod)
+	log.G(ctx).Debug("request started")
+
+	err := handler(srv, &contextStream{ServerStream: ss, ctx: ctx})
+	logFinished(ctx, start, err)
+	return err
+}
+
+// contextStream is a server stream with a different context, so that
+// handlers see the request logger.
+type contextStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *contextStream) Context() context.Context {
+	return s.ctx
+}
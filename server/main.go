@@ -0,0 +1,279 @@
+package main
+
+import (
+	"context"
+	"deltadiff/api"
+	"deltadiff/registry"
+	"deltadiff/telemetry"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/defaults"
+	"github.com/containerd/containerd/identifiers"
+	"github.com/containerd/containerd/log"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/urfave/cli"
+	"google.golang.org/grpc"
+)
+
+func main() {
+	app := cli.NewApp()
+	app.Name = "cargosync-server"
+	app.Usage = "compute and serve rsync-based deltas between container images"
+	app.Commands = []cli.Command{
+		serveCommand,
+	}
+
+	if err := app.Run(os.Args); err != nil {
+		fmt.Fprintf(os.Stderr, "cargosync-server: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+var serveCommand = cli.Command{
+	Name:  "serve",
+	Usage: "listen for delta requests",
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:   "listen, l",
+			Usage:  "address to listen on: host:port for TCP, or an absolute path for a unix socket",
+			Value:  "0.0.0.0:4000",
+			EnvVar: "CARGOSYNC_LISTEN",
+		},
+		cli.StringFlag{
+			Name:   "address, a",
+			Usage:  "address of the containerd socket",
+			Value:  defaults.DefaultAddress,
+			EnvVar: "CONTAINERD_ADDRESS",
+		},
+		cli.StringFlag{
+			Name:   "namespace, n",
+			Usage:  "containerd namespace used for requests that don't name one",
+			Value:  "default",
+			EnvVar: "CONTAINERD_NAMESPACE",
+		},
+		cli.StringSliceFlag{
+			Name:   "allow-namespace",
+			Usage:  "additional containerd namespace requests may select (repeatable)",
+			EnvVar: "CARGOSYNC_ALLOW_NAMESPACES",
+		},
+		cli.StringFlag{
+			Name:   "snapshotter",
+			Usage:  "containerd snapshotter used to unpack and mount images",
+			Value:  containerd.DefaultSnapshotter,
+			EnvVar: "CONTAINERD_SNAPSHOTTER",
+		},
+		cli.StringFlag{
+			Name:   "tmp-dir",
+			Usage:  "directory the delta patches are written to and cached in",
+			Value:  os.TempDir(),
+			EnvVar: "CARGOSYNC_TMP_DIR",
+		},
+		cli.StringFlag{
+			Name:   "registry-hosts-dir",
+			Usage:  "directory of containerd hosts.toml files setting the mirrors, CAs and plain-HTTP use of each registry",
+			Value:  "/etc/containerd/certs.d",
+			EnvVar: "CARGOSYNC_REGISTRY_HOSTS_DIR",
+		},
+		cli.StringFlag{
+			Name:   "registry-config",
+			Usage:  "directory of the docker config.json holding registry credentials or naming credential helpers (default: ~/.docker)",
+			EnvVar: "DOCKER_CONFIG",
+		},
+		cli.StringFlag{
+			Name:   "tls-cert",
+			Usage:  "server certificate, reloaded when the file changes",
+			EnvVar: "CARGOSYNC_TLS_CERT",
+		},
+		cli.StringFlag{
+			Name:   "tls-key",
+			Usage:  "private key of the server certificate",
+			EnvVar: "CARGOSYNC_TLS_KEY",
+		},
+		cli.StringFlag{
+			Name:   "tls-client-ca",
+			Usage:  "CA bundle to verify client certificates against; clients without one are refused",
+			EnvVar: "CARGOSYNC_TLS_CLIENT_CA",
+		},
+		cli.StringFlag{
+			Name:   "auth-policy",
+			Usage:  "JSON file naming the clients that may connect and the images each may request (default: any client, any image)",
+			EnvVar: "CARGOSYNC_AUTH_POLICY",
+		},
+		cli.BoolFlag{
+			Name:   "insecure",
+			Usage:  "serve without TLS: traffic is in cleartext and clients can't tell they reach the real server",
+			EnvVar: "CARGOSYNC_INSECURE",
+		},
+		cli.StringFlag{
+			Name:   "metrics-address",
+			Usage:  "address to serve Prometheus metrics on at /metrics, e.g. :9090 (default: disabled)",
+			EnvVar: "CARGOSYNC_METRICS_ADDRESS",
+		},
+		cli.StringFlag{
+			Name:   "trace-otlp-endpoint",
+			Usage:  "OTLP gRPC collector to send traces to, host:port (default: tracing disabled)",
+			EnvVar: "CARGOSYNC_TRACE_OTLP_ENDPOINT",
+		},
+		cli.StringFlag{
+			Name:   "trace-file",
+			Usage:  "file to append traces to as JSON spans",
+			EnvVar: "CARGOSYNC_TRACE_FILE",
+		},
+		cli.StringFlag{
+			Name:   "log-level",
+			Usage:  "log level (trace, debug, info, warn, error)",
+			Value:  "info",
+			EnvVar: "CARGOSYNC_LOG_LEVEL",
+		},
+		cli.StringFlag{
+			Name:   "log-format",
+			Usage:  "log output format (text, json)",
+			Value:  "text",
+			EnvVar: "CARGOSYNC_LOG_FORMAT",
+		},
+	},
+	Action: func(c *cli.Context) error {
+		if c.NArg() != 0 {
+			return fmt.Errorf("serve takes no arguments, use --listen to set the address (got %q)", c.Args())
+		}
+		if err := log.SetLevel(c.String("log-level")); err != nil {
+			return fmt.Errorf("invalid --log-level %q: %w", c.String("log-level"), err)
+		}
+		switch c.String("log-format") {
+		case "text":
+			log.SetFormat(log.TextFormat)
+		case "json":
+			log.SetFormat(log.JSONFormat)
+		default:
+			return fmt.Errorf("invalid --log-format %q: must be text or json", c.String("log-format"))
+		}
+
+		shutdownTracing, err := telemetry.Setup(context.Background(), "cargosync-server", c.String("trace-otlp-endpoint"), c.String("trace-file"))
+		if err != nil {
+			return err
+		}
+		defer shutdownTracing(context.Background())
+
+		unary := []grpc.UnaryServerInterceptor{unaryLogger, unaryMetrics}
+		stream := []grpc.StreamServerInterceptor{streamLogger, streamMetrics}
+		if path := c.String("auth-policy"); path != "" {
+			policy, err := loadAuthPolicy(path, c.String("namespace"))
+			if err != nil {
+				return fmt.Errorf("invalid --auth-policy: %w", err)
+			}
+			unary = append(unary, policy.unaryInterceptor)
+			stream = append(stream, policy.streamInterceptor)
+		} else {
+			log.L.Warn("no --auth-policy: any client may request any image")
+		}
+		opts := append(telemetry.ServerOptions(),
+			grpc.ChainUnaryInterceptor(unary...),
+			grpc.ChainStreamInterceptor(stream...),
+		)
+		if c.Bool("insecure") {
+			if c.String("tls-cert") != "" || c.String("tls-key") != "" || c.String("tls-client-ca") != "" {
+				return errors.New("--insecure cannot be combined with the --tls-* flags")
+			}
+			log.L.Warn("serving without TLS")
+		} else {
+			creds, err := serverCredentials(c.String("tls-cert"), c.String("tls-key"), c.String("tls-client-ca"))
+			if err != nil {
+				return err
+			}
+			opts = append(opts, grpc.Creds(creds))
+		}
+
+		hosts, err := registry.Hosts(context.Background(), c.String("registry-hosts-dir"), c.String("registry-config"))
+		if err != nil {
+			return err
+		}
+
+		client, err := containerd.New(c.String("address"),
+			containerd.WithDefaultNamespace(c.String("namespace")),
+			containerd.WithDialOpts(telemetry.ContainerdDialOptions()))
+		if err != nil {
+			return fmt.Errorf("error connecting to containerd at %s (set --address or CONTAINERD_ADDRESS): %w", c.String("address"), err)
+		}
+		defer client.Close()
+
+		// Create a gRPC server
+		rpc := grpc.NewServer(opts...)
+		allowedNamespaces := map[string]bool{}
+		for _, ns := range c.StringSlice("allow-namespace") {
+			if err := identifiers.Validate(ns); err != nil {
+				return fmt.Errorf("invalid --allow-namespace: %w", err)
+			}
+			allowedNamespaces[ns] = true
+		}
+
+		// Paths handed to rsync and zstd are absolute, so none can be read
+		// as an option or, by rsync, as a remote host.
+		tmpDir, err := filepath.Abs(c.String("tmp-dir"))
+		if err != nil {
+			return fmt.Errorf("invalid --tmp-dir: %w", err)
+		}
+
+		api.RegisterDeltaDiffServiceServer(rpc, &deltaDiffService{
+			client:            client,
+			snapshotter:       c.String("snapshotter"),
+			tmpDir:            tmpDir,
+			namespace:         c.String("namespace"),
+			allowedNamespaces: allowedNamespaces,
+			hosts:             hosts,
+		})
+
+		// Listen and serve
+		// For IPv4, use:   IP_ADDRESS:PORT
+		// For unix sockets, use: /var/run/mydiffer.sock
+		address := c.String("listen")
+		addressType := "tcp"
+		if strings.HasPrefix(address, "/") {
+			addressType = "unix"
+		}
+
+		l, err := net.Listen(addressType, address)
+		if err != nil {
+			return fmt.Errorf("error listening on %s: %w", address, err)
+		}
+		defer l.Close()
+		log.L.WithField("address", address).Info("listening")
+
+		if address := c.String("metrics-address"); address != "" {
+			mux := http.NewServeMux()
+			mux.Handle("/metrics", promhttp.Handler())
+			metrics := &http.Server{Addr: address, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+			go func() {
+				if err := metrics.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+					log.L.WithError(err).Error("error serving metrics")
+				}
+			}()
+			defer metrics.Close()
+			log.L.WithField("address", address).Info("serving metrics")
+		}
+
+		go func() {
+			if err := rpc.Serve(l); err != nil {
+				log.L.WithError(err).Error("error serving requests")
+			}
+		}()
+		defer rpc.Stop()
+
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+
+		// Block until a signal is received.
+		s := <-sig
+		log.L.WithField("signal", s).Info("shutting down")
+		return nil
+	},
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/containerd/containerd/reference/docker"
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+// Metrics served on --metrics-address. Image metrics are labelled with the
+// repository of the target image, without tag or digest, to keep the
+// number of series bounded.
+var (
+	deltaRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "cargosync",
+		Name:      "delta_requests_total",
+		Help:      "Delta requests, by whether the patch was served from the cache (hit) or generated (miss).",
+	}, []string{"repository", "cache"})
+	deltaSize = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "cargosync",
+		Name:      "delta_size_bytes",
+		Help:      "Size of the compressed patches generated.",
+		Buckets:   prometheus.ExponentialBuckets(64<<10, 4, 10),
+	}, []string{"repository"})
+	deltaCompressionRatio = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "cargosync",
+		Name:      "delta_compression_ratio",
+		Help:      "Size of the target image divided by the size of its compressed patch.",
+		Buckets:   prometheus.ExponentialBuckets(1, 2, 12),
+	}, []string{"repository"})
+	deltaGenerationSeconds = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "cargosync",
+		Name:      "delta_generation_seconds",
+		Help:      "Time to create and compress a patch.",
+		Buckets:   prometheus.ExponentialBuckets(0.5, 2, 12),
+	}, []string{"repository"})
+	deltaTransferSeconds = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "cargosync",
+		Name:      "delta_transfer_seconds",
+		Help:      "Time to stream a patch to the client.",
+		Buckets:   prometheus.ExponentialBuckets(0.1, 2, 14),
+	}, []string{"repository", "cache"})
+	bytesServed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "cargosync",
+		Name:      "served_bytes_total",
+		Help:      "Bytes streamed to clients, by kind (delta, layer_metadata).",
+	}, []string{"repository", "kind"})
+	imagePullSeconds = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "cargosync",
+		Name:      "image_pull_seconds",
+		Help:      "Time to pull and unpack an image that wasn't available yet.",
+		Buckets:   prometheus.ExponentialBuckets(0.5, 2, 12),
+	}, []string{"repository"})
+
+	grpcHandled = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "cargosync",
+		Subsystem: "grpc",
+		Name:      "server_handled_total",
+		Help:      "RPCs completed on the server, by method and status code.",
+	}, []string{"method", "code"})
+	grpcHandlingSeconds = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "cargosync",
+		Subsystem: "grpc",
+		Name:      "server_handling_seconds",
+		Help:      "Time until the server completed an RPC.",
+		Buckets:   prometheus.ExponentialBuckets(0.005, 4, 10),
+	}, []string{"method"})
+	grpcActiveStreams = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "cargosync",
+		Subsystem: "grpc",
+		Name:      "server_active_streams",
+		Help:      "Server streams currently open.",
+	}, []string{"method"})
+)
+
+func init() {
+	prometheus.MustRegister(
+		deltaRequests,
+		deltaSize,
+		deltaCompressionRatio,
+		deltaGenerationSeconds,
+		deltaTransferSeconds,
+		bytesServed,
+		imagePullSeconds,
+		grpcHandled,
+		grpcHandlingSeconds,
+		grpcActiveStreams,
+	)
+}
+
+// repository returns the repository of an image reference for use as a
+// metric label.
+func repository(ref string) string {
+	named, err := docker.ParseNormalizedNamed(ref)
+	if err != nil {
+		return "invalid"
+	}
+	return named.Name()
+}
+
+func unaryMetrics(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	start := time.Now()
+	resp, err := handler(ctx, req)
+	grpcHandled.WithLabelValues(info.FullMethod, status.Code(err).String()).Inc()
+	grpcHandlingSeconds.WithLabelValues(info.FullMethod).Observe(time.Since(start).Seconds())
+	return resp, err
+}
+
+func streamMetrics(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	start := time.Now()
+	active := grpcActiveStreams.WithLabelValues(info.FullMethod)
+	active.Inc()
+	defer active.Dec()
+
+	err := handler(srv, ss)
+	grpcHandled.WithLabelValues(info.FullMethod, status.Code(err).String()).Inc()
+	grpcHandlingSeconds.WithLabelValues(info.FullMethod).Observe(time.Since(start).Seconds())
+	return err
+}
@@ -0,0 +1,23 @@
+package main
+
+import "testing"
+
+func TestRepository(t *testing.T) {
+	tests := []struct {
+		ref, want string
+	}{
+		{"alpine", "docker.io/library/alpine"},
+		{"alpine:3.18", "docker.io/library/alpine"},
+		{"docker.io/library/alpine:latest", "docker.io/library/alpine"},
+		{"library/alpine@sha256:" + "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef", "docker.io/library/alpine"},
+		{"registry.local:5000/team/app:2", "registry.local:5000/team/app"},
+		{"Alpine", "invalid"},
+		{"", "invalid"},
+		{"--rsh=evil", "invalid"},
+	}
+	for _, tt := range tests {
+		if got := repository(tt.ref); got != tt.want {
+			t.Errorf("repository(%q) = %q, want %q", tt.ref, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"deltadiff/api"
+
+	"github.com/containerd/containerd/reference/docker"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// normalizeReference returns the reference img names in its complete form,
+// such as docker.io/library/alpine:3.18 for alpine:3.18; a reference with
+// neither a tag nor a digest counts as :latest. References reach
+// containerd, registries and logs, so anything that doesn't parse, a path
+// or something that reads as an option included, is refused before it is
+// used.
+func normalizeReference(img *api.Image) (string, error) {
+	ref := img.GetReference()
+	if ref == "" {
+		return "", status.Error(codes.InvalidArgument, "image reference is required")
+	}
+	named, err := docker.ParseNormalizedNamed(ref)
+	if err != nil {
+		return "", status.Errorf(codes.InvalidArgument, "invalid image reference %q: %v", ref, err)
+	}
+	return docker.TagNameOnly(named).String(), nil
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"deltadiff/api"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestNormalizeReference(t *testing.T) {
+	const dgst = "sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+	tests := []struct {
+		ref  string
+		want string
+		// code of the error, or OK if the reference is valid
+		code codes.Code
+	}{
+		{ref: "alpine:3.18", want: "docker.io/library/alpine:3.18"},
+		{ref: "alpine", want: "docker.io/library/alpine:latest"},
+		{ref: "library/alpine:3.18", want: "docker.io/library/alpine:3.18"},
+		{ref: "docker.io/alpine:3.18", want: "docker.io/library/alpine:3.18"},
+		{ref: "docker.io/library/alpine:3.18", want: "docker.io/library/alpine:3.18"},
+		{ref: "registry.local:5000/team/app", want: "registry.local:5000/team/app:latest"},
+		{ref: "registry.local:5000/team/app@" + dgst, want: "registry.local:5000/team/app@" + dgst},
+		{ref: "alpine@" + dgst, want: "docker.io/library/alpine@" + dgst},
+		{ref: "alpine:3.18@" + dgst, want: "docker.io/library/alpine:3.18@" + dgst},
+		{ref: "", code: codes.InvalidArgument},
+		{ref: "evil:../../etc/x", code: codes.InvalidArgument},
+		{ref: "--rsh", code: codes.InvalidArgument},
+		{ref: "-e sh", code: codes.InvalidArgument},
+		{ref: "Alpine:3.18", code: codes.InvalidArgument},
+		{ref: "alpine:3.18 --delete", code: codes.InvalidArgument},
+		{ref: "alpine@sha256:abc", code: codes.InvalidArgument},
+	}
+	for _, tt := range tests {
+		t.Run(tt.ref, func(t *testing.T) {
+			got, err := normalizeReference(&api.Image{Reference: tt.ref})
+			if code := status.Code(err); code != tt.code {
+				t.Fatalf("normalizeReference(%q) error = %v, want code %v", tt.ref, err, tt.code)
+			}
+			if got != tt.want {
+				t.Errorf("normalizeReference(%q) = %q, want %q", tt.ref, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNormalizeReferenceNil(t *testing.T) {
+	if _, err := normalizeReference(nil); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("normalizeReference(nil) error = %v, want InvalidArgument", err)
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/platforms"
+	"github.com/containerd/containerd/remotes"
+	"github.com/containerd/containerd/remotes/docker"
+	remoteerrors "github.com/containerd/containerd/remotes/errors"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// resolver returns a resolver for pulling from the configured registries.
+func (c *deltaDiffService) resolver() remotes.Resolver {
+	return docker.NewResolver(docker.ResolverOptions{Hosts: c.hosts})
+}
+
+// requestPlatform returns the platform a request asked for, or the server's
+// own if it didn't name one.
+func requestPlatform(osName, arch, variant, osVersion string) ocispec.Platform {
+	if osName == "" && arch == "" {
+		return platforms.DefaultSpec()
+	}
+	return platforms.Normalize(ocispec.Platform{
+		OS:           osName,
+		Architecture: arch,
+		Variant:      variant,
+		OSVersion:    osVersion,
+	})
+}
+
+// pullError returns the status for a failed pull of ref, telling a missing
+// image and a registry refusing the server's credentials apart from a
+// registry that can't be reached.
+func pullError(ref string, err error) error {
+	var unexpected remoteerrors.ErrUnexpectedStatus
+	switch {
+	case errors.Is(err, docker.ErrInvalidAuthorization),
+		errors.As(err, &unexpected) && (unexpected.StatusCode == http.StatusUnauthorized || unexpected.StatusCode == http.StatusForbidden):
+		return status.Errorf(codes.PermissionDenied, "registry refused to serve %s, check the server's registry credentials: %v", ref, err)
+	case errdefs.IsNotFound(err):
+		return status.Errorf(codes.NotFound, "error pulling image %s: %v", ref, err)
+	case errdefs.IsInvalidArgument(err):
+		return status.Errorf(codes.InvalidArgument, "error pulling image %s: %v", ref, err)
+	}
+	return status.Errorf(codes.Unavailable, "error pulling image %s: %v", ref, err)
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"deltadiff/manifest"
+	"deltadiff/telemetry"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/platforms"
+	"github.com/containerd/containerd/remotes"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// Schema1 manifests larger than this are refused.
+const maxSchema1Size = 8 << 20
+
+// localImage returns ref for platform if it has already been pulled and
+// unpacked.
+func (c *deltaDiffService) localImage(ctx context.Context, ref string, platform ocispec.Platform) (containerd.Image, bool) {
+	img, err := c.client.ImageService().Get(ctx, ref)
+	if err != nil {
+		return nil, false
+	}
+	image := containerd.NewImageWithPlatform(c.client, img, platforms.Only(platform))
+	unpacked, err := image.IsUnpacked(ctx, c.snapshotter)
+	return image, err == nil && unpacked
+}
+
+// pullImage pulls ref for platform and unpacks it, recording how long that
+// took. Failures are returned as a gRPC status.
+func (c *deltaDiffService) pullImage(ctx context.Context, ref string, platform ocispec.Platform) (_ containerd.Image, err error) {
+	ctx, span := telemetry.StartSpan(ctx, "pull",
+		attribute.String("image", ref),
+		attribute.String("platform", platforms.Format(platform)))
+	defer telemetry.End(span, &err)
+
+	start := time.Now()
+	image, err := c.pull(ctx, ref, platform)
+	if err != nil {
+		return nil, pullError(ref, err)
+	}
+	imagePullSeconds.WithLabelValues(repository(ref)).Observe(time.Since(start).Seconds())
+	return image, nil
+}
+
+// pull pulls ref for platform, leaving out the content of other platforms,
+// and unpacks it. containerd no longer converts Docker schema1 images, so
+// those are fetched here and converted to schema2 with the manifest package
+// before the image is created.
+func (c *deltaDiffService) pull(ctx context.Context, ref string, platform ocispec.Platform) (containerd.Image, error) {
+	resolver := c.resolver()
+	name, desc, err := resolver.Resolve(ctx, ref)
+	if err != nil {
+		return nil, err
+	}
+	if desc.MediaType != images.MediaTypeDockerSchema1Manifest {
+		return c.client.Pull(ctx, ref,
+			containerd.WithPullUnpack,
+			containerd.WithPullSnapshotter(c.snapshotter),
+			containerd.WithResolver(resolver),
+			containerd.WithPlatformMatcher(platforms.Only(platform)))
+	}
+
+	log.G(ctx).WithField("image", ref).Info("image is schema1, converting it to schema2")
+	ctx, done, err := c.client.WithLease(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer done(ctx)
+
+	fetcher, err := resolver.Fetcher(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if desc.Size > maxSchema1Size {
+		return nil, fmt.Errorf("manifest of %s is larger than %d bytes", ref, maxSchema1Size)
+	}
+	rc, err := fetcher.Fetch(ctx, desc)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching manifest: %w", err)
+	}
+	p, err := io.ReadAll(io.LimitReader(rc, maxSchema1Size+1))
+	rc.Close()
+	if err != nil {
+		return nil, fmt.Errorf("error fetching manifest: %w", err)
+	}
+	if len(p) > maxSchema1Size {
+		return nil, fmt.Errorf("manifest of %s is larger than %d bytes", ref, maxSchema1Size)
+	}
+	// The manifest is converted into an image of its own, so nothing but
+	// the digest that was resolved vouches for it.
+	if err := manifest.VerifySchema1(p, desc.Digest); err != nil {
+		return nil, fmt.Errorf("error fetching manifest of %s: %w", ref, err)
+	}
+
+	layers, err := manifest.Schema1Layers(p)
+	if err != nil {
+		return nil, err
+	}
+	cs := c.client.ContentStore()
+	for _, layer := range layers {
+		if _, err := cs.Info(ctx, layer.Digest); err == nil {
+			continue
+		}
+		rc, err := fetcher.Fetch(ctx, layer)
+		if err != nil {
+			return nil, fmt.Errorf("error fetching layer %s: %w", layer.Digest, err)
+		}
+		err = manifest.WriteBlob(ctx, cs, remotes.MakeRefKey(ctx, layer), rc, layer, nil)
+		rc.Close()
+		if err != nil {
+			return nil, fmt.Errorf("error fetching layer %s: %w", layer.Digest, err)
+		}
+	}
+
+	m, err := manifest.ConvertSchema1(ctx, cs, p, manifest.FormatDocker)
+	if err != nil {
+		return nil, err
+	}
+	img := images.Image{Name: name, Target: m.Descriptor()}
+	if _, err := c.client.ImageService().Create(ctx, img); err != nil {
+		if !errdefs.IsAlreadyExists(err) {
+			return nil, err
+		}
+		if _, err := c.client.ImageService().Update(ctx, img, "target"); err != nil {
+			return nil, err
+		}
+	}
+	stored, err := c.client.ImageService().Get(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	image := containerd.NewImageWithPlatform(c.client, stored, platforms.Only(platform))
+	if err := image.Unpack(ctx, c.snapshotter); err != nil {
+		return nil, fmt.Errorf("error unpacking image: %w", err)
+	}
+	return image, nil
+}
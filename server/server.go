@@ -4,410 +4,421 @@ import (
 	"context"
 	"deltadiff/api"
 	"deltadiff/manifest"
+	"deltadiff/telemetry"
 	"fmt"
-	"net"
+	"io"
 	"os"
 	"os/exec"
-	"os/signal"
-	"runtime"
-	"strings"
+	"path/filepath"
 	"strconv"
-	"sync"
-	"syscall"
 	"time"
 
-	"go.mongodb.org/mongo-driver/bson"
-	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 
 	"github.com/containerd/containerd"
 	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/errdefs"
 	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/log"
 	"github.com/containerd/containerd/mount"
+	"github.com/containerd/containerd/namespaces"
+	"github.com/containerd/containerd/remotes/docker"
 	"github.com/containerd/containerd/snapshots"
+	digest "github.com/opencontainers/go-digest"
 	"github.com/opencontainers/image-spec/identity"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/sync/singleflight"
 )
 
-var SERVER_ADDRESS string
-
 const CHUNK_SIZE = 32 * 1024
 const RSYNC_BLOCK_SIZE = 382
 
 type deltaDiffService struct {
 	client *containerd.Client
 
+	// snapshotter the images are unpacked with
+	snapshotter string
+	// directory the delta patches are written to and cached in
+	tmpDir string
+	// namespace used when a request doesn't name one
+	namespace string
+	// namespaces, besides the default, that requests may select
+	allowedNamespaces map[string]bool
+	// registries images are pulled from, with their credentials
+	hosts docker.RegistryHosts
+
 	// embed the unimplemented server
 	api.UnimplementedDeltaDiffServiceServer
 }
 
-func (c *deltaDiffService) GetManifest(ctx context.Context, r *api.ManifestRequest) (*api.ManifestResponse, error) {
-	fmt.Println("GetManifest was called")
-
-	contentStore := c.client.ContentStore()
-
-	// Check if image reference is provided
-	if r.Image.Reference == "" {
-		return &api.ManifestResponse{Manifest: nil}, status.Errorf(codes.InvalidArgument, "image reference is required")
-	}
-
-	image, err := c.client.GetImage(ctx, r.Image.Reference)
-	if err != nil {
-		fmt.Printf("Image %v not found, pulling...\n", r.Image.Reference)
-		image, err = c.client.Pull(ctx, r.Image.Reference, containerd.WithPullUnpack)
-		if err != nil {
-			return &api.ManifestResponse{Manifest: nil}, status.Errorf(codes.InvalidArgument, "error pulling image %v: %v", r.Image.Reference, err)
-		}
+// withNamespace returns ctx scoped to the containerd namespace a request
+// asked for, or to the default one if it asked for none.
+func (c *deltaDiffService) withNamespace(ctx context.Context, requested string) (context.Context, string, error) {
+	ns := requested
+	if ns == "" {
+		ns = c.namespace
 	}
-
-	target_manifest, err := manifest.LoadManifest(ctx, contentStore, image.Target())
-	if err != nil {
-		fmt.Println(err)
-		return nil, status.Errorf(codes.InvalidArgument, "error loading manifest: %v", err)
+	if ns != c.namespace && !c.allowedNamespaces[ns] {
+		return nil, "", status.Errorf(codes.PermissionDenied, "namespace %q is not served", ns)
 	}
+	return namespaces.WithNamespace(ctx, ns), ns, nil
+}
 
-	m_impl, err := manifest.LoadManifestImpl(ctx, contentStore, image.Target())
+func (c *deltaDiffService) GetManifest(ctx context.Context, r *api.ManifestRequest) (*api.ManifestResponse, error) {
+	ctx, _, err := c.withNamespace(ctx, r.Namespace)
 	if err != nil {
-		fmt.Println(err)
-		return nil, status.Errorf(codes.InvalidArgument, "error loading manifest impl: %v", err)
+		return nil, err
 	}
 
-	if target_manifest.Descriptor().MediaType == images.MediaTypeDockerSchema2ManifestList {
-		// Retrieve manifest for specific platform
-		target_manifest, err = manifest.LoadManifestFromList(ctx, image.Target(), contentStore, r.Os, r.Arch)
-		if err != nil {
-			fmt.Println(err)
-			return nil, status.Errorf(codes.InvalidArgument, "error loading manifest from list: %v", err)
-		}
-
-		m_impl, err = manifest.LoadManifestImplFromList(ctx, image.Target(), contentStore, runtime.GOOS, runtime.GOARCH)
-		if err != nil {
-			fmt.Println(err)
-			return nil, status.Errorf(codes.InvalidArgument, "error loading manifest from list: %v", err)
-		}
-	}
+	contentStore := c.client.ContentStore()
 
-	// Deserialize the image config
-	imageConfigDesc, err := manifest.GetDescriptor(m_impl.D["config"])
+	image, m_impl, err := c.loadManifest(ctx, r.Image, r.Os, r.Arch, r.Variant, r.OsVersion)
 	if err != nil {
-		return nil, status.Errorf(codes.InvalidArgument, "error getting image config descriptor: %v", err)
+		return nil, err
 	}
 
 	// Get the image configuration.
-	fmt.Println(imageConfigDesc)
+	imageConfigDesc := m_impl.Config()
+	log.G(ctx).WithField("config", imageConfigDesc.Digest).Debug("reading image config")
 	p, err := content.ReadBlob(ctx, contentStore, imageConfigDesc)
 	if err != nil {
 		return nil, status.Errorf(codes.InvalidArgument, "error reading image config blob: %v", err)
 	}
 
-	manifest_bytes, err := bson.Marshal(target_manifest)
-	if err != nil {
-		fmt.Println("Error Marshalling Manifest", err)
-		return &api.ManifestResponse{Manifest: nil}, status.Errorf(codes.InvalidArgument, "error marshalling manifest: %v", err)
-	}
-
-	return &api.ManifestResponse{
-		Manifest:    manifest_bytes,
+	// The manifest is sent as stored, so the client can rebuild it without
+	// losing fields we don't know about.
+	resp := &api.ManifestResponse{
+		Manifest:    m_impl.Bytes(),
+		MediaType:   m_impl.Descriptor().MediaType,
 		ImageConfig: p,
-	}, nil
-
-}
-
-
-
-var mutexes map[string]*sync.Mutex
-
-func init() {
-    mutexes = make(map[string]*sync.Mutex)
-}
-
+		ImageDigest: image.Target().Digest.String(),
+	}
 
-func (c *deltaDiffService) CalculateDeltaDiffs(r *api.CalcImageDiffsRequest, stream api.DeltaDiffService_CalculateDeltaDiffsServer) error {
-	fmt.Println("CalculateDeltaDiffs was called")
-
-	ctx := context.Background()
-
-	// Before anything, check if the diff file already exists
-	// If it does, we can just send it to the client
-	image1name := strings.Split(r.Image1.Reference, "/")[len(strings.Split(r.Image1.Reference, "/"))-1]
-	image2name := strings.Split(r.Image2.Reference, "/")[len(strings.Split(r.Image2.Reference, "/"))-1]
-	patch_location := fmt.Sprintf("/tmp/delta-patch-from-%s-to-%s.zst", image1name, image2name)
-	
-	// We use mutexes to check whether another proccess is currently creating a patch file.
-	// If it does, there is no need to create it twice.
-	mutex, exists := mutexes[patch_location]
-    if !exists {
-        mutex = &sync.Mutex{}
-        mutexes[patch_location] = mutex
-    }
-	
-	// The critical section is checking the if condition.
-	mutexes[patch_location].Lock()
-	if _, err := os.Stat(patch_location); err == nil {
-		// If the patchfile already exists, it can be sent and there is no need for the mutex to be locked
-		mutexes[patch_location].Unlock()
-		fmt.Printf("File %s already exists, sending to client...\n", patch_location)
-
-		file, err := os.Open(patch_location)
+	// Send the index too if it lists the manifest, so the client can
+	// store the image under its original digest.
+	if images.IsIndexType(image.Target().MediaType) {
+		index, err := manifest.LoadImageIndex(ctx, contentStore, image.Target())
 		if err != nil {
-			return status.Errorf(codes.InvalidArgument, "error reading diff patch file: %v", err)
+			return nil, status.Errorf(codes.InvalidArgument, "error loading index: %v", err)
 		}
-		defer file.Close()
-
-		timeToTransferDeltaStart := time.Now()
-
-		buf := make([]byte, CHUNK_SIZE)
-		for {
-			n, err := file.Read(buf)
-			//fmt.Println(n)
-			if err != nil {
-				// fmt.Println(err)
+		for _, desc := range index.Manifests() {
+			if desc.Digest == m_impl.Descriptor().Digest {
+				resp.Index = index.Bytes()
+				resp.IndexMediaType = index.Descriptor().MediaType
 				break
 			}
-			if err := stream.Send(&api.CalculateDeltaDiffsResponse{DeltaDiff: buf[:n]}); err != nil {
-				return status.Errorf(codes.InvalidArgument, "error sending diff patch file: %v", err)
-			}
 		}
+	}
+	return resp, nil
+
+}
 
-		timeToTransferDelta := time.Since(timeToTransferDeltaStart)
+// loadManifest returns the image ref and its manifest for the requested
+// platform, pulling the image if it isn't available yet. Docker manifest
+// lists and OCI indexes, nested ones included, are resolved to the best
+// match.
+func (c *deltaDiffService) loadManifest(ctx context.Context, ref *api.Image, osName, arch, variant, osVersion string) (containerd.Image, *manifest.ImageManifest, error) {
+	name, err := normalizeReference(ref)
+	if err != nil {
+		return nil, nil, err
+	}
 
-		fileInfo, err := os.Stat(patch_location)
+	platform := requestPlatform(osName, arch, variant, osVersion)
+	image, ok := c.localImage(ctx, name, platform)
+	if !ok {
+		log.G(ctx).WithField("image", name).Info("image not found, pulling")
+		image, err = c.pullImage(ctx, name, platform)
 		if err != nil {
-			fmt.Println("Error:", err)
-			return err
+			return nil, nil, err
 		}
+	}
+	m, err := manifest.LoadManifestForPlatform(ctx, c.client.ContentStore(), image.Target(), platform)
+	if err != nil {
+		if errdefs.IsNotFound(err) {
+			return nil, nil, status.Errorf(codes.NotFound, "error loading manifest: %v", err)
+		}
+		return nil, nil, status.Errorf(codes.InvalidArgument, "error loading manifest: %v", err)
+	}
+	return image, m, nil
+}
 
-		// Get the file size in bytes from the file info
-		fileSizeBytes := fileInfo.Size()
-
-		// Convert file size to megabytes
-		fileSizeMB := float64(fileSizeBytes) / 1048576.0
-
-		fmt.Printf("Transferred %v MB worth of Δ in %vs\n", fileSizeMB, timeToTransferDelta.Seconds())
+// patches makes sure each patch is made only once at a time: requests for a
+// patch that is being made wait for it and share the outcome.
+var patches singleflight.Group
 
-		return nil
+func (c *deltaDiffService) CalculateDeltaDiffs(r *api.CalcImageDiffsRequest, stream api.DeltaDiffService_CalculateDeltaDiffsServer) error {
+	// The patch is cached for later requests, so it is made to completion
+	// even if this client goes away; only the request's logger and span
+	// are kept.
+	ctx := trace.ContextWithSpan(context.Background(), trace.SpanFromContext(stream.Context()))
+	ctx = log.WithLogger(ctx, log.G(stream.Context()).WithFields(log.Fields{
+		"base":   r.Image1.GetReference(),
+		"target": r.Image2.GetReference(),
+	}))
+	ctx, _, err := c.withNamespace(ctx, r.Namespace)
+	if err != nil {
+		return err
 	}
-
-	// Check if image references are provided
-	if r.Image1.Reference == "" || r.Image2.Reference == "" {
-		return status.Errorf(codes.InvalidArgument, "image references are required")
+	base, err := normalizeReference(r.Image1)
+	if err != nil {
+		return err
+	}
+	target, err := normalizeReference(r.Image2)
+	if err != nil {
+		return err
 	}
+	repo := repository(target)
+	// Only the requested platform is pulled and diffed.
+	platform := requestPlatform(r.Os, r.Arch, r.Variant, r.OsVersion)
 
 	timeStartPullImages := time.Now()
 
 	// Get images; if they don't exist, pull them
-	image1, err := c.client.GetImage(ctx, r.Image1.Reference)
-	if err != nil {
-		fmt.Printf("Image %v not found, pulling...\n", r.Image1.Reference)
-		image1, err = c.client.Pull(ctx, r.Image1.Reference, containerd.WithPullUnpack)
+	image1, ok := c.localImage(ctx, base, platform)
+	if !ok {
+		log.G(ctx).WithField("image", base).Info("image not found, pulling")
+		sendPhase(ctx, stream, api.DeltaPhase_DELTA_PHASE_PULLING, 0)
+		image1, err = c.pullImage(ctx, base, platform)
 		if err != nil {
-			return status.Errorf(codes.InvalidArgument, "error pulling image %v: %v", r.Image1.Reference, err)
+			return err
 		}
 	}
 
-	image2, err := c.client.GetImage(ctx, r.Image2.Reference)
-	if err != nil {
-		fmt.Printf("Image %v not found, pulling...\n", r.Image2.Reference)
-		image2, err = c.client.Pull(ctx, r.Image2.Reference, containerd.WithPullUnpack)
+	image2, ok := c.localImage(ctx, target, platform)
+	if !ok {
+		log.G(ctx).WithField("image", target).Info("image not found, pulling")
+		sendPhase(ctx, stream, api.DeltaPhase_DELTA_PHASE_PULLING, 0)
+		image2, err = c.pullImage(ctx, target, platform)
 		if err != nil {
-			return status.Errorf(codes.InvalidArgument, "error pulling image %v: %v", r.Image2.Reference, err)
+			return err
 		}
 	}
 
 	// Most useful when images are not available locally
 	timeToPullImages := time.Since(timeStartPullImages)
+	log.G(ctx).WithFields(log.Fields{"phase": "pull", "duration": timeToPullImages}).Info("images ready")
+
+	// Patches are named after the images' content, so images with the same
+	// manifests share a patch, whatever their names or namespaces.
+	name, err := patchName(ctx, c.client.ContentStore(), image1, image2, platform)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(c.tmpDir, name+".zst")
+	// Do runs the function in this goroutine if it runs it at all.
+	ran := false
+	made, err, _ := patches.Do(path, func() (interface{}, error) {
+		ran = true
+		return c.makePatch(ctx, stream, image1, image2, name, repo)
+	})
+	if err != nil {
+		return err
+	}
+	hit := !ran || !made.(bool)
+	if hit {
+		log.G(ctx).WithField("patch", path).Info("sending cached patch")
+		deltaRequests.WithLabelValues(repo, "hit").Inc()
+	} else {
+		deltaRequests.WithLabelValues(repo, "miss").Inc()
+	}
+	return sendPatch(ctx, stream, path, repo, hit)
+}
+
+// makePatch makes the patch from image1 to image2 in c.tmpDir, unless it
+// exists already, and reports whether it made it. The patch is compressed
+// into a temporary file that is only renamed into place once complete, so a
+// failed attempt never leaves a patch behind for later requests to send.
+func (c *deltaDiffService) makePatch(ctx context.Context, stream api.DeltaDiffService_CalculateDeltaDiffsServer, image1, image2 containerd.Image, name, repo string) (bool, error) {
+	path := filepath.Join(c.tmpDir, name+".zst")
+	if _, err := os.Stat(path); err == nil {
+		return false, nil
+	}
 
 	// Get image snapshots
-	snapshotter := c.client.SnapshotService("overlayfs")
+	snapshotter := c.client.SnapshotService(c.snapshotter)
 	defer snapshotter.Close()
 
 	// Get mounts for snapshots
-	var mounts1, mounts2 []mount.Mount
-	var key1, key2 string
-	mounts1, key1, err = getMounts(ctx, snapshotter, image1)
+	_, span := telemetry.StartSpan(ctx, "mount")
+	mounts1, key1, err := getMounts(ctx, snapshotter, image1)
 	if err != nil {
-		fmt.Println("Could not get mounts for image1.")
-		return status.Errorf(codes.InvalidArgument, "error getting mounts (lower): %v", err)
+		telemetry.End(span, &err)
+		return false, status.Errorf(codes.InvalidArgument, "error getting mounts (lower): %v", err)
+	}
+	if key1 != "" {
+		defer snapshotter.Remove(ctx, key1)
 	}
-	defer snapshotter.Remove(ctx, key1)
 
-	mounts2, key2, err = getMounts(ctx, snapshotter, image2)
+	mounts2, key2, err := getMounts(ctx, snapshotter, image2)
+	telemetry.End(span, &err)
 	if err != nil {
-		return status.Errorf(codes.InvalidArgument, "error getting mounts (upper): %v", err)
+		return false, status.Errorf(codes.InvalidArgument, "error getting mounts (upper): %v", err)
+	}
+	if key2 != "" {
+		defer snapshotter.Remove(ctx, key2)
 	}
-	defer snapshotter.Remove(ctx, key2)
-
-	fmt.Println("mounts2: ", mounts2)
 
+	timeCreateDeltaStart := time.Now()
 	if err := mount.WithTempMount(ctx, mounts1, func(from_root string) error {
 		return mount.WithTempMount(ctx, mounts2, func(to_root string) error {
-			fmt.Println("from_root: ", from_root)
-			fmt.Println("to_root: ", to_root)
+			log.G(ctx).WithFields(log.Fields{"from": from_root, "to": to_root}).Debug("snapshots mounted")
 
-			timeCreateDeltaStart := time.Now()
 			rsyncBlockSize := strconv.Itoa(RSYNC_BLOCK_SIZE)
-			patch_filename := fmt.Sprintf("delta-patch-from-%s-to-%s", image1name, image2name)
 			// execute rsync between from and to and create binary diff file
 			cmd := exec.Command("rsync",
 				"-avH",
 				"--partial",
 				"--delete",
-				"--only-write-batch="+patch_filename,
+				"--only-write-batch="+name,
 				"--block-size="+rsyncBlockSize,
 				"--no-i-r",
 				"--one-file-system",
-				to_root+"/", from_root+"/")
-			cmd.Dir = "/tmp"
+				"--", to_root+"/", from_root+"/")
+			cmd.Dir = c.tmpDir
 
+			sendPhase(ctx, stream, api.DeltaPhase_DELTA_PHASE_GENERATING, 0)
+			_, span := telemetry.StartSpan(ctx, "rsync")
 			output, err := cmd.CombinedOutput()
-			fmt.Println(string(output))
-
+			telemetry.End(span, &err)
+			log.G(ctx).WithField("phase", "delta").Debugf("rsync output:\n%s", output)
 			if err != nil {
 				return status.Errorf(codes.InvalidArgument, "error creating diff patch: %v", err)
-			}		
-			
-			// At this point the patch is created, so the other processes can continue
-			
-			fmt.Println(patch_location)
-			fmt.Println(mutexes)
-			
-			
-			patch_location := "/tmp/" + patch_filename
-
-			// Compress the diff patch file with zstd
-			cmd = exec.Command("zstd", "-f", "-q", "-9", "-o", patch_location+".zst", patch_location)
-			cmd.Dir = "/tmp"
-			output, err = cmd.CombinedOutput()
-			fmt.Println(string(output))
-			mutex.Unlock()
-			if err != nil {
-				return status.Errorf(codes.InvalidArgument, "error creating diff patch: %v", err)
-			}
-
-			file, err := os.Open(patch_location + ".zst")
-			if err != nil {
-				return status.Errorf(codes.InvalidArgument, "error reading diff patch file: %v", err)
 			}
-			defer file.Close()
-
-			timeToCreateDelta := time.Since(timeCreateDeltaStart)
-
-			timeToTransferDeltaStart := time.Now()
-
-			buf := make([]byte, CHUNK_SIZE)
-			for {
-				n, err := file.Read(buf)
-				//fmt.Println(n)
-				if err != nil {
-					// fmt.Println(err)
-					break
-				}
-				if err := stream.Send(&api.CalculateDeltaDiffsResponse{DeltaDiff: buf[:n]}); err != nil {
-					return status.Errorf(codes.InvalidArgument, "error sending diff patch file: %v", err)
-				}
-			}
-
-			timeToTransferDelta := time.Since(timeToTransferDeltaStart)
-
-			// get file size of /tmp/delta-patch
-
-			filepath := patch_location + ".zst"
-			fileInfo, err := os.Stat(filepath)
-			if err != nil {
-				fmt.Println("Error:", err)
-				return err
-			}
-
-			// Get the file size in bytes from the file info
-			fileSizeBytes := fileInfo.Size()
-
-			// Convert file size to megabytes
-			fileSizeMB := float64(fileSizeBytes) / 1048576.0
-
-			// Get the image size
-			imageSizeBytes, err := image2.Size(ctx)
-			if err != nil {
-				fmt.Println("Error getting image info:", err)
-				return err
-			}
-
-			// Convert image size to megabytes
-			imageSizeMB := float64(imageSizeBytes) / 1048576.0
-
-			fmt.Printf("File size of %s: %.2f MB\n", filepath, fileSizeMB)
-			fmt.Printf("Size of compressed image is %.2f MB\n", float64(imageSizeMB))
-			fmt.Printf("Compression ratio: %.2f\n", float64((imageSizeMB))/fileSizeMB)
-			fmt.Printf("Compressed to: %.2f%% of initial image size \n", float64(fileSizeMB/imageSizeMB)*100)
-			fmt.Println("------TIME STATISTICS------")
-			fmt.Printf("Time to pull images: %v\n", timeToPullImages)
-			fmt.Printf("Time to create delta: %v\n", timeToCreateDelta)
-			fmt.Printf("Time to transfer delta: %v\n", timeToTransferDelta)
-
 			return nil
-
 		})
 	}); err != nil {
-		return status.Errorf(codes.InvalidArgument, "error creating snapshot diffs: %v", err)
+		return false, status.Errorf(codes.InvalidArgument, "error creating snapshot diffs: %v", err)
 	}
-	return nil
-}
 
-func main() {
-
-	// Create a gRPC server
-	rpc := grpc.NewServer()
-
-	client, e := containerd.New("/run/containerd/containerd.sock", containerd.WithDefaultNamespace("default"))
-	if e != nil {
-		fmt.Printf("error: %v\n", e)
-		os.Exit(1)
+	// Compress the diff patch file with zstd
+	batch := filepath.Join(c.tmpDir, name)
+	partial := path + ".part"
+	defer os.Remove(partial)
+	cmd := exec.Command("zstd", "-f", "-q", "-9", "-o", partial, "--", batch)
+	cmd.Dir = c.tmpDir
+	sendPhase(ctx, stream, api.DeltaPhase_DELTA_PHASE_COMPRESSING, 0)
+	_, span = telemetry.StartSpan(ctx, "zstd")
+	output, err := cmd.CombinedOutput()
+	telemetry.End(span, &err)
+	log.G(ctx).WithField("phase", "compress").Debugf("zstd output:\n%s", output)
+	if err != nil {
+		return false, status.Errorf(codes.InvalidArgument, "error creating diff patch: %v", err)
+	}
+	if err := os.Rename(partial, path); err != nil {
+		return false, status.Errorf(codes.Internal, "error storing diff patch: %v", err)
 	}
 
-	api.RegisterDeltaDiffServiceServer(rpc, &deltaDiffService{client: client})
+	timeToCreateDelta := time.Since(timeCreateDeltaStart)
+	deltaGenerationSeconds.WithLabelValues(repo).Observe(timeToCreateDelta.Seconds())
 
-	// Listen and serve
-	// For IPv4, use:   ("tcp", IP_ADDRESS:PORT)
-	// For unix sockets, use: ("unix", "/var/run/mydiffer.sock")
+	fileInfo, err := os.Stat(path)
+	if err != nil {
+		return false, err
+	}
+	// Convert the sizes to megabytes
+	fileSizeMB := float64(fileInfo.Size()) / 1048576.0
+	imageSizeBytes, err := image2.Size(ctx)
+	if err != nil {
+		return false, fmt.Errorf("error getting image info: %w", err)
+	}
+	imageSizeMB := float64(imageSizeBytes) / 1048576.0
+
+	deltaSize.WithLabelValues(repo).Observe(float64(fileInfo.Size()))
+	deltaCompressionRatio.WithLabelValues(repo).Observe(imageSizeMB / fileSizeMB)
+
+	log.G(ctx).WithFields(log.Fields{
+		"phase":             "delta",
+		"patch":             path,
+		"size_mb":           fileSizeMB,
+		"image_size_mb":     imageSizeMB,
+		"compression_ratio": imageSizeMB / fileSizeMB,
+		"duration":          timeToCreateDelta,
+	}).Info("patch created")
+	return true, nil
+}
 
-	if len(os.Args) != 2 {
-		fmt.Println("Usage: server <addr>")
-		return
+// sendPatch streams the patch at path to the client; hit tells whether it
+// was made for an earlier request.
+func sendPatch(ctx context.Context, stream api.DeltaDiffService_CalculateDeltaDiffsServer, path, repo string, hit bool) (err error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return status.Errorf(codes.InvalidArgument, "error reading diff patch file: %v", err)
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return status.Errorf(codes.InvalidArgument, "error reading diff patch file: %v", err)
 	}
 
-	SERVER_ADDRESS = os.Args[1]
+	_, span := telemetry.StartSpan(ctx, "transfer", attribute.Bool("cached", hit))
+	defer telemetry.End(span, &err)
+	timeToTransferDeltaStart := time.Now()
+	sendPhase(ctx, stream, api.DeltaPhase_DELTA_PHASE_SENDING, info.Size())
 
-	// Check if address is unix socket or ip address
+	buf := make([]byte, CHUNK_SIZE)
+	for {
+		n, err := file.Read(buf)
+		if n > 0 {
+			if err := stream.Send(&api.CalculateDeltaDiffsResponse{DeltaDiff: buf[:n]}); err != nil {
+				return status.Errorf(codes.InvalidArgument, "error sending diff patch file: %v", err)
+			}
+			bytesServed.WithLabelValues(repo, "delta").Add(float64(n))
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return status.Errorf(codes.InvalidArgument, "error reading diff patch file: %v", err)
+		}
+	}
 
-	var addressType string
+	timeToTransferDelta := time.Since(timeToTransferDeltaStart)
+	cache := "miss"
+	if hit {
+		cache = "hit"
+	}
+	deltaTransferSeconds.WithLabelValues(repo, cache).Observe(timeToTransferDelta.Seconds())
+
+	log.G(ctx).WithFields(log.Fields{
+		"phase":    "transfer",
+		"patch":    path,
+		"size_mb":  float64(info.Size()) / 1048576.0,
+		"duration": timeToTransferDelta,
+	}).Info("patch sent")
+	return nil
+}
 
-	if strings.HasPrefix(SERVER_ADDRESS, "/") {
-		addressType = "unix"
-	} else {
-		addressType = "tcp"
+// sendPhase tells the client what the server is working on, so it can show
+// progress. The patch is made whether or not the client is still there, so
+// a failure is only logged; sending the patch itself will fail too.
+func sendPhase(ctx context.Context, stream api.DeltaDiffService_CalculateDeltaDiffsServer, phase api.DeltaPhase, totalSize int64) {
+	if err := stream.Send(&api.CalculateDeltaDiffsResponse{Phase: phase, TotalSize: totalSize}); err != nil {
+		log.G(ctx).WithError(err).WithField("phase", phase).Debug("failed to send progress")
 	}
+}
 
-	l, err := net.Listen(addressType, SERVER_ADDRESS)
+// patchName returns the file name of the patch from base to target. It is
+// made only of the digests of their manifests for platform, so nothing a
+// client sends ends up in a path or an rsync argument, and a tag that moved
+// to another image gets a patch of its own.
+func patchName(ctx context.Context, cs content.Store, base, target containerd.Image, platform ocispec.Platform) (string, error) {
+	from, err := manifest.ResolvePlatform(ctx, cs, base.Target(), platform)
 	if err != nil {
-		fmt.Printf("error: %v\n", err)
-		return
+		return "", status.Errorf(codes.NotFound, "error resolving base manifest: %v", err)
 	}
-	defer l.Close()
-
-	go func() {
-		if err := rpc.Serve(l); err != nil {
-			fmt.Printf("error: %v\n", err)
-			return
+	to, err := manifest.ResolvePlatform(ctx, cs, target.Target(), platform)
+	if err != nil {
+		return "", status.Errorf(codes.NotFound, "error resolving target manifest: %v", err)
+	}
+	for _, d := range []digest.Digest{from.Digest, to.Digest} {
+		if err := d.Validate(); err != nil {
+			return "", status.Errorf(codes.Internal, "invalid manifest digest %q: %v", d, err)
 		}
-		defer rpc.Stop()
-	}()
-
-	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
-
-	// Block until a signal is received.
-	s := <-c
-	fmt.Println("Got signal, will now exit gracefully...:", s)
-
+	}
+	return fmt.Sprintf("delta-patch-from-%s-to-%s", from.Digest.Encoded(), to.Digest.Encoded()), nil
 }
 
 func getMounts(ctx context.Context, sn snapshots.Snapshotter, image containerd.Image) ([]mount.Mount, string, error) {
@@ -433,7 +444,7 @@ func getMounts(ctx context.Context, sn snapshots.Snapshotter, image containerd.I
 			return nil, "", err
 		}
 	} else {
-		key := fmt.Sprintf("%s-view-%s", identity.ChainID(diffIDs).String(), time.Now().Format(time.RFC3339Nano))
+		key = fmt.Sprintf("%s-view-%s", identity.ChainID(diffIDs).String(), time.Now().Format(time.RFC3339Nano))
 		mounts, err = sn.View(ctx, key, identity.ChainID(diffIDs).String())
 		if err != nil {
 			return nil, "", err
@@ -441,15 +452,3 @@ func getMounts(ctx context.Context, sn snapshots.Snapshotter, image containerd.I
 	}
 	return mounts, key, nil
 }
-
-func RetrieveImage(ctx context.Context, client *containerd.Client, imageRef string) (containerd.Image, error) {
-	image, err := client.GetImage(ctx, imageRef)
-	if err != nil {
-		fmt.Printf("Image %v not found, pulling...\n", imageRef)
-		image, err = client.Pull(ctx, imageRef, containerd.WithPullUnpack)
-		if err != nil {
-			return nil, err
-		}
-	}
-	return image, nil
-}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd/log"
+	"google.golang.org/grpc/credentials"
+)
+
+// certReloader serves the TLS certificate, and the CA bundle clients are
+// verified against, from files that are read again whenever they change,
+// so certificates can be rotated without restarting the server.
+type certReloader struct {
+	certFile, keyFile string
+	// empty unless clients must present a certificate
+	clientCAFile string
+
+	mu sync.Mutex
+	// latest modification time of the files when they were loaded
+	modTime time.Time
+	config  *tls.Config
+	// latest modification time of files that couldn't be loaded; they are
+	// only tried again once they change
+	failedModTime time.Time
+	// whether a file was missing on the previous handshake
+	missing bool
+}
+
+// serverCredentials returns TLS credentials for the certificate in certFile
+// and keyFile. If clientCAFile is set, clients must present a certificate
+// signed by one of its CAs.
+func serverCredentials(certFile, keyFile, clientCAFile string) (credentials.TransportCredentials, error) {
+	if certFile == "" || keyFile == "" {
+		return nil, errors.New("--tls-cert and --tls-key are required, or use --insecure to serve without TLS")
+	}
+	r := &certReloader{certFile: certFile, keyFile: keyFile, clientCAFile: clientCAFile}
+	modTime, err := r.latestModTime()
+	if err != nil {
+		return nil, err
+	}
+	if err := r.load(modTime); err != nil {
+		return nil, err
+	}
+	return credentials.NewTLS(&tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		GetConfigForClient: r.getConfig,
+	}), nil
+}
+
+// getConfig returns the configuration for a new connection, reloading the
+// files first if they changed. If they can't be loaded, for example because
+// only the certificate has been replaced yet, the previous configuration is
+// kept, and the files aren't read again until they change once more.
+func (r *certReloader) getConfig(*tls.ClientHelloInfo) (*tls.Config, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	modTime, err := r.latestModTime()
+	if err != nil {
+		if !r.missing {
+			log.L.WithError(err).Warn("cannot reload TLS certificate, keeping the previous one")
+			r.missing = true
+		}
+		return r.config, nil
+	}
+	r.missing = false
+	if !modTime.After(r.modTime) || modTime.Equal(r.failedModTime) {
+		return r.config, nil
+	}
+	if err := r.load(modTime); err != nil {
+		r.failedModTime = modTime
+		log.L.WithError(err).Warn("cannot reload TLS certificate, keeping the previous one")
+		return r.config, nil
+	}
+	log.L.WithField("cert", r.certFile).Info("reloaded TLS certificate")
+	return r.config, nil
+}
+
+func (r *certReloader) latestModTime() (time.Time, error) {
+	var latest time.Time
+	for _, path := range []string{r.certFile, r.keyFile, r.clientCAFile} {
+		if path == "" {
+			continue
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// load reads the files; r.mu must be held.
+func (r *certReloader) load(modTime time.Time) error {
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("error loading TLS certificate: %w", err)
+	}
+	config := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{cert},
+		// Set by credentials.NewTLS on the outer config only.
+		NextProtos: []string{"h2"},
+	}
+	if r.clientCAFile != "" {
+		pem, err := os.ReadFile(r.clientCAFile)
+		if err != nil {
+			return fmt.Errorf("error loading client CA bundle: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates found in client CA bundle %s", r.clientCAFile)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	r.config = config
+	r.modTime = modTime
+	return nil
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeKeyPair writes a self-signed certificate for cn and its key, and
+// sets the modification time of both files to modTime.
+func writeKeyPair(t *testing.T, certFile, keyFile, cn string, modTime time.Time) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), modTime)
+	writeFile(t, keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), modTime)
+}
+
+func writeFile(t *testing.T, path string, p []byte, modTime time.Time) {
+	t.Helper()
+	if err := os.WriteFile(path, p, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func servedName(t *testing.T, r *certReloader) string {
+	t.Helper()
+	config, err := r.getConfig(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(config.Certificates[0].Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert.Subject.CommonName
+}
+
+func TestCertReloader(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	start := time.Now().Add(-time.Hour).Truncate(time.Second)
+	writeKeyPair(t, certFile, keyFile, "first", start)
+
+	r := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := r.load(start); err != nil {
+		t.Fatal(err)
+	}
+	if got := servedName(t, r); got != "first" {
+		t.Fatalf("served %q, want first", got)
+	}
+
+	// A new certificate is picked up.
+	writeKeyPair(t, certFile, keyFile, "second", start.Add(time.Minute))
+	if got := servedName(t, r); got != "second" {
+		t.Fatalf("served %q after rotation, want second", got)
+	}
+
+	// Only the certificate has been replaced: the previous pair is kept.
+	failed := start.Add(2 * time.Minute)
+	writeKeyPair(t, certFile, filepath.Join(dir, "other-key.pem"), "third", failed)
+	if got := servedName(t, r); got != "second" {
+		t.Fatalf("served %q with a mismatched key, want second", got)
+	}
+	if !r.failedModTime.Equal(failed) {
+		t.Fatalf("failedModTime = %v, want %v", r.failedModTime, failed)
+	}
+
+	// Files that failed aren't read again until they change, even though
+	// they would load now.
+	writeKeyPair(t, certFile, keyFile, "third", failed)
+	if got := servedName(t, r); got != "second" {
+		t.Fatalf("served %q without a change, want second", got)
+	}
+	if err := os.Chtimes(keyFile, failed.Add(time.Minute), failed.Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if got := servedName(t, r); got != "third" {
+		t.Fatalf("served %q after the key changed, want third", got)
+	}
+
+	// A missing file keeps the previous pair too.
+	if err := os.Remove(keyFile); err != nil {
+		t.Fatal(err)
+	}
+	if got := servedName(t, r); got != "third" || !r.missing {
+		t.Fatalf("served %q with the key missing, want third", got)
+	}
+	writeKeyPair(t, certFile, keyFile, "fourth", failed.Add(2*time.Minute))
+	if got := servedName(t, r); got != "fourth" || r.missing {
+		t.Fatalf("served %q once the key is back, want fourth", got)
+	}
+}
+
+func TestServerCredentialsErrors(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeKeyPair(t, certFile, keyFile, "server", time.Now())
+	notPEM := filepath.Join(dir, "ca.pem")
+	writeFile(t, notPEM, []byte("not a certificate"), time.Now())
+
+	tests := []struct {
+		name                            string
+		certFile, keyFile, clientCAFile string
+	}{
+		{"no certificate", "", keyFile, ""},
+		{"no key", certFile, "", ""},
+		{"missing certificate", filepath.Join(dir, "missing.pem"), keyFile, ""},
+		{"missing client CA", certFile, keyFile, filepath.Join(dir, "missing.pem")},
+		{"empty client CA bundle", certFile, keyFile, notPEM},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := serverCredentials(tt.certFile, tt.keyFile, tt.clientCAFile); err == nil {
+				t.Error("serverCredentials() succeeded")
+			}
+		})
+	}
+}
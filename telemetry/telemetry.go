@@ -0,0 +1,136 @@
+// Package telemetry sets up OpenTelemetry tracing for the client and the
+// server. Trace context is propagated over gRPC, so a single trace covers an
+// update on both sides, along with the containerd calls each side makes.
+package telemetry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/containerd/containerd/pkg/dialer"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.20.0"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/backoff"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// Setup Install a global tracer provider for service that sends spans to the
+// OTLP collector at otlpEndpoint, appends them as JSON to file, or both. The
+// endpoint is host:port, optionally with an http:// or https:// scheme;
+// plain http is the default. Tracing stays disabled when neither is given.
+// The returned function flushes the spans and stops the exporters.
+func Setup(ctx context.Context, service, otlpEndpoint, file string) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	if otlpEndpoint == "" && file == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(semconv.ServiceName(service)))
+	if err != nil {
+		return nil, err
+	}
+	opts := []sdktrace.TracerProviderOption{sdktrace.WithResource(res)}
+	var closers []func() error
+
+	if otlpEndpoint != "" {
+		endpointOpts := []otlptracegrpc.Option{otlptracegrpc.WithEndpoint(strings.TrimPrefix(otlpEndpoint, "http://"))}
+		if strings.HasPrefix(otlpEndpoint, "https://") {
+			endpointOpts[0] = otlptracegrpc.WithEndpoint(strings.TrimPrefix(otlpEndpoint, "https://"))
+		} else {
+			endpointOpts = append(endpointOpts, otlptracegrpc.WithInsecure())
+		}
+		exporter, err := otlptracegrpc.New(ctx, endpointOpts...)
+		if err != nil {
+			return nil, fmt.Errorf("error creating OTLP exporter for %s: %w", otlpEndpoint, err)
+		}
+		opts = append(opts, sdktrace.WithBatcher(exporter))
+	}
+
+	if file != "" {
+		f, err := os.OpenFile(file, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			return nil, fmt.Errorf("error opening trace file: %w", err)
+		}
+		exporter, err := stdouttrace.New(stdouttrace.WithWriter(f))
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		opts = append(opts, sdktrace.WithBatcher(exporter))
+		closers = append(closers, f.Close)
+	}
+
+	tp := sdktrace.NewTracerProvider(opts...)
+	otel.SetTracerProvider(tp)
+	return func(ctx context.Context) error {
+		err := tp.Shutdown(ctx)
+		for _, closer := range closers {
+			err = errors.Join(err, closer())
+		}
+		return err
+	}, nil
+}
+
+// StartSpan Start a span named cargosync.<name> as a child of the span in
+// ctx. End it with End.
+func StartSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer("deltadiff").Start(ctx, "cargosync."+name, trace.WithAttributes(attrs...))
+}
+
+// End End span, marking it failed if *err is set. It is meant to be
+// deferred with a pointer to a named error result.
+func End(span trace.Span, err *error) {
+	if err != nil && *err != nil {
+		span.RecordError(*err)
+		span.SetStatus(codes.Error, (*err).Error())
+	}
+	span.End()
+}
+
+// ServerOptions The interceptors that continue the trace of a client in
+// the spans of a gRPC server.
+func ServerOptions() []grpc.ServerOption {
+	return []grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(otelgrpc.UnaryServerInterceptor()),
+		grpc.ChainStreamInterceptor(otelgrpc.StreamServerInterceptor()),
+	}
+}
+
+// DialOptions The interceptors that trace the calls of a gRPC client and
+// propagate the trace to the server.
+func DialOptions() []grpc.DialOption {
+	return []grpc.DialOption{
+		grpc.WithChainUnaryInterceptor(otelgrpc.UnaryClientInterceptor()),
+		grpc.WithChainStreamInterceptor(otelgrpc.StreamClientInterceptor()),
+	}
+}
+
+// ContainerdDialOptions The dial options containerd.New uses by default,
+// which containerd.WithDialOpts replaces, plus DialOptions so that the
+// calls to containerd show up in the trace too.
+func ContainerdDialOptions() []grpc.DialOption {
+	backoffConfig := backoff.DefaultConfig
+	backoffConfig.MaxDelay = 3 * time.Second
+	return append([]grpc.DialOption{
+		grpc.WithBlock(),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.FailOnNonTempDialError(true),
+		grpc.WithConnectParams(grpc.ConnectParams{Backoff: backoffConfig}),
+		grpc.WithContextDialer(dialer.ContextDialer),
+		grpc.WithReturnConnectionError(),
+	}, DialOptions()...)
+}